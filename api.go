@@ -1,6 +1,7 @@
 package gossip
 
 import (
+	"context"
 	"github.com/libopenstorage/gossip/proto"
 	"github.com/libopenstorage/gossip/types"
 	"time"
@@ -12,19 +13,123 @@ type GossipStore interface {
 
 	// Update updates the value for this node.
 	// Side-effects include updating the last update ts
-	// for this node.
-	UpdateSelf(types.StoreKey, interface{})
+	// for this node. It returns an error if the update
+	// exceeds the configured size limits.
+	UpdateSelf(types.StoreKey, interface{}) error
+
+	// CompareAndSwapSelf updates the value of the key for this node
+	// only if the key is at the given version, as returned by
+	// GetKeyVersion. A version of 0 means the key must not be set.
+	// It returns false without updating the key if the version has
+	// changed.
+	CompareAndSwapSelf(key types.StoreKey, oldVersion uint64,
+		val interface{}) (bool, error)
+
+	// UpdateSelfMulti updates the values of all the keys for this node
+	// atomically. The keys are gossiped with a single version. No key
+	// is updated if the update exceeds the configured size limits.
+	UpdateSelfMulti(values types.StoreMap) error
+
+	// IncrementCounter increments this node's count in the grow-only
+	// counter (types.GCounter) of the key. Every node gossips all the
+	// contributions to the CRDT values it has seen, so the counts of a
+	// node are kept after it restarts or is removed.
+	IncrementCounter(key types.StoreKey, delta uint64) error
+
+	// AddCounter adds delta to this node's contribution to the
+	// counter (types.PNCounter) of the key.
+	AddCounter(key types.StoreKey, delta int64) error
+
+	// GetCounter returns the value of the merged counters of the key
+	// on the nodes with a valid status.
+	GetCounter(key types.StoreKey) (int64, error)
+
+	// AddToSet adds the elements to the set (types.ORSet) of the key.
+	AddToSet(key types.StoreKey, elements ...string) error
+
+	// RemoveFromSet removes the elements from the set of the key.
+	// Additions of the elements which this node has not seen yet
+	// are not removed.
+	RemoveFromSet(key types.StoreKey, elements ...string) error
+
+	// GetSet returns the elements of the merged sets of the key on
+	// the nodes with a valid status.
+	GetSet(key types.StoreKey) ([]string, error)
+
+	// SetRegister sets the register (types.LWWRegister) of the key.
+	// The concrete type of the value must be registered with gob.
+	SetRegister(key types.StoreKey, val interface{}) error
+
+	// GetRegister returns the register of the key set last by the
+	// nodes with a valid status.
+	GetRegister(key types.StoreKey) (types.LWWRegister, error)
 
 	// GetSelfStatus returns the node's status
 	GetSelfStatus() types.NodeStatus
 
-	// GetStoreValue returns the StoreValue associated with
-	// the given key
+	// GetStoreKeyValue returns the values of the given key on the
+	// nodes which have the key and whose status is not
+	// NODE_STATUS_INVALID or NODE_STATUS_NEVER_GOSSIPED, keyed by
+	// node id. Unlike earlier versions, the nodes which do not have
+	// the key are left out instead of being returned with a nil Value.
+	// Use QueryStoreKeyValue with IncludeMissing to get them too.
 	GetStoreKeyValue(key types.StoreKey) types.NodeValueMap
 
+	// QueryStoreKeyValue returns the values of the given key on the
+	// nodes selected by the options, keyed by node id. The nodes
+	// which do not have the key have a nil Value.
+	QueryStoreKeyValue(
+		key types.StoreKey,
+		opts types.QueryOptions,
+	) types.NodeValueMap
+
+	// GetFreshStoreKeyValue returns the values of the given key like
+	// GetStoreKeyValue leaving out the nodes whose info we received
+	// longer than maxStaleness ago
+	GetFreshStoreKeyValue(
+		key types.StoreKey,
+		maxStaleness time.Duration,
+	) types.NodeValueMap
+
 	// GetStoreKeys returns all the keys present in the store
 	GetStoreKeys() []types.StoreKey
 
+	// Get returns the value of a node's key without copying the
+	// node's other values. It returns false if the node or the key
+	// is not known.
+	Get(nodeId types.NodeId, key types.StoreKey) (types.NodeValue, bool)
+
+	// GetNodeKeys returns the keys of a node in order
+	GetNodeKeys(nodeId types.NodeId) []types.StoreKey
+
+	// ScanNodeKeys returns the values of a node's keys which start
+	// with the prefix
+	ScanNodeKeys(nodeId types.NodeId, prefix types.StoreKey) types.StoreMap
+
+	// ScanStoreKeys returns the values of the keys which start with
+	// the prefix on all the nodes, keyed by key
+	ScanStoreKeys(prefix types.StoreKey) map[types.StoreKey]types.NodeValueMap
+
+	// Namespace returns a handle to the namespace with the given name.
+	// Each namespace has its own key space which is gossiped along
+	// with the rest of the store.
+	Namespace(name string) types.Namespace
+
+	// GetNamespaces returns the namespaces present on any node
+	GetNamespaces() []string
+
+	// GetKeyVersion returns the version at which this node last set
+	// the key. It returns false if the key is not set.
+	GetKeyVersion(key types.StoreKey) (uint64, bool)
+
+	// GetAcknowledgements reports for every other node whether it has
+	// seen the given version of our key, as told by the digest of its
+	// view which it gossips.
+	GetAcknowledgements(
+		key types.StoreKey,
+		version uint64,
+	) (map[types.NodeId]types.Acknowledgement, error)
+
 	// Used for gossiping
 
 	// Update updates the current state of the gossip data
@@ -65,6 +170,10 @@ type Gossiper interface {
 	// GossipInterval gets the gossip interval
 	GossipInterval() time.Duration
 
+	// Clock returns the clock of the gossiper which timestamps the
+	// updates and drives its timers
+	Clock() types.Clock
+
 	// Stop stops the gossiping. Leave timeout indicates the minimum time
 	// required to successfully broadcast the leave message to all other nodes.
 	Stop(leaveTimeout time.Duration) error
@@ -72,13 +181,68 @@ type Gossiper interface {
 	// GetNodes returns a list of the connection addresses
 	GetNodes() []string
 
-	// UpdateCluster updates gossip with latest peer nodes info
+	// UpdateCluster updates gossip with latest peer nodes info. It also pins
+	// the public keys of the peers used for identity key authentication.
 	UpdateCluster(map[types.NodeId]types.NodeUpdate)
 
 	// ExternalNodeLeave is used to indicate gossip that one of the nodes might be down.
-	// It checks quorum and appropriately marks either self down or the other node down.
-	// It returns the nodeId that was marked down
-	ExternalNodeLeave(nodeId types.NodeId) types.NodeId
+	// It checks quorum, probes the node directly and through some of the peers
+	// and consults the peers' gossiped view of the node and ourselves. It returns
+	// a verdict with the nodeId that should be marked down, either self or the
+	// other node, and the evidence it is based upon. No node should be marked
+	// down if the other node is reachable or a majority of the peers see it UP.
+	ExternalNodeLeave(nodeId types.NodeId) types.NodeLeaveVerdict
+
+	// UpdateSelfMaintenance puts this node in or out of maintenance.
+	// A node in maintenance is alive but will be leaving soon. While
+	// in quorum its status is reported as NODE_STATUS_MAINTENANCE instead
+	// of NODE_STATUS_UP.
+	UpdateSelfMaintenance(maintenance bool)
+
+	// InstallKey installs a new encryption key on all the nodes.
+	// Encryption must be enabled at construction. The key is only used
+	// for decryption until it is made the primary key with UseKey.
+	// To rotate keys without downtime, install the new key on all nodes,
+	// use it and then remove the old key.
+	InstallKey(key []byte) error
+
+	// UseKey makes an installed key the primary encryption key
+	// on all the nodes. It fails until all the peers we see UP
+	// report that they hold the key.
+	UseKey(key []byte) error
+
+	// RemoveKey removes an encryption key from all the nodes.
+	// The primary key cannot be removed. It fails until all the
+	// peers we see UP report our primary key as theirs. Nodes
+	// which are down must be restarted with the current keys.
+	RemoveKey(key []byte) error
+
+	// ListKeys returns the encryption keys installed on this node.
+	// The first key is the primary key.
+	ListKeys() [][]byte
+
+	// GetStats returns the counters of the gossip activity of this node.
+	// The same activity is emitted as metrics to the MetricSink option.
+	GetStats() types.GossipStats
+
+	// GetDebugInfo returns a dump of this node's view of the cluster
+	// including its state, quorum math and recent transitions.
+	GetDebugInfo() types.DebugInfo
+
+	// InjectFaults makes this node misbehave as described by faults
+	// to test the reaction of the cluster and the application.
+	// It replaces the faults injected before. The zero value
+	// removes all the faults.
+	InjectFaults(faults types.GossipFaults)
+
+	// GetInjectedFaults returns the faults injected in this node.
+	GetInjectedFaults() types.GossipFaults
+
+	// WaitForConvergence blocks until all the peers we see UP or in
+	// MAINTENANCE have seen the current version of our key or the
+	// context is done. The peers in maintenance still gossip and
+	// serve the keys, so they are waited for too.
+	WaitForConvergence(ctx context.Context, key types.StoreKey) error
 }
 
 // New returns an initialized Gossip node
@@ -95,3 +259,23 @@ func New(
 	g.Init(ip, selfNodeId, genNumber, gossipIntervals, gossipVersion, clusterId)
 	return g
 }
+
+// NewWithOptions returns an initialized Gossip node like New
+// and applies the given optional settings
+func NewWithOptions(
+	ip string,
+	selfNodeId types.NodeId,
+	genNumber uint64,
+	gossipIntervals types.GossipIntervals,
+	gossipVersion string,
+	clusterId string,
+	options types.GossipOptions,
+) (Gossiper, error) {
+	g := new(proto.GossiperImpl)
+	err := g.InitWithOptions(ip, selfNodeId, genNumber, gossipIntervals,
+		gossipVersion, clusterId, options)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
@@ -0,0 +1,55 @@
+// gossipctl runs a gossip node and inspects the view of running nodes.
+//
+// Usage:
+//
+//	gossipctl start -addr 127.0.0.1:9000 -id 0 -http 127.0.0.1:8000 \
+//		-peers 1=127.0.0.1:9001,2=127.0.0.1:9002 -join 127.0.0.1:9001 \
+//		-set role=db
+//	gossipctl set -http 127.0.0.1:8000 role=web zone=a
+//	gossipctl status -http 127.0.0.1:8000 [-o table|json]
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"start", "Start a gossip node", runStart},
+	{"set", "Set keys on a running node", runSet},
+	{"status", "Print the view of a running node", runStatus},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: gossipctl <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'gossipctl <command> -h' for the flags "+
+		"of a command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+		if err := c.run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "gossipctl %s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	usage()
+	os.Exit(2)
+}
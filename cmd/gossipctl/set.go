@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+func runSet(args []string) error {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	httpAddr := fs.String("http", "127.0.0.1:8000",
+		"http address of the running node")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: gossipctl set [flags] key=value...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no keys given")
+	}
+
+	form := url.Values{}
+	for _, arg := range fs.Args() {
+		k, v, err := parseKeyValue(arg)
+		if err != nil {
+			return err
+		}
+		form.Set(k, v)
+	}
+	resp, err := httpClient.PostForm("http://"+*httpAddr+keysPath, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, body)
+	}
+	return nil
+}
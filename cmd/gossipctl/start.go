@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libopenstorage/gossip"
+	"github.com/libopenstorage/gossip/types"
+)
+
+const (
+	debugPath   = "/debug/gossip"
+	metricsPath = "/metrics"
+	keysPath    = "/keys"
+)
+
+// keyValues collects repeated key=value flags
+type keyValues map[string]string
+
+func (kv keyValues) String() string {
+	pairs := make([]string, 0, len(kv))
+	for k, v := range kv {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValues) Set(value string) error {
+	k, v, err := parseKeyValue(value)
+	if err != nil {
+		return err
+	}
+	kv[k] = v
+	return nil
+}
+
+func parseKeyValue(value string) (string, string, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return "", "", fmt.Errorf("expected key=value, got %q", value)
+	}
+	return value[:i], value[i+1:], nil
+}
+
+// parsePeers parses a comma separated list of quorum members given
+// as id=ip:port
+func parsePeers(value string) (map[types.NodeId]types.NodeUpdate, error) {
+	peers := make(map[types.NodeId]types.NodeUpdate)
+	if value == "" {
+		return peers, nil
+	}
+	for _, peer := range strings.Split(value, ",") {
+		id, addr, err := parseKeyValue(peer)
+		if err != nil {
+			return nil, fmt.Errorf("expected id=ip:port, got %q", peer)
+		}
+		peers[types.NodeId(id)] = types.NodeUpdate{
+			Addr:         addr,
+			QuorumMember: true,
+		}
+	}
+	return peers, nil
+}
+
+func runStart(args []string) error {
+	fs := flag.NewFlagSet("start", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9000", "gossip bind address ip:port")
+	nodeId := fs.String("id", "", "unique node id (required)")
+	clusterId := fs.String("cluster", "gossipctl", "cluster id")
+	version := fs.String("version", types.DEFAULT_GOSSIP_VERSION,
+		"gossip version")
+	peersFlag := fs.String("peers", "", "comma separated quorum members "+
+		"as id=ip:port")
+	join := fs.String("join", "", "comma separated ip:port of running "+
+		"nodes to join")
+	httpAddr := fs.String("http", "", "address serving the debug, "+
+		"metrics and keys endpoints")
+	gossipInterval := fs.Duration("gossip-interval",
+		types.DEFAULT_GOSSIP_INTERVAL, "gossip interval")
+	pushPullInterval := fs.Duration("push-pull-interval",
+		types.DEFAULT_PUSH_PULL_INTERVAL, "push/pull interval")
+	probeInterval := fs.Duration("probe-interval",
+		types.DEFAULT_PROBE_INTERVAL, "probe interval")
+	probeTimeout := fs.Duration("probe-timeout",
+		types.DEFAULT_PROBE_TIMEOUT, "probe timeout")
+	quorumTimeout := fs.Duration("quorum-timeout",
+		types.DEFAULT_QUORUM_TIMEOUT, "quorum timeout")
+	leaveTimeout := fs.Duration("leave-timeout", 5*time.Second,
+		"timeout of the leave on shutdown")
+	keys := make(keyValues)
+	fs.Var(keys, "set", "key=value set on this node, can be repeated")
+	fs.Parse(args)
+
+	if *nodeId == "" {
+		return fmt.Errorf("-id is required")
+	}
+	peers, err := parsePeers(*peersFlag)
+	if err != nil {
+		return err
+	}
+	peers[types.NodeId(*nodeId)] = types.NodeUpdate{
+		Addr:         *addr,
+		QuorumMember: true,
+	}
+
+	intervals := types.GossipIntervals{
+		GossipInterval:   *gossipInterval,
+		PushPullInterval: *pushPullInterval,
+		ProbeInterval:    *probeInterval,
+		ProbeTimeout:     *probeTimeout,
+		QuorumTimeout:    *quorumTimeout,
+	}
+	g, err := gossip.NewWithOptions(*addr, types.NodeId(*nodeId), 1,
+		intervals, *version, *clusterId, types.GossipOptions{})
+	if err != nil {
+		return err
+	}
+	for k, v := range keys {
+		if err := g.UpdateSelf(types.StoreKey(k), v); err != nil {
+			return err
+		}
+	}
+	var knownIps []string
+	if *join != "" {
+		knownIps = strings.Split(*join, ",")
+	}
+	if err := g.Start(knownIps); err != nil {
+		return err
+	}
+	g.UpdateCluster(peers)
+
+	if *httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle(debugPath, gossip.NewDebugHandler(g))
+		mux.Handle(metricsPath, gossip.NewPrometheusHandler(g))
+		mux.Handle(keysPath, &keysHandler{g: g})
+		go func() {
+			if err := http.ListenAndServe(*httpAddr, mux); err != nil {
+				fmt.Fprintf(os.Stderr, "gossipctl start: %v\n", err)
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	return g.Stop(*leaveTimeout)
+}
+
+// keysHandler sets the keys posted as form values on this node at once
+type keysHandler struct {
+	g gossip.Gossiper
+}
+
+func (h *keysHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values := make(types.StoreMap)
+	for k := range r.PostForm {
+		values[types.StoreKey(k)] = r.PostForm.Get(k)
+	}
+	// Apply the keys in a single update so that they are gossiped together
+	if err := h.g.UpdateSelfMulti(values); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
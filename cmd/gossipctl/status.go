@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+var nodeStatusNames = map[types.NodeStatus]string{
+	types.NODE_STATUS_INVALID:               "INVALID",
+	types.NODE_STATUS_UP:                    "UP",
+	types.NODE_STATUS_DOWN:                  "DOWN",
+	types.NODE_STATUS_NEVER_GOSSIPED:        "NEVER_GOSSIPED",
+	types.NODE_STATUS_NOT_IN_QUORUM:         "NOT_IN_QUORUM",
+	types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM: "SUSPECT_NOT_IN_QUORUM",
+	types.NODE_STATUS_MAINTENANCE:           "MAINTENANCE",
+}
+
+func statusName(status types.NodeStatus) string {
+	if name, ok := nodeStatusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", status)
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	httpAddr := fs.String("http", "127.0.0.1:8000",
+		"http address of the running node")
+	output := fs.String("o", "table", "output format: table or json")
+	fs.Parse(args)
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	resp, err := httpClient.Get("http://" + *httpAddr + debugPath)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %s", resp.Status, body)
+	}
+	if *output == "json" {
+		_, err := os.Stdout.Write(body)
+		return err
+	}
+	var info types.DebugInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		return err
+	}
+	printStatus(os.Stdout, &info)
+	return nil
+}
+
+// printStatus prints the node's status, the members and the keys
+// of all the nodes as tables
+func printStatus(out io.Writer, info *types.DebugInfo) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NODE\tCLUSTER\tVERSION\tSTATUS\tQUORUM\n")
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v/%v (need %v)\n", info.NodeId,
+		info.ClusterId, info.GossipVersion, statusName(info.Status),
+		info.Quorum.QuorumMembersUp, info.Quorum.QuorumMembers,
+		info.Quorum.QuorumNeeded)
+	w.Flush()
+	fmt.Fprintln(out)
+
+	members := append([]types.DebugMember{}, info.Members...)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].NodeId < members[j].NodeId
+	})
+	fmt.Fprintf(w, "MEMBER\tADDR\tVERSION\tSTATUS\tLAST UPDATE\n")
+	for _, member := range members {
+		nodeInfo := info.NodeInfoMap[member.NodeId]
+		fmt.Fprintf(w, "%v\t%v:%v\t%v\t%v\t%v\n", member.NodeId,
+			member.Addr, member.Port, member.GossipVersion,
+			statusName(nodeInfo.Status), formatTs(nodeInfo.LastUpdateTs))
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+
+	ids := make([]string, 0, len(info.NodeInfoMap))
+	for id := range info.NodeInfoMap {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	fmt.Fprintf(w, "NODE\tKEY\tVALUE\n")
+	for _, id := range ids {
+		values := info.NodeInfoMap[types.NodeId(id)].Value
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, string(key))
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", id, key,
+				values[types.StoreKey(key)])
+		}
+	}
+	w.Flush()
+}
+
+func formatTs(ts time.Time) string {
+	if ts.IsZero() {
+		return "-"
+	}
+	return time.Since(ts).Truncate(time.Millisecond).String() + " ago"
+}
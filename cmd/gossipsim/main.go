@@ -0,0 +1,120 @@
+// gossipsim simulates a gossip cluster in-process and reports how fast
+// updates and failures spread.
+//
+// Usage:
+//
+//	gossipsim -nodes 200 -updates 50 -failures 5 -drop-rate 0.01 \
+//		-push-pull-interval 2s [-o table|json]
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/libopenstorage/gossip/simulator"
+	"github.com/libopenstorage/gossip/types"
+)
+
+func main() {
+	nodes := flag.Int("nodes", 50, "number of nodes")
+	updates := flag.Int("updates", 20, "number of key updates")
+	failures := flag.Int("failures", 0, "number of crashed nodes")
+	eventInterval := flag.Duration("event-interval", 0,
+		"time between the updates and failures, defaults to the "+
+			"push/pull interval")
+	timeout := flag.Duration("timeout", 5*time.Minute,
+		"time after which an update or failure has not converged")
+	dropRate := flag.Float64("drop-rate", 0, "probability of a packet drop")
+	delay := flag.Duration("delay", 0, "delay of the packets")
+	seed := flag.Int64("seed", 1, "seed of the simulation")
+	gossipInterval := flag.Duration("gossip-interval",
+		types.DEFAULT_GOSSIP_INTERVAL, "gossip interval")
+	pushPullInterval := flag.Duration("push-pull-interval",
+		types.DEFAULT_PUSH_PULL_INTERVAL, "push/pull interval")
+	probeInterval := flag.Duration("probe-interval",
+		types.DEFAULT_PROBE_INTERVAL, "probe interval")
+	probeTimeout := flag.Duration("probe-timeout",
+		types.DEFAULT_PROBE_TIMEOUT, "probe timeout")
+	quorumTimeout := flag.Duration("quorum-timeout",
+		types.DEFAULT_QUORUM_TIMEOUT, "quorum timeout")
+	output := flag.String("o", "table", "output format: table or json")
+	flag.Parse()
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "gossipsim: unknown output format %q\n",
+			*output)
+		os.Exit(2)
+	}
+
+	start := time.Now()
+	report, err := simulator.Run(simulator.Config{
+		Nodes: *nodes,
+		Intervals: types.GossipIntervals{
+			GossipInterval:   *gossipInterval,
+			PushPullInterval: *pushPullInterval,
+			ProbeInterval:    *probeInterval,
+			ProbeTimeout:     *probeTimeout,
+			QuorumTimeout:    *quorumTimeout,
+		},
+		Updates:       *updates,
+		Failures:      *failures,
+		EventInterval: *eventInterval,
+		Timeout:       *timeout,
+		DropRate:      *dropRate,
+		Delay:         *delay,
+		Seed:          *seed,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gossipsim: %v\n", err)
+		os.Exit(1)
+	}
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+	printReport(os.Stdout, report)
+	fmt.Printf("\nsimulated %v in %v\n", report.StartupTime+report.Duration,
+		time.Since(start).Truncate(time.Millisecond))
+}
+
+// printReport prints the report as tables
+func printReport(out io.Writer, report *simulator.Report) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NODES\tSTARTUP\tDURATION\tFALSE DOWN\n")
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", report.Nodes, report.StartupTime,
+		report.Duration, report.FalseDown)
+	w.Flush()
+	fmt.Fprintln(out)
+
+	fmt.Fprintf(w, "\tCOUNT\tUNCONVERGED\tMIN\tMEAN\tP50\tP90\tP99\tMAX\n")
+	for _, row := range []struct {
+		name string
+		d    simulator.Distribution
+	}{
+		{"updates", report.Convergence},
+		{"failures", report.Detection},
+	} {
+		d := row.d
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", row.name,
+			d.Count, d.Unconverged, d.Min, d.Mean, d.P50, d.P90, d.P99,
+			d.Max)
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+
+	fmt.Fprintf(w, "BYTES SENT\tBYTES RECEIVED\tPER NODE PER SECOND\n")
+	perNodeSecond := 0.0
+	if seconds := report.Duration.Seconds(); seconds > 0 {
+		perNodeSecond = float64(report.BytesSent) / seconds /
+			float64(report.Nodes)
+	}
+	fmt.Fprintf(w, "%v\t%v\t%.0f\n", report.BytesSent, report.BytesReceived,
+		perNodeSecond)
+	w.Flush()
+}
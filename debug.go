@@ -0,0 +1,29 @@
+package gossip
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// debugHandler serves the gossiper's debug info as JSON
+type debugHandler struct {
+	g Gossiper
+}
+
+// NewDebugHandler returns an http.Handler which serves a JSON dump of the
+// gossiper's view of the cluster: the local node info map, the memberlist
+// members, the current state, the quorum math and the recent transitions.
+// It can be mounted on an existing admin server.
+func NewDebugHandler(g Gossiper) http.Handler {
+	return &debugHandler{g: g}
+}
+
+func (h *debugHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	buf, err := json.MarshalIndent(h.g.GetDebugInfo(), "", "  ")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(buf)
+}
@@ -0,0 +1,61 @@
+package gossip
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+func TestDebugHandler(t *testing.T) {
+	gossipers := startSimCluster(t, []string{"10.0.0.1:9000", "10.0.0.2:9000"})
+	defer func() {
+		for _, g := range gossipers {
+			g.Stop(0)
+		}
+	}()
+	gossipers[0].UpdateSelf("key", "value")
+
+	rec := httptest.NewRecorder()
+	NewDebugHandler(gossipers[0]).ServeHTTP(rec,
+		httptest.NewRequest("GET", "/debug", nil))
+	if rec.Code != 200 {
+		t.Fatal("Expected status 200, got ", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Error("Unexpected content type ", ct)
+	}
+
+	var dump map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &dump); err != nil {
+		t.Fatal("Error in unmarshalling the dump: ", err)
+	}
+	for _, field := range []string{"NodeId", "ClusterId", "GossipVersion",
+		"State", "Status", "NodeInfoMap", "Members", "Quorum",
+		"Transitions", "Stats", "Faults"} {
+		if _, ok := dump[field]; !ok {
+			t.Error("Expected field ", field, " in the dump")
+		}
+	}
+
+	var info types.DebugInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal("Error in unmarshalling the dump: ", err)
+	}
+	if info.NodeId != "0" || info.ClusterId != "cluster" ||
+		info.Status != types.NODE_STATUS_UP {
+		t.Error("Unexpected node in the dump: ", info.NodeId, " ",
+			info.ClusterId, " ", info.Status)
+	}
+	if len(info.NodeInfoMap) != 2 || info.NodeInfoMap["0"].Value["key"] != "value" {
+		t.Error("Unexpected node info map in the dump: ", info.NodeInfoMap)
+	}
+	if len(info.Members) != 2 {
+		t.Error("Expected 2 members in the dump, got ", info.Members)
+	}
+	if info.Quorum.QuorumMembers != 2 || info.Quorum.QuorumMembersUp != 2 ||
+		!info.Quorum.InQuorum {
+		t.Error("Unexpected quorum in the dump: ", info.Quorum)
+	}
+}
@@ -0,0 +1,189 @@
+package gossip
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+var nodeStatusNames = map[types.NodeStatus]string{
+	types.NODE_STATUS_INVALID:               "invalid",
+	types.NODE_STATUS_UP:                    "up",
+	types.NODE_STATUS_DOWN:                  "down",
+	types.NODE_STATUS_NEVER_GOSSIPED:        "never_gossiped",
+	types.NODE_STATUS_NOT_IN_QUORUM:         "not_in_quorum",
+	types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM: "suspect_not_in_quorum",
+	types.NODE_STATUS_MAINTENANCE:           "maintenance",
+}
+
+// prometheusHandler renders the gossiper's view of the cluster in the
+// Prometheus text exposition format
+type prometheusHandler struct {
+	g Gossiper
+}
+
+// NewPrometheusHandler returns an http.Handler which renders the node
+// statuses, quorum state, per node update age and key counts and the
+// gossip traffic counters in the Prometheus text exposition format.
+func NewPrometheusHandler(g Gossiper) http.Handler {
+	return &prometheusHandler{g: g}
+}
+
+// promWriter writes metric families in the Prometheus text format
+type promWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *promWriter) family(name, metricType, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n",
+		name, help, name, metricType)
+}
+
+func (w *promWriter) sample(name string, labels []string, value float64) {
+	w.buf.WriteString(name)
+	if len(labels) != 0 {
+		w.buf.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i != 0 {
+				w.buf.WriteString(",")
+			}
+			fmt.Fprintf(&w.buf, "%s=\"%s\"", labels[i],
+				escapeLabelValue(labels[i+1]))
+		}
+		w.buf.WriteString("}")
+	}
+	fmt.Fprintf(&w.buf, " %v\n", value)
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
+
+// receivedTimes returns when the gossiper last received the info of
+// every node, as reported with the values of the nodes. It is zero for
+// the nodes whose info was never received.
+func receivedTimes(g Gossiper) map[types.NodeId]time.Time {
+	opts := types.QueryOptions{IncludeMissing: true}
+	for status := types.NODE_STATUS_INVALID; status <= types.NODE_STATUS_MAINTENANCE; status++ {
+		opts.Statuses = append(opts.Statuses, status)
+	}
+	received := make(map[types.NodeId]time.Time)
+	for id, value := range g.QueryStoreKeyValue("", opts) {
+		received[id] = value.ReceivedTs
+	}
+	return received
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (h *prometheusHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w := &promWriter{}
+	now := h.g.Clock().Now()
+	selfId := h.g.NodeId()
+	selfLabels := []string{"node", string(selfId)}
+	selfStatus := h.g.GetSelfStatus()
+	stats := h.g.GetStats()
+	nodeInfoMap := h.g.GetLocalState()
+	received := receivedTimes(h.g)
+	ids := make([]string, 0, len(nodeInfoMap))
+	for id := range nodeInfoMap {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+
+	w.family("gossip_self_status", "gauge",
+		"Status of this node. The status label is set to 1.")
+	for status := types.NODE_STATUS_INVALID; status <= types.NODE_STATUS_MAINTENANCE; status++ {
+		w.sample("gossip_self_status",
+			[]string{"node", string(selfId), "status", nodeStatusNames[status]},
+			boolValue(status == selfStatus))
+	}
+	w.family("gossip_self_in_quorum", "gauge",
+		"Whether this node is in quorum.")
+	w.sample("gossip_self_in_quorum", selfLabels,
+		boolValue(selfStatus == types.NODE_STATUS_UP ||
+			selfStatus == types.NODE_STATUS_MAINTENANCE))
+	w.family("gossip_quorum_members", "gauge",
+		"Number of quorum members.")
+	w.sample("gossip_quorum_members", selfLabels,
+		float64(stats.QuorumMembers))
+	w.family("gossip_quorum_members_up", "gauge",
+		"Number of quorum members which are up.")
+	w.sample("gossip_quorum_members_up", selfLabels,
+		float64(stats.QuorumMembersUp))
+
+	w.family("gossip_node_status", "gauge",
+		"Status of a node as seen by this node.")
+	for _, id := range ids {
+		nodeInfo := nodeInfoMap[types.NodeId(id)]
+		w.sample("gossip_node_status",
+			[]string{"node", id, "status", nodeStatusNames[nodeInfo.Status]}, 1)
+	}
+	w.family("gossip_node_quorum_member", "gauge",
+		"Whether a node is a quorum member.")
+	for _, id := range ids {
+		w.sample("gossip_node_quorum_member", []string{"node", id},
+			boolValue(nodeInfoMap[types.NodeId(id)].QuorumMember))
+	}
+	w.family("gossip_node_last_update_age_seconds", "gauge",
+		"Seconds since this node last received the info of a node.")
+	for _, id := range ids {
+		receivedTs := received[types.NodeId(id)]
+		if receivedTs.IsZero() {
+			continue
+		}
+		w.sample("gossip_node_last_update_age_seconds", []string{"node", id},
+			now.Sub(receivedTs).Seconds())
+	}
+	w.family("gossip_node_keys", "gauge",
+		"Number of keys in the store of a node.")
+	for _, id := range ids {
+		nodeInfo := nodeInfoMap[types.NodeId(id)]
+		numKeys := len(nodeInfo.Value)
+		for _, values := range nodeInfo.Namespaces {
+			numKeys += len(values)
+		}
+		w.sample("gossip_node_keys", []string{"node", id}, float64(numKeys))
+	}
+
+	w.family("gossip_push_pull_merges_total", "counter",
+		"Number of push/pull states merged.")
+	w.sample("gossip_push_pull_merges_total", selfLabels, float64(stats.Merges))
+	w.family("gossip_push_pull_sent_bytes_total", "counter",
+		"Number of push/pull bytes sent.")
+	w.sample("gossip_push_pull_sent_bytes_total", selfLabels,
+		float64(stats.BytesSent))
+	w.family("gossip_push_pull_received_bytes_total", "counter",
+		"Number of push/pull bytes received.")
+	w.sample("gossip_push_pull_received_bytes_total", selfLabels,
+		float64(stats.BytesReceived))
+	w.family("gossip_state_transitions_total", "counter",
+		"Number of status changes of this node.")
+	w.sample("gossip_state_transitions_total", selfLabels,
+		float64(stats.StateTransitions))
+	w.family("gossip_forged_updates_total", "counter",
+		"Number of rejected forged node infos.")
+	w.sample("gossip_forged_updates_total", selfLabels,
+		float64(stats.ForgedUpdates))
+	if !stats.LastGossipTs.IsZero() {
+		w.family("gossip_last_gossip_age_seconds", "gauge",
+			"Seconds since the last gossip with a peer.")
+		w.sample("gossip_last_gossip_age_seconds", selfLabels,
+			now.Sub(stats.LastGossipTs).Seconds())
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.Write(w.buf.Bytes())
+}
@@ -0,0 +1,137 @@
+package gossip
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/gossip/proto"
+	"github.com/libopenstorage/gossip/types"
+)
+
+// startSimCluster starts gossipers for the addresses on a simulated
+// network and lets them see each other up
+func startSimCluster(t *testing.T, addrs []string) []Gossiper {
+	n := proto.NewSimNetwork(1)
+	peers := make(map[types.NodeId]types.NodeUpdate)
+	for i, addr := range addrs {
+		peers[types.NodeId(strconv.Itoa(i))] = types.NodeUpdate{
+			Addr:         addr,
+			QuorumMember: true,
+		}
+	}
+	intervals := types.GossipIntervals{
+		GossipInterval:   types.DEFAULT_GOSSIP_INTERVAL,
+		PushPullInterval: types.DEFAULT_PUSH_PULL_INTERVAL,
+		ProbeInterval:    types.DEFAULT_PROBE_INTERVAL,
+		ProbeTimeout:     types.DEFAULT_PROBE_TIMEOUT,
+		QuorumTimeout:    types.DEFAULT_QUORUM_TIMEOUT,
+	}
+	var gossipers []Gossiper
+	for i, addr := range addrs {
+		g, err := n.NewGossiper(addr, types.NodeId(strconv.Itoa(i)), 1,
+			intervals, types.DEFAULT_GOSSIP_VERSION, "cluster",
+			types.GossipOptions{})
+		if err != nil {
+			t.Fatal("Error in creating gossiper: ", err)
+		}
+		var knownIps []string
+		if i != 0 {
+			knownIps = []string{addrs[0]}
+		}
+		if err := g.Start(knownIps); err != nil {
+			t.Fatal("Error in starting gossiper: ", err)
+		}
+		g.UpdateCluster(peers)
+		gossipers = append(gossipers, g)
+	}
+	n.Advance(time.Minute)
+	return gossipers
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	gossipers := startSimCluster(t, []string{"10.0.0.1:9000", "10.0.0.2:9000"})
+	defer func() {
+		for _, g := range gossipers {
+			g.Stop(0)
+		}
+	}()
+
+	rec := httptest.NewRecorder()
+	NewPrometheusHandler(gossipers[0]).ServeHTTP(rec,
+		httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatal("Expected status 200, got ", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Error("Unexpected content type ", ct)
+	}
+
+	body := rec.Body.String()
+	for _, expected := range []string{
+		"# TYPE gossip_self_status gauge\n",
+		"gossip_self_status{node=\"0\",status=\"up\"} 1\n",
+		"gossip_self_status{node=\"0\",status=\"down\"} 0\n",
+		"gossip_self_in_quorum{node=\"0\"} 1\n",
+		"gossip_quorum_members{node=\"0\"} 2\n",
+		"gossip_quorum_members_up{node=\"0\"} 2\n",
+		"gossip_node_status{node=\"1\",status=\"up\"} 1\n",
+		"gossip_node_quorum_member{node=\"1\"} 1\n",
+		"# TYPE gossip_push_pull_merges_total counter\n",
+		"gossip_push_pull_merges_total{node=\"0\"} ",
+		"gossip_state_transitions_total{node=\"0\"} ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Error("Expected ", strings.TrimSpace(expected), " in:\n", body)
+		}
+	}
+
+	// The ages follow the simulated clock of the gossiper
+	for _, name := range []string{
+		"gossip_node_last_update_age_seconds{node=\"1\"}",
+		"gossip_last_gossip_age_seconds{node=\"0\"}",
+	} {
+		age := regexp.MustCompile("(?m)^" + regexp.QuoteMeta(name) + " (\\S+)$").
+			FindStringSubmatch(body)
+		if age == nil {
+			t.Error("Expected ", name, " in:\n", body)
+			continue
+		}
+		seconds, err := strconv.ParseFloat(age[1], 64)
+		if err != nil || seconds < 0 || seconds > types.DEFAULT_PUSH_PULL_INTERVAL.Seconds() {
+			t.Error("Unexpected ", name, " ", age[1])
+		}
+	}
+
+	// Every sample is well formed and follows the type of its family
+	sample := regexp.MustCompile(`^([a-z_]+)(\{[a-z_]+="[^"]*"(,[a-z_]+="[^"]*")*\})? \S+$`)
+	typed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			typed[strings.Fields(line)[2]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		match := sample.FindStringSubmatch(line)
+		if match == nil {
+			t.Error("Malformed sample: ", line)
+			continue
+		}
+		if !typed[match[1]] {
+			t.Error("Sample without a type: ", line)
+		}
+	}
+}
+
+func TestPrometheusLabelEscaping(t *testing.T) {
+	w := &promWriter{}
+	w.sample("metric", []string{"label", "a\"b\\c\nd"}, 1)
+	if expected := "metric{label=\"a\\\"b\\\\c\\nd\"} 1\n"; w.buf.String() != expected {
+		t.Error("Expected ", expected, " got ", w.buf.String())
+	}
+}
@@ -4,14 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
-	"os"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	log "github.com/sirupsen/logrus"
-	"github.com/hashicorp/logutils"
 	ml "github.com/hashicorp/memberlist"
 	"github.com/libopenstorage/gossip/types"
 )
@@ -23,6 +21,26 @@ type GossipNode struct {
 
 type GossipNodeList []GossipNode
 
+// memberList is the membership layer of the gossiper. It is implemented
+// by memberlist and by the simulated network.
+type memberList interface {
+	Members() []*ml.Node
+	Join(existing []string) (int, error)
+	Leave(timeout time.Duration) error
+	Shutdown() error
+	Ping(node string, addr net.Addr) (time.Duration, error)
+	SendToUDP(to *ml.Node, msg []byte) error
+}
+
+// createMemberlist creates a memberlist listening on the network
+func createMemberlist(conf *ml.Config) (memberList, error) {
+	list, err := ml.Create(conf)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
 func (nodes GossipNodeList) Len() int {
 	return len(nodes)
 }
@@ -42,7 +60,8 @@ type GossiperImpl struct {
 	GossipDelegate
 
 	mlConf *ml.Config
-	mlist  *ml.Memberlist
+	// newMemberList creates the membership layer on Start
+	newMemberList func(conf *ml.Config) (memberList, error)
 
 	// node list, maintained separately
 	nodes          GossipNodeList
@@ -51,11 +70,13 @@ type GossiperImpl struct {
 	gossipInterval time.Duration
 	//nodeDeathInterval time.Duration
 	shutDown bool
+	// closed to stop emitting the periodic metrics
+	stopMetrics chan struct{}
 }
 
 // Utility methods
-func logAndGetError(msg string) error {
-	log.Error(msg)
+func (g *GossiperImpl) logAndGetError(msg string) error {
+	g.log(types.LOG_COMPONENT_GOSSIP).Errorf("%s", msg)
 	return errors.New(msg)
 }
 
@@ -67,6 +88,23 @@ func (g *GossiperImpl) Init(
 	gossipVersion string,
 	clusterId string,
 ) {
+	// Default options are always valid
+	g.InitWithOptions(ipPort, selfNodeId, genNumber, gossipIntervals,
+		gossipVersion, clusterId, types.GossipOptions{})
+}
+
+// InitWithOptions initializes the gossiper like Init and additionally
+// applies the given optional settings. It returns an error if the
+// options are invalid.
+func (g *GossiperImpl) InitWithOptions(
+	ipPort string,
+	selfNodeId types.NodeId,
+	genNumber uint64,
+	gossipIntervals types.GossipIntervals,
+	gossipVersion string,
+	clusterId string,
+	options types.GossipOptions,
+) error {
 	g.name = ipPort
 	g.shutDown = false
 
@@ -94,6 +132,9 @@ func (g *GossiperImpl) Init(
 	// ProbeInterval used for broadcasts and decides probing behavior
 	mlConf.ProbeInterval = gossipIntervals.ProbeInterval
 
+	if options.Clock != nil {
+		g.clock = options.Clock
+	}
 	// MemberDelegates
 	g.InitGossipDelegate(
 		genNumber,
@@ -102,39 +143,89 @@ func (g *GossiperImpl) Init(
 		gossipIntervals.QuorumTimeout,
 		clusterId,
 	)
+	logger, err := newGossipLogger(options.Logger, options.LogLevels,
+		selfNodeId, clusterId)
+	if err != nil {
+		return err
+	}
+	g.logger = logger
+	g.peerConfirmedQuorum = options.PeerConfirmedQuorum
+	g.maintenanceQuorumPolicy = options.MaintenanceQuorumPolicy
+	keyring, err := newGossipKeyring(options.EncryptionKey,
+		options.EncryptionKeys)
+	if err != nil {
+		return err
+	}
+	g.keyring = keyring
+	g.updateSelfKeyring(keyring.fingerprints())
+	if options.MaxKeySize < 0 || options.MaxNodeSize < 0 {
+		return fmt.Errorf("gossip: Size limits cannot be negative")
+	}
+	if options.Compression > types.COMPRESSION_FLATE {
+		return fmt.Errorf("gossip: Unknown compression type %v",
+			options.Compression)
+	}
+	g.compression = options.Compression
+	g.metrics, err = newGossipMetrics(options.MetricSink)
+	if err != nil {
+		return err
+	}
+	err = validateVersionRange(gossipVersion, options.MinGossipVersion,
+		options.MaxGossipVersion)
+	if err != nil {
+		return err
+	}
+	g.minGossipVersion = options.MinGossipVersion
+	g.maxGossipVersion = options.MaxGossipVersion
+	g.limits = storeLimits{
+		maxKeySize:  options.MaxKeySize,
+		maxNodeSize: options.MaxNodeSize,
+	}
+	g.auth, err = newNodeAuthenticator(options.AuthSecret, options.IdentityKey)
+	if err != nil {
+		return err
+	}
+	mlConf.Keyring = keyring.keyring
+	g.broadcasts.RetransmitMult = mlConf.RetransmitMult
 	mlConf.Delegate = ml.Delegate(g)
 	mlConf.Events = ml.EventDelegate(g)
 	mlConf.Alive = ml.AliveDelegate(g)
 	mlConf.Merge = ml.MergeDelegate(g)
-	filter := &logutils.LevelFilter{
-		Levels:   []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERROR"},
-		MinLevel: logutils.LogLevel("INFO"),
-		Writer:   os.Stderr,
+	mlConf.LogOutput = &memberlistLogWriter{
+		logger: g.log(types.LOG_COMPONENT_MEMBERLIST),
 	}
-	mlConf.LogOutput = filter
 
 	g.mlConf = mlConf
+	if g.newMemberList == nil {
+		g.newMemberList = createMemberlist
+	}
 	rand.Seed(time.Now().UnixNano())
+	return nil
 }
 
 func (g *GossiperImpl) Start(knownIps []string) error {
 	g.InitCurrentState(uint(len(knownIps) + 1))
-	list, err := ml.Create(g.mlConf)
+	list, err := g.newMemberList(g.mlConf)
 	if err != nil {
-		log.Warnf("gossip: Unable to create memberlist: " + err.Error())
+		g.log(types.LOG_COMPONENT_GOSSIP).Warnf("gossip: Unable to create "+
+			"memberlist: %v", err)
 		return err
 	}
 	// Set the memberlist in gossiper object
 	g.mlist = list
+	g.stopMetrics = make(chan struct{})
+	g.emitMetrics(g.stopMetrics)
 
 	if len(knownIps) != 0 {
 		// Joining an existing cluster
 		joinedNodes, err := list.Join(knownIps)
 		if err != nil {
-			log.Infof("gossip: Unable to join other nodes at startup : %v", err)
+			g.log(types.LOG_COMPONENT_GOSSIP).Infof("gossip: Unable to join "+
+				"other nodes at startup : %v", err)
 			return err
 		}
-		log.Infof("gossip: Successfully joined with %v node(s)", joinedNodes)
+		g.log(types.LOG_COMPONENT_GOSSIP).Infof("gossip: Successfully "+
+			"joined with %v node(s)", joinedNodes)
 	}
 	return nil
 }
@@ -151,14 +242,33 @@ func (g *GossiperImpl) Stop(leaveTimeout time.Duration) error {
 	if err != nil {
 		return err
 	}
+	close(g.stopMetrics)
 	g.shutDown = true
 	return nil
 }
 
+// emitMetrics emits the periodic metrics every gossip interval of our
+// clock until stopped
+func (g *GossiperImpl) emitMetrics(stop chan struct{}) {
+	g.clock.AfterFunc(g.gossipInterval, func() {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		g.emitPeriodicMetrics()
+		g.emitMetrics(stop)
+	})
+}
+
 func (g *GossiperImpl) GossipInterval() time.Duration {
 	return g.gossipInterval
 }
 
+func (g *GossiperImpl) Clock() types.Clock {
+	return g.clock
+}
+
 func (g *GossiperImpl) GetNodes() []string {
 	nodes := g.mlist.Members()
 	nodeList := make([]string, len(nodes))
@@ -169,19 +279,97 @@ func (g *GossiperImpl) GetNodes() []string {
 }
 
 func (g *GossiperImpl) UpdateCluster(peers map[types.NodeId]types.NodeUpdate) {
+	g.auth.updateKeys(peers)
 	g.updateCluster(peers)
 	g.triggerStateEvent(types.UPDATE_CLUSTER_SIZE)
 }
 
-func (g *GossiperImpl) ExternalNodeLeave(nodeId types.NodeId) types.NodeId {
-	log.Infof("gossip: Request for a Node Leave operation on Node %v", nodeId)
-	if g.GetSelfStatus() == types.NODE_STATUS_UP {
-		log.Infof("gossip: Node %v should go down.", nodeId)
-		return nodeId
-	} else {
+func (g *GossiperImpl) UpdateSelfMaintenance(maintenance bool) {
+	g.updateSelfMaintenance(maintenance)
+	g.triggerStateEvent(types.UPDATE_CLUSTER_SIZE)
+}
+
+func (g *GossiperImpl) ExternalNodeLeave(
+	nodeId types.NodeId,
+) types.NodeLeaveVerdict {
+	g.log(types.LOG_COMPONENT_QUORUM).Infof("gossip: Request for a Node "+
+		"Leave operation on Node %v", nodeId)
+	verdict := types.NodeLeaveVerdict{
+		Target:     nodeId,
+		SelfStatus: g.GetSelfStatus(),
+	}
+	verdict.TargetProbed, verdict.TargetReachable = g.probeNode(nodeId)
+	if !verdict.TargetReachable {
+		verdict.IndirectProbes = g.indirectProbe(nodeId)
+		for _, reachable := range verdict.IndirectProbes {
+			verdict.TargetReachable = verdict.TargetReachable || reachable
+		}
+	}
+	g.collectPeerReports(&verdict)
+
+	peersReportingTargetUp := uint(0)
+	for _, status := range verdict.PeerReports {
+		if status == types.NODE_STATUS_UP ||
+			status == types.NODE_STATUS_MAINTENANCE {
+			peersReportingTargetUp++
+		}
+	}
+	peersReportingTargetDown := uint(len(verdict.PeerReports)) -
+		peersReportingTargetUp
+	verdict.Confirmed = !verdict.TargetReachable &&
+		peersReportingTargetDown >= peersReportingTargetUp
+
+	if verdict.SelfStatus != types.NODE_STATUS_UP &&
+		verdict.SelfStatus != types.NODE_STATUS_MAINTENANCE {
 		// We are the culprit as we are not in quorum
-		log.Infof("gossip: Our Status: %v. We should go down.",
-			g.GetSelfStatus())
-		return g.NodeId()
+		verdict.NodeId = g.NodeId()
+		verdict.Reason = "self not in quorum"
+	} else if 2*verdict.PeersReportingSelfDown > uint(len(verdict.PeerReports)) &&
+		peersReportingTargetUp > peersReportingTargetDown {
+		// Majority of our peers cannot see us, but they can see the target
+		verdict.NodeId = g.NodeId()
+		verdict.Reason = "majority of peers do not see self"
+	} else if verdict.TargetReachable {
+		verdict.Reason = "target reachable"
+	} else if !verdict.Confirmed {
+		verdict.Reason = "majority of peers see target"
+	} else {
+		verdict.NodeId = nodeId
+		verdict.Reason = "target unreachable"
+	}
+	g.log(types.LOG_COMPONENT_QUORUM).Infof("gossip: Node %q should go "+
+		"down. Reason: %v. Our Status: %v. Target reachable: %v. "+
+		"Indirect probes: %v. Peer reports: %v", verdict.NodeId,
+		verdict.Reason, verdict.SelfStatus, verdict.TargetReachable,
+		verdict.IndirectProbes, verdict.PeerReports)
+	return verdict
+}
+
+// collectPeerReports fills in the verdict with the target's status as gossiped
+// by our peers. Only peers which we see alive and whose info we received
+// within the quorum timeout are consulted. Memberlist on these peers decides
+// their view of the target through its direct and indirect probes.
+func (g *GossiperImpl) collectPeerReports(verdict *types.NodeLeaveVerdict) {
+	selfId := g.NodeId()
+	verdict.PeerReports = make(map[types.NodeId]types.NodeStatus)
+	for id, nodeInfo := range g.GetLocalState() {
+		if id == selfId || id == verdict.Target {
+			continue
+		}
+		if nodeInfo.Status != types.NODE_STATUS_UP &&
+			nodeInfo.Status != types.NODE_STATUS_MAINTENANCE {
+			continue
+		}
+		if g.staleness(id) > g.quorumTimeout {
+			continue
+		}
+		status, ok := nodeInfo.PeerStatus[verdict.Target]
+		if !ok {
+			continue
+		}
+		verdict.PeerReports[id] = status
+		if !peerConfirmed(nodeInfo, selfId) {
+			verdict.PeersReportingSelfDown++
+		}
 	}
 }
@@ -0,0 +1,175 @@
+package proto
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+// nodeAuthenticator signs our payloads and verifies the payloads signed
+// by the other nodes. Nodes either share an HMAC secret or sign with their
+// own ed25519 key, in which case the peers' public keys are pinned through
+// UpdateCluster. A nil secret and key disables authentication.
+type nodeAuthenticator struct {
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKeys map[types.NodeId]ed25519.PublicKey
+	lock       sync.Mutex
+}
+
+func newNodeAuthenticator(
+	secret []byte,
+	privateKey ed25519.PrivateKey,
+) (*nodeAuthenticator, error) {
+	if len(secret) != 0 && len(privateKey) != 0 {
+		return nil, fmt.Errorf("gossip: Only one of the authentication " +
+			"secret and the identity key can be provided")
+	}
+	if len(privateKey) != 0 && len(privateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("gossip: Invalid identity key size %v",
+			len(privateKey))
+	}
+	return &nodeAuthenticator{
+		secret:     secret,
+		privateKey: privateKey,
+		publicKeys: make(map[types.NodeId]ed25519.PublicKey),
+	}, nil
+}
+
+func (a *nodeAuthenticator) enabled() bool {
+	return len(a.secret) != 0 || len(a.privateKey) != 0
+}
+
+// updateKeys pins the public keys of the peers
+func (a *nodeAuthenticator) updateKeys(
+	peers map[types.NodeId]types.NodeUpdate,
+) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.publicKeys = make(map[types.NodeId]ed25519.PublicKey)
+	for id, update := range peers {
+		if len(update.PublicKey) != 0 {
+			a.publicKeys[id] = ed25519.PublicKey(update.PublicKey)
+		}
+	}
+}
+
+// sign returns the signature of the payload or nil if authentication
+// is disabled
+func (a *nodeAuthenticator) sign(payload []byte) []byte {
+	if len(a.secret) != 0 {
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(payload)
+		return mac.Sum(nil)
+	}
+	if len(a.privateKey) != 0 {
+		return ed25519.Sign(a.privateKey, payload)
+	}
+	return nil
+}
+
+// verify checks that the payload was signed by the node with the given id
+func (a *nodeAuthenticator) verify(
+	id types.NodeId,
+	payload []byte,
+	signature []byte,
+) error {
+	if len(signature) == 0 {
+		return fmt.Errorf("gossip: Node %v did not sign its payload", id)
+	}
+	if len(a.secret) != 0 {
+		if !hmac.Equal(a.sign(payload), signature) {
+			return fmt.Errorf("gossip: Invalid signature from node %v", id)
+		}
+		return nil
+	}
+	a.lock.Lock()
+	publicKey, ok := a.publicKeys[id]
+	a.lock.Unlock()
+	if !ok || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("gossip: No valid public key pinned for node %v", id)
+	}
+	if !ed25519.Verify(publicKey, payload, signature) {
+		return fmt.Errorf("gossip: Invalid signature from node %v", id)
+	}
+	return nil
+}
+
+// identityPayload is the payload signed by a node to prove its identity
+func identityPayload(id types.NodeId, clusterId string) []byte {
+	return []byte(string(id) + "\x00" + clusterId)
+}
+
+// verifyIdentity checks the signed identity presented by a node in
+// its meta data
+func (gd *GossipDelegate) verifyIdentity(
+	nodeName string,
+	nodeMeta types.NodeMetaInfo,
+) error {
+	if !gd.auth.enabled() {
+		return nil
+	}
+	if string(nodeMeta.Id) != nodeName {
+		return fmt.Errorf("gossip: Node (%v) presented the identity of "+
+			"node (%v)", nodeName, nodeMeta.Id)
+	}
+	return gd.auth.verify(nodeMeta.Id,
+		identityPayload(nodeMeta.Id, nodeMeta.ClusterId), nodeMeta.Identity)
+}
+
+// nodeInfoPayload is the payload signed by a node over its node info.
+// Status, StatusUpdateTs and QuorumMember are decided locally by every
+// node and are not signed. Empty maps are not transmitted by gob and are
+// treated as nil. With a shared secret any member can sign the payload
+// of another member, so only an identity key proves its origin.
+func nodeInfoPayload(nodeInfo types.NodeInfo) ([]byte, error) {
+	nodeInfo.Status = types.NODE_STATUS_INVALID
+	nodeInfo.StatusUpdateTs = time.Time{}
+	nodeInfo.QuorumMember = false
+	nodeInfo.Signature = nil
+	if len(nodeInfo.Value) == 0 {
+		nodeInfo.Value = nil
+	}
+	if len(nodeInfo.PeerStatus) == 0 {
+		nodeInfo.PeerStatus = nil
+	}
+	if len(nodeInfo.Namespaces) == 0 {
+		nodeInfo.Namespaces = nil
+	}
+	if len(nodeInfo.KeyVersions) == 0 {
+		nodeInfo.KeyVersions = nil
+	}
+	if len(nodeInfo.PeerVersions) == 0 {
+		nodeInfo.PeerVersions = nil
+	}
+	if len(nodeInfo.KeyFingerprints) == 0 {
+		nodeInfo.KeyFingerprints = nil
+	}
+	// json sorts the map keys which makes the payload deterministic
+	return json.Marshal(nodeInfo)
+}
+
+// signNodeInfo signs the node info on behalf of its owner
+func (a *nodeAuthenticator) signNodeInfo(nodeInfo *types.NodeInfo) error {
+	payload, err := nodeInfoPayload(*nodeInfo)
+	if err != nil {
+		return err
+	}
+	nodeInfo.Signature = a.sign(payload)
+	return nil
+}
+
+// verifyNodeInfo checks that the node info was signed by its owner
+func (a *nodeAuthenticator) verifyNodeInfo(nodeInfo types.NodeInfo) error {
+	payload, err := nodeInfoPayload(nodeInfo)
+	if err != nil {
+		return err
+	}
+	return a.verify(nodeInfo.Id, payload, nodeInfo.Signature)
+}
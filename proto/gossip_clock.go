@@ -0,0 +1,122 @@
+package proto
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+// systemClock is the default clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) types.Timer {
+	return time.AfterFunc(d, f)
+}
+
+// ManualClock is a clock which only moves when told to. Scheduled calls
+// run in the goroutine which moves the clock past their time, in the
+// order of their times.
+type ManualClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+	seq    uint64
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	deadline time.Time
+	seq      uint64
+	f        func()
+}
+
+// NewManualClock returns a manual clock set to the given time
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) types.Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	t := &manualTimer{clock: c, deadline: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	sort.Slice(c.timers, func(i, j int) bool {
+		if c.timers[i].deadline.Equal(c.timers[j].deadline) {
+			return c.timers[i].seq < c.timers[j].seq
+		}
+		return c.timers[i].deadline.Before(c.timers[j].deadline)
+	})
+	return t
+}
+
+// Advance moves the clock forward by d and runs the calls which
+// become due
+func (c *ManualClock) Advance(d time.Duration) {
+	c.advanceTo(c.Now().Add(d))
+}
+
+// advanceTo moves the clock to the time running the calls due until
+// then. The clock is set to the time of each call when it runs.
+func (c *ManualClock) advanceTo(to time.Time) {
+	for c.fireNext(to) {
+	}
+	c.lock.Lock()
+	if c.now.Before(to) {
+		c.now = to
+	}
+	c.lock.Unlock()
+}
+
+// fireNext runs the first call due until the time. It returns false
+// if there is none.
+func (c *ManualClock) fireNext(to time.Time) bool {
+	c.lock.Lock()
+	if len(c.timers) == 0 || c.timers[0].deadline.After(to) {
+		c.lock.Unlock()
+		return false
+	}
+	t := c.timers[0]
+	c.timers = c.timers[1:]
+	if c.now.Before(t.deadline) {
+		c.now = t.deadline
+	}
+	c.lock.Unlock()
+	t.f()
+	return true
+}
+
+// nextDeadline returns the time of the next scheduled call
+func (c *ManualClock) nextDeadline() (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	return c.timers[0].deadline, true
+}
+
+func (t *manualTimer) Stop() bool {
+	c := t.clock
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
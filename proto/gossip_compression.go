@@ -0,0 +1,99 @@
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+// compressionPrefix marks a compressed push/pull payload. It is followed
+// by the compression type. A gob stream never starts with a zero byte
+// which keeps compressed payloads distinguishable from plain ones.
+const compressionPrefix byte = 0x00
+
+// maxDecompressedStateSize bounds the size of a decompressed push/pull
+// payload so that a small payload cannot exhaust our memory
+const maxDecompressedStateSize = 64 * 1024 * 1024
+
+// supportedCompression returns the compression types which this node
+// can decompress. It is advertised in the node meta data.
+func supportedCompression() []types.CompressionType {
+	return []types.CompressionType{types.COMPRESSION_FLATE}
+}
+
+func compressState(
+	compression types.CompressionType,
+	buf []byte,
+) ([]byte, error) {
+	var out bytes.Buffer
+	out.Write([]byte{compressionPrefix, byte(compression)})
+	switch compression {
+	case types.COMPRESSION_FLATE:
+		w, err := flate.NewWriter(&out, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("gossip: Unknown compression type %v",
+			compression)
+	}
+	return out.Bytes(), nil
+}
+
+// decompressState returns the plain payload. Payloads which are not
+// compressed are returned as is.
+func decompressState(buf []byte) ([]byte, error) {
+	if len(buf) < 2 || buf[0] != compressionPrefix {
+		return buf, nil
+	}
+	switch types.CompressionType(buf[1]) {
+	case types.COMPRESSION_FLATE:
+		r := flate.NewReader(bytes.NewReader(buf[2:]))
+		defer r.Close()
+		state, err := ioutil.ReadAll(
+			io.LimitReader(r, maxDecompressedStateSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(state) > maxDecompressedStateSize {
+			return nil, fmt.Errorf("gossip: Decompressed state exceeds "+
+				"%v bytes", maxDecompressedStateSize)
+		}
+		return state, nil
+	}
+	return nil, fmt.Errorf("gossip: Unknown compression type %v", buf[1])
+}
+
+// compressionNegotiated returns true if our push/pull payload should be
+// compressed. As the receiver of the payload is not known, all the alive
+// peers should support our compression type.
+func (gd *GossipDelegate) compressionNegotiated() bool {
+	if gd.compression == types.COMPRESSION_NONE {
+		return false
+	}
+	gd.peerMetaLock.Lock()
+	defer gd.peerMetaLock.Unlock()
+	for _, nodeMeta := range gd.peerMeta {
+		supported := false
+		for _, compression := range nodeMeta.Compression {
+			if compression == gd.compression {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return false
+		}
+	}
+	return true
+}
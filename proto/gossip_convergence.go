@@ -0,0 +1,94 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+// GetKeyVersion returns the version at which we last set the key
+func (s *GossipStoreImpl) GetKeyVersion(key types.StoreKey) (uint64, bool) {
+	s.Lock()
+	defer s.Unlock()
+	version, ok := s.nodeMap[s.id].KeyVersions[key]
+	return version, ok
+}
+
+// GetAcknowledgements reports for every other node whether it has seen
+// the version of our key. A node tells the versions it has seen in the
+// digest gossiped with its node info, so its acknowledgement reaches us
+// one gossip exchange after it has seen the version.
+func (s *GossipStoreImpl) GetAcknowledgements(
+	key types.StoreKey,
+	version uint64,
+) (map[types.NodeId]types.Acknowledgement, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	selfInfo := s.nodeMap[s.id]
+	if _, ok := selfInfo.KeyVersions[key]; !ok {
+		return nil, fmt.Errorf("gossip: Key %v is not set on node %v",
+			key, s.id)
+	}
+	if version > selfInfo.Version {
+		return nil, fmt.Errorf("gossip: Version %v of key %v is newer than "+
+			"our version %v", version, key, selfInfo.Version)
+	}
+	acks := make(map[types.NodeId]types.Acknowledgement)
+	for id, nodeInfo := range s.nodeMap {
+		if id == s.id {
+			continue
+		}
+		seen := nodeInfo.PeerVersions[s.id]
+		acks[id] = types.Acknowledgement{
+			Status: nodeInfo.Status,
+			Seen:   seen,
+			Acked: seen.GenNumber == selfInfo.GenNumber &&
+				seen.Version >= version,
+		}
+	}
+	return acks, nil
+}
+
+// WaitForConvergence blocks until all the peers we see UP or in
+// MAINTENANCE have seen the current version of our key or the context
+// is done. It checks the acknowledgements every gossip interval of our
+// clock.
+func (g *GossiperImpl) WaitForConvergence(
+	ctx context.Context,
+	key types.StoreKey,
+) error {
+	version, ok := g.GetKeyVersion(key)
+	if !ok {
+		return fmt.Errorf("gossip: Key %v is not set on node %v",
+			key, g.NodeId())
+	}
+	for {
+		acks, err := g.GetAcknowledgements(key, version)
+		if err != nil {
+			return err
+		}
+		converged := true
+		for _, ack := range acks {
+			if (ack.Status == types.NODE_STATUS_UP ||
+				ack.Status == types.NODE_STATUS_MAINTENANCE) && !ack.Acked {
+				converged = false
+				break
+			}
+		}
+		if converged {
+			return nil
+		}
+		tick := make(chan struct{})
+		timer := g.clock.AfterFunc(g.gossipInterval, func() {
+			close(tick)
+		})
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-tick:
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package proto
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+// Every node gossips the merge of all the contributions to a CRDT value
+// it has seen, and merges the values of the peers into its own as it
+// receives them. The contributions of a node thus outlive the node's
+// own info, which is dropped when the node restarts or is removed.
+
+// IncrementCounter increments the count of this node in the grow-only
+// counter of the key
+func (s *GossipStoreImpl) IncrementCounter(
+	key types.StoreKey,
+	delta uint64,
+) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var counter types.GCounter
+	err := s.mergeValues(key, func(id types.NodeId, val interface{}) error {
+		other, ok := val.(types.GCounter)
+		if !ok {
+			return crdtTypeError(id, key, val, counter)
+		}
+		counter = counter.Merge(other)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.updateSelfValues(types.StoreMap{
+		key: counter.Increment(s.id, s.nodeMap[s.id].GenNumber, delta),
+	})
+}
+
+// AddCounter adds delta, which may be negative, to the counter of the key
+func (s *GossipStoreImpl) AddCounter(key types.StoreKey, delta int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var counter types.PNCounter
+	err := s.mergeValues(key, func(id types.NodeId, val interface{}) error {
+		other, ok := val.(types.PNCounter)
+		if !ok {
+			return crdtTypeError(id, key, val, counter)
+		}
+		counter = counter.Merge(other)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.updateSelfValues(types.StoreMap{
+		key: counter.Add(s.id, s.nodeMap[s.id].GenNumber, delta),
+	})
+}
+
+// GetCounter returns the value of the counter of the key across the
+// nodes. The nodes may use either a grow-only or a PN counter.
+func (s *GossipStoreImpl) GetCounter(key types.StoreKey) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var counter types.PNCounter
+	err := s.mergeValues(key, func(id types.NodeId, val interface{}) error {
+		switch c := val.(type) {
+		case types.GCounter:
+			counter = counter.Merge(types.PNCounter{Incr: c})
+		case types.PNCounter:
+			counter = counter.Merge(c)
+		default:
+			return crdtTypeError(id, key, val, counter)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counter.Value(), nil
+}
+
+// AddToSet adds the elements to the set of the key
+func (s *GossipStoreImpl) AddToSet(
+	key types.StoreKey,
+	elements ...string,
+) error {
+	s.Lock()
+	defer s.Unlock()
+
+	set, err := s.mergedSet(key)
+	if err != nil {
+		return err
+	}
+	genNumber := s.nodeMap[s.id].GenNumber
+	for _, element := range elements {
+		set = set.Add(element, s.id, genNumber)
+	}
+	return s.updateSelfValues(types.StoreMap{key: set})
+}
+
+// RemoveFromSet removes the elements from the set of the key. Only the
+// additions of the elements we have seen so far are removed.
+func (s *GossipStoreImpl) RemoveFromSet(
+	key types.StoreKey,
+	elements ...string,
+) error {
+	s.Lock()
+	defer s.Unlock()
+
+	set, err := s.mergedSet(key)
+	if err != nil {
+		return err
+	}
+	for _, element := range elements {
+		set = set.Remove(element, set.Adds[element])
+	}
+	return s.updateSelfValues(types.StoreMap{key: set})
+}
+
+// GetSet returns the elements of the set of the key across the nodes
+// in order
+func (s *GossipStoreImpl) GetSet(key types.StoreKey) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	set, err := s.mergedSet(key)
+	if err != nil {
+		return nil, err
+	}
+	return set.Elements(), nil
+}
+
+// SetRegister sets the register of the key to the value. The value
+// replaces the values set by the nodes before we saw them even if
+// their clocks are ahead of ours.
+func (s *GossipStoreImpl) SetRegister(
+	key types.StoreKey,
+	val interface{},
+) error {
+	s.Lock()
+	defer s.Unlock()
+
+	last, err := s.mergedRegister(key)
+	if err != nil {
+		return err
+	}
+	return s.updateSelfValues(types.StoreMap{key: types.LWWRegister{
+		Value:  val,
+		Ts:     s.updateTs(last.Ts),
+		NodeId: s.id,
+	}})
+}
+
+// GetRegister returns the register of the key set last by any node. It
+// is the zero register if no node has set it.
+func (s *GossipStoreImpl) GetRegister(
+	key types.StoreKey,
+) (types.LWWRegister, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.mergedRegister(key)
+}
+
+// mergedSet returns the merge of the sets of the key. Caller should hold
+// the lock.
+func (s *GossipStoreImpl) mergedSet(key types.StoreKey) (types.ORSet, error) {
+	var set types.ORSet
+	err := s.mergeValues(key, func(id types.NodeId, val interface{}) error {
+		other, ok := val.(types.ORSet)
+		if !ok {
+			return crdtTypeError(id, key, val, set)
+		}
+		set = set.Merge(other)
+		return nil
+	})
+	return set, err
+}
+
+// mergedRegister returns the register of the key set last. Caller should
+// hold the lock.
+func (s *GossipStoreImpl) mergedRegister(
+	key types.StoreKey,
+) (types.LWWRegister, error) {
+	var register types.LWWRegister
+	err := s.mergeValues(key, func(id types.NodeId, val interface{}) error {
+		other, ok := val.(types.LWWRegister)
+		if !ok {
+			return crdtTypeError(id, key, val, register)
+		}
+		register = register.Merge(other)
+		return nil
+	})
+	return register, err
+}
+
+// mergeValues calls merge with the value of the key of every node with a
+// valid status which has the key. It stops at the first error. Caller
+// should hold the lock.
+func (s *GossipStoreImpl) mergeValues(
+	key types.StoreKey,
+	merge func(id types.NodeId, val interface{}) error,
+) error {
+	for id, nodeInfo := range s.nodeMap {
+		if !statusValid(nodeInfo.Status) {
+			continue
+		}
+		val, ok := nodeInfo.Value[key]
+		if !ok {
+			continue
+		}
+		if err := merge(id, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// absorbCRDTs merges the CRDT values of the node infos into our own
+// values with a single update. Values which are not CRDTs or whose type
+// differs from ours are left out. Caller should hold the lock.
+func (s *GossipStoreImpl) absorbCRDTs(nodeInfos []types.NodeInfo) {
+	values := make(types.StoreMap)
+	selfValue := s.nodeMap[s.id].Value
+	for _, nodeInfo := range nodeInfos {
+		for key, val := range nodeInfo.Value {
+			selfVal, ok := values[key]
+			if !ok {
+				selfVal, ok = selfValue[key]
+			}
+			if merged, changed := mergeCRDT(selfVal, ok, val); changed {
+				values[key] = merged
+			}
+		}
+	}
+	if len(values) == 0 {
+		return
+	}
+	if err := s.updateSelfValues(values); err != nil {
+		s.log(types.LOG_COMPONENT_STORE).Warnf("gossip: Unable to merge "+
+			"the CRDT values of the peers: %v", err)
+	}
+}
+
+// mergeCRDT merges the value of another node into ours if it is a CRDT
+// of the same type. It returns false if ours does not change.
+func mergeCRDT(
+	val interface{},
+	hasVal bool,
+	other interface{},
+) (interface{}, bool) {
+	var merged interface{}
+	switch o := other.(type) {
+	case types.GCounter:
+		v, ok := val.(types.GCounter)
+		if !ok && hasVal {
+			return nil, false
+		}
+		merged, val = v.Merge(o), v
+	case types.PNCounter:
+		v, ok := val.(types.PNCounter)
+		if !ok && hasVal {
+			return nil, false
+		}
+		merged, val = v.Merge(o), v
+	case types.ORSet:
+		v, ok := val.(types.ORSet)
+		if !ok && hasVal {
+			return nil, false
+		}
+		merged, val = v.Merge(o), v
+	case types.LWWRegister:
+		v, ok := val.(types.LWWRegister)
+		if !ok && hasVal {
+			return nil, false
+		}
+		merged, val = v.Merge(o), v
+	default:
+		return nil, false
+	}
+	return merged, !reflect.DeepEqual(merged, val)
+}
+
+// crdtTypeError returns the error for a value of a key which is not of
+// the expected CRDT type
+func crdtTypeError(
+	id types.NodeId,
+	key types.StoreKey,
+	val interface{},
+	expected interface{},
+) error {
+	return fmt.Errorf("gossip: Value of key %v on node %v is a %T, "+
+		"not a %T", key, id, val, expected)
+}
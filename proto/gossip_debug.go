@@ -0,0 +1,86 @@
+package proto
+
+import (
+	"github.com/libopenstorage/gossip/proto/state"
+	"github.com/libopenstorage/gossip/types"
+)
+
+// maxTransitions is the number of recent transitions kept for debugging
+const maxTransitions = 32
+
+var stateEventNames = map[types.StateEvent]string{
+	types.SELF_ALIVE:          "SELF_ALIVE",
+	types.NODE_ALIVE:          "NODE_ALIVE",
+	types.SELF_LEAVE:          "SELF_LEAVE",
+	types.NODE_LEAVE:          "NODE_LEAVE",
+	types.UPDATE_CLUSTER_SIZE: "UPDATE_CLUSTER_SIZE",
+	types.TIMEOUT:             "TIMEOUT",
+}
+
+// recordState records the name of the current state and the
+// transition which led to it, if any
+func (gd *GossipDelegate) recordState(
+	stateName string,
+	transition *types.StateTransition,
+) {
+	gd.debugLock.Lock()
+	defer gd.debugLock.Unlock()
+	gd.stateName = stateName
+	if transition == nil {
+		return
+	}
+	gd.transitions = append(gd.transitions, *transition)
+	if len(gd.transitions) > maxTransitions {
+		gd.transitions = gd.transitions[len(gd.transitions)-maxTransitions:]
+	}
+}
+
+// GetDebugInfo returns a dump of our view of the gossip cluster.
+// Memberlist incarnation numbers are not exported by memberlist and
+// are not part of the dump.
+func (g *GossiperImpl) GetDebugInfo() types.DebugInfo {
+	info := types.DebugInfo{
+		NodeId:        g.NodeId(),
+		ClusterId:     g.GetClusterId(),
+		GossipVersion: g.GetGossipVersion(),
+		Status:        g.GetSelfStatus(),
+		NodeInfoMap:   g.GetLocalState(),
+		Stats:         g.GetStats(),
+		Faults:        g.GetInjectedFaults(),
+	}
+
+	g.debugLock.Lock()
+	info.State = g.stateName
+	info.Transitions = make([]types.StateTransition, len(g.transitions))
+	copy(info.Transitions, g.transitions)
+	g.debugLock.Unlock()
+
+	quorumMembers, nodeInfoMap := g.getQuorumView()
+	info.Quorum = types.DebugQuorum{
+		QuorumMembers:   quorumMembers,
+		QuorumMembersUp: state.NumQuorumMembersUp(nodeInfoMap),
+		QuorumNeeded:    quorumMembers/2 + 1,
+		InQuorum: info.Status == types.NODE_STATUS_UP ||
+			info.Status == types.NODE_STATUS_MAINTENANCE,
+		PeerConfirmedQuorum:     g.peerConfirmedQuorum,
+		MaintenanceQuorumPolicy: g.maintenanceQuorumPolicy,
+	}
+
+	if g.mlist != nil {
+		for _, node := range g.mlist.Members() {
+			member := types.DebugMember{
+				Name:            node.Name,
+				NodeId:          types.NodeId(g.parseMemberlistNodeName(node.Name)),
+				Addr:            node.Addr.String(),
+				Port:            node.Port,
+				ProtocolVersion: node.PCur,
+			}
+			var nodeMeta types.NodeMetaInfo
+			if err := g.convertFromBytes(node.Meta, &nodeMeta); err == nil {
+				member.GossipVersion = nodeMeta.GossipVersion
+			}
+			info.Members = append(info.Members, member)
+		}
+	}
+	return info
+}
@@ -1,19 +1,43 @@
 package proto
 
 import (
-	"encoding/json"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/hashicorp/memberlist"
 
 	"github.com/libopenstorage/gossip/proto/state"
 	"github.com/libopenstorage/gossip/types"
 )
 
+type messageType uint8
+
+const (
+	// KEYRING_MESSAGE carries a keyringMessage
+	KEYRING_MESSAGE messageType = iota
+	// PING_REQUEST_MESSAGE carries a pingRequestMessage
+	PING_REQUEST_MESSAGE
+	// PING_RESPONSE_MESSAGE carries a pingResponseMessage
+	PING_RESPONSE_MESSAGE
+)
+
+// gossipBroadcast is a user data message broadcast through memberlist
+type gossipBroadcast struct {
+	msg []byte
+}
+
+func (b *gossipBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	return false
+}
+
+func (b *gossipBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *gossipBroadcast) Finished() {
+}
+
 type GossipDelegate struct {
 	// GossipstoreImpl implements the GossipStoreInterface
 	GossipStoreImpl
@@ -23,12 +47,64 @@ type GossipDelegate struct {
 	lastGossipTs     time.Time
 	// channel to receive state change events
 	stateEvent chan types.StateEvent
+	// channel to wait until the received state events are handled
+	flushEvents chan chan struct{}
+	// channel to hand the initial state to a running state handler
+	// when the gossiper is restarted
+	initState chan state.State
 	// current State object
 	currentState state.State
 	// quorum timeout to change the quorum status of a node
 	quorumTimeout      time.Duration
 	timeoutVersion     uint64
 	timeoutVersionLock sync.Mutex
+	// peerConfirmedQuorum when set only counts quorum members which
+	// also see us as UP
+	peerConfirmedQuorum bool
+	// maintenanceQuorumPolicy decides how nodes in maintenance are
+	// treated in quorum decisions
+	maintenanceQuorumPolicy types.MaintenanceQuorumPolicy
+	// last known number of quorum members and quorum members up
+	// as seen by the quorum view
+	quorumMembers     uint
+	quorumMembersUp   uint
+	quorumMembersLock sync.Mutex
+	// membership layer, set once started
+	mlist memberList
+	// queue of user data messages to be broadcast
+	broadcasts *memberlist.TransmitLimitedQueue
+	// indirect probes waiting for the answers of the peers keyed by
+	// sequence number
+	pingRequests     map[uint64]chan pingResponseMessage
+	pingRequestSeq   uint64
+	pingRequestsLock sync.Mutex
+	// keyring used for encrypting the gossip traffic
+	keyring *gossipKeyring
+	// compression used for our push/pull state
+	compression types.CompressionType
+	// meta data advertised by the alive peers keyed by memberlist name
+	peerMeta     map[string]types.NodeMetaInfo
+	peerMetaLock sync.Mutex
+	// last decoded meta data of every node keyed by memberlist name
+	metaCache     map[string]cachedMeta
+	metaCacheLock sync.Mutex
+	// range of gossip versions of the peers we accept
+	minGossipVersion string
+	maxGossipVersion string
+	// counters of the gossip activity
+	stats     types.GossipStats
+	statsLock sync.Mutex
+	// name of the current state and the recent transitions
+	stateName   string
+	transitions []types.StateTransition
+	debugLock   sync.Mutex
+	// faults injected for testing and whether the state events are
+	// handled yet
+	faults         types.GossipFaults
+	handlingEvents bool
+	faultsLock     sync.Mutex
+	// state events held while the state handler is frozen
+	heldEvents []types.StateEvent
 }
 
 func (gd *GossipDelegate) InitGossipDelegate(
@@ -41,6 +117,9 @@ func (gd *GossipDelegate) InitGossipDelegate(
 	gd.GenNumber = genNumber
 	gd.nodeId = string(selfNodeId)
 	gd.stateEvent = make(chan types.StateEvent)
+	gd.flushEvents = make(chan chan struct{})
+	gd.initState = make(chan state.State)
+	gd.pingRequests = make(map[uint64]chan pingResponseMessage)
 	// We start with a NOT_IN_QUORUM status
 	gd.InitStore(
 		selfNodeId,
@@ -49,12 +128,26 @@ func (gd *GossipDelegate) InitGossipDelegate(
 		clusterId,
 	)
 	gd.quorumTimeout = quorumTimeout
+	gd.broadcasts = &memberlist.TransmitLimitedQueue{NumNodes: gd.numNodes}
+	gd.keyring = &gossipKeyring{}
 }
 
 func (gd *GossipDelegate) InitCurrentState(clusterSize uint) {
 	// Our initial state is NOT_IN_QUORUM
-	gd.currentState = state.GetNotInQuorum(
+	initState := state.GetNotInQuorum(
 		uint(clusterSize), types.NodeId(gd.nodeId), gd.stateEvent)
+	gd.faultsLock.Lock()
+	handlingEvents := gd.handlingEvents
+	gd.handlingEvents = true
+	gd.faultsLock.Unlock()
+	if handlingEvents {
+		// The gossiper is restarted. The state is only changed by
+		// the go routine handling the events.
+		gd.initState <- initState
+		return
+	}
+	gd.currentState = initState
+	gd.recordState(gd.currentState.String(), nil)
 	// Start the go routine which handles all the events
 	// and changes state of the node
 	go gd.handleStateEvents()
@@ -63,18 +156,17 @@ func (gd *GossipDelegate) InitCurrentState(clusterSize uint) {
 func (gd *GossipDelegate) updateGossipTs() {
 	gd.lastGossipTsLock.Lock()
 	defer gd.lastGossipTsLock.Unlock()
-	gd.lastGossipTs = time.Now()
+	gd.lastGossipTs = gd.clock.Now()
 }
 
 func (gd *GossipDelegate) gossipChecks(node *memberlist.Node) error {
 	// Check the gossip version of other node
-	var nodeMeta types.NodeMetaInfo
 	nodeName := gd.parseMemberlistNodeName(node.Name)
-	err := gd.convertFromBytes(node.Meta, &nodeMeta)
+	nodeMeta, err := gd.decodeNodeMeta(node)
 	if err != nil {
 		err = fmt.Errorf("gossip: Error in unmarshalling peer's meta data. Error : %v", err.Error())
 	} else {
-		if nodeMeta.GossipVersion != gd.GetGossipVersion() {
+		if !gd.versionCompatible(nodeMeta) {
 			// Version Mismatch
 			// We do not add this node in our memberlist
 			err = fmt.Errorf("Version mismatch with "+
@@ -91,8 +183,9 @@ func (gd *GossipDelegate) gossipChecks(node *memberlist.Node) error {
 					gd.nodeId, nodeName, node.Addr, gd.GetClusterId(), nodeMeta.ClusterId)
 			} else {
 				// ClusterId Match
-				// Add this new node in our node map
-				err = nil
+				// Add this new node in our node map only if
+				// it proves its identity
+				err = gd.verifyIdentity(nodeName, nodeMeta)
 			}
 		}
 	}
@@ -102,20 +195,54 @@ func (gd *GossipDelegate) gossipChecks(node *memberlist.Node) error {
 // NodeMeta is used to retrieve meta-data about the current node
 // when broadcasting an alive message. It's length is limited to
 // the given byte size. This metadata is available in the Node structure.
+// The meta data is never truncated as peers would fail to decode it.
+// Fields which are not needed for the gossip checks are dropped if the
+// meta data does not fit in the limit.
 func (gd *GossipDelegate) NodeMeta(limit int) []byte {
 	msg := gd.MetaInfo()
-	msgBytes, _ := gd.convertToBytes(msg)
-	return msgBytes
+	msg.Identity = gd.auth.sign(identityPayload(msg.Id, msg.ClusterId))
+	msg.Compression = supportedCompression()
+	msg.MinGossipVersion = gd.minGossipVersion
+	msg.MaxGossipVersion = gd.maxGossipVersion
+	msgBytes, err := gd.convertToBytes(msg)
+	if err == nil && len(msgBytes) <= limit {
+		return msgBytes
+	}
+	// Without the compression types peers do not send us compressed
+	// state, which is always safe.
+	msg.GenNumber = 0
+	msg.LastUpdateTs = time.Time{}
+	msg.Compression = nil
+	msgBytes, err = gd.convertToBytes(msg)
+	if err == nil && len(msgBytes) <= limit {
+		return msgBytes
+	}
+	// Peers will reject us, but memberlist will not panic
+	gd.log(types.LOG_COMPONENT_GOSSIP).Errorf("gossip: Node meta data of "+
+		"%v bytes exceeds the limit of %v bytes", len(msgBytes), limit)
+	return []byte{}
 }
 
 // NotifyMsg is called when a user-data message is received.
 // Care should be taken that this method does not block, since doing
 // so would block the entire UDP packet receive loop. Additionally, the byte
 // slice may be modified after the call returns, so it should be copied if needed.
-// Note: Currently, we do not use broadcasts and hence this function does nothing
+// The first byte of the message is its messageType.
 func (gd *GossipDelegate) NotifyMsg(data []byte) {
-	var nodeId string
-	json.Unmarshal(data, &nodeId)
+	if len(data) == 0 {
+		return
+	}
+	buf := make([]byte, len(data)-1)
+	copy(buf, data[1:])
+	switch messageType(data[0]) {
+	case KEYRING_MESSAGE:
+		gd.handleKeyringMessage(buf)
+	case PING_REQUEST_MESSAGE:
+		gd.handlePingRequest(buf)
+	case PING_RESPONSE_MESSAGE:
+		gd.handlePingResponse(buf)
+	}
+	// Ignore unknown messages
 	return
 }
 
@@ -125,14 +252,20 @@ func (gd *GossipDelegate) NotifyMsg(data []byte) {
 // The total byte size of the resulting data to send must not exceed
 // the limit. Care should be taken that this method does not block,
 // since doing so would block the entire UDP packet receive loop.
-// Note: Currently, we do not use broadcasts and hence this function does nothing
 func (gd *GossipDelegate) GetBroadcasts(overhead, limit int) [][]byte {
-	var test [][]byte
-	s1, _ := json.Marshal(gd.nodeId)
-	s2, _ := json.Marshal("test_string")
-	test = append(test, s1)
-	test = append(test, s2)
-	return test
+	return gd.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+// queueBroadcast queues a user data message to be broadcast to all the nodes
+func (gd *GossipDelegate) queueBroadcast(msgType messageType, msg interface{}) error {
+	msgBytes, err := gd.convertToBytes(msg)
+	if err != nil {
+		return err
+	}
+	gd.broadcasts.QueueBroadcast(&gossipBroadcast{
+		msg: append([]byte{byte(msgType)}, msgBytes...),
+	})
+	return nil
 }
 
 // LocalState is used for a TCP Push/Pull. This is sent to
@@ -142,13 +275,32 @@ func (gd *GossipDelegate) GetBroadcasts(overhead, limit int) [][]byte {
 func (gd *GossipDelegate) LocalState(join bool) []byte {
 	gd.updateSelfTs()
 
+	if !join && gd.GetInjectedFaults().DropPushPull {
+		return []byte{}
+	}
+
 	// We send our local state of nodeMap
 	// The receiver will decide which nodes to merge and which to ignore
 	byteLocalState, err := gd.GetLocalStateInBytes()
 	if err != nil {
 		byteLocalState = []byte{}
 	}
+	// The joining node's support for compression is not known yet
+	if !join && gd.compressionNegotiated() {
+		compressed, err := compressState(gd.compression, byteLocalState)
+		if err != nil {
+			gd.log(types.LOG_COMPONENT_GOSSIP).Warnf("gossip: Unable to "+
+				"compress local state: %v", err)
+		} else {
+			byteLocalState = compressed
+		}
+	}
 	gd.updateGossipTs()
+	gd.metrics.incrCounter([]string{"gossip", "push_pull", "bytes_sent"},
+		float32(len(byteLocalState)))
+	gd.updateStats(func(stats *types.GossipStats) {
+		stats.BytesSent += uint64(len(byteLocalState))
+	})
 	return byteLocalState
 }
 
@@ -157,22 +309,61 @@ func (gd *GossipDelegate) LocalState(join bool) []byte {
 // remote side's LocalState call. The 'join'
 // boolean indicates this is for a join instead of a push/pull.
 func (gd *GossipDelegate) MergeRemoteState(buf []byte, join bool) {
-	var remoteState types.NodeInfoMap
+	gd.metrics.incrCounter([]string{"gossip", "push_pull", "bytes_received"},
+		float32(len(buf)))
+	gd.updateStats(func(stats *types.GossipStats) {
+		stats.BytesReceived += uint64(len(buf))
+	})
 	if join == true {
 		// NotifyJoin will take care of this info
 		return
 	}
+
+	faults := gd.GetInjectedFaults()
+	if faults.CorruptMergeState {
+		buf = corruptState(buf)
+	}
+	if faults.MergeDelay > 0 {
+		delayed := make([]byte, len(buf))
+		copy(delayed, buf)
+		gd.clock.AfterFunc(faults.MergeDelay, func() {
+			gd.mergeRemoteState(delayed)
+		})
+		return
+	}
+	gd.mergeRemoteState(buf)
+}
+
+// mergeRemoteState merges the state received in a push/pull
+func (gd *GossipDelegate) mergeRemoteState(buf []byte) {
+	var remoteState types.NodeInfoMap
 	gd.updateSelfTs()
 
-	err := gd.convertFromBytes(buf, &remoteState)
+	buf, err := decompressState(buf)
+	if err != nil {
+		gd.log(types.LOG_COMPONENT_GOSSIP).Infof("gossip: Error in "+
+			"decompressing peer's local data. Error : %v", err.Error())
+		return
+	}
+	err = gd.convertFromBytes(buf, &remoteState)
 	if err != nil {
-		logrus.Infof("gossip: Error in unmarshalling peer's local data. "+
-			"Error : %v", err.Error())
+		gd.log(types.LOG_COMPONENT_GOSSIP).Infof("gossip: Error in "+
+			"unmarshalling peer's local data. Error : %v", err.Error())
 	}
 
+	start := time.Now()
 	gd.Update(remoteState)
+	gd.metrics.measureSince([]string{"gossip", "push_pull", "merge"}, start)
+	gd.metrics.incrCounter([]string{"gossip", "push_pull", "merges"}, 1)
+	gd.updateStats(func(stats *types.GossipStats) {
+		stats.Merges++
+	})
 	gd.updateGossipTs()
-	return
+	if gd.updateQuorumMembers() {
+		// The peers' gossiped state has changed our quorum view.
+		// Re-evaluate our quorum.
+		gd.triggerStateEvent(types.UPDATE_CLUSTER_SIZE)
+	}
 }
 
 // NotifyJoin is invoked when a node is detected to have joined.
@@ -190,8 +381,15 @@ func (gd *GossipDelegate) NotifyJoin(node *memberlist.Node) {
 	// gossip version mismatches.
 	// Nevertheless we are doing an extra check here.
 	if err := gd.gossipChecks(node); err != nil {
+		gd.forgetNodeMeta(node)
 		gd.RemoveNode(types.NodeId(nodeName))
+		return
+	}
+	gd.updatePeerMeta(node)
+	if gd.GetInjectedFaults().SuppressAlive {
+		return
 	}
+	gd.markNodeAlive(types.NodeId(nodeName))
 }
 
 // NotifyLeave is invoked when a node is detected to have left.
@@ -201,9 +399,18 @@ func (gd *GossipDelegate) NotifyLeave(node *memberlist.Node) {
 	if nodeName == gd.nodeId {
 		gd.triggerStateEvent(types.SELF_LEAVE)
 	} else {
+		if gd.removePeerMeta(node) {
+			// The node restarted with a different gossip version and
+			// is alive under its new memberlist name
+			gd.log(types.LOG_COMPONENT_GOSSIP).Infof("gossip: Ignoring leave "+
+				"of %v as node %v is alive", node.Name, nodeName)
+			gd.updateGossipTs()
+			return
+		}
 		err := gd.UpdateNodeStatus(types.NodeId(nodeName), types.NODE_STATUS_DOWN)
 		if err != nil {
-			logrus.Infof("gossip: Could not update status on NotifyLeave : %v", err.Error())
+			gd.log(types.LOG_COMPONENT_GOSSIP).Infof("gossip: Could not update "+
+				"status on NotifyLeave : %v", err.Error())
 			return
 		}
 		gd.triggerStateEvent(types.NODE_LEAVE)
@@ -216,11 +423,14 @@ func (gd *GossipDelegate) NotifyLeave(node *memberlist.Node) {
 // NotifyUpdate is invoked when a node is detected to have
 // updated, usually involving the meta data. The Node argument
 // must not be modified.
-// Note: Currently we do not use memberlists Node meta or modify it.
-// Probably future use ?
+// We record the peer's meta data to know its capabilities.
 func (gd *GossipDelegate) NotifyUpdate(node *memberlist.Node) {
 	nodeName := gd.parseMemberlistNodeName(node.Name)
-	logrus.Infof("gossip: Update Notification from %v %v", nodeName, node.Addr)
+	gd.log(types.LOG_COMPONENT_GOSSIP).Infof("gossip: Update Notification "+
+		"from %v %v", nodeName, node.Addr)
+	if nodeName != gd.nodeId {
+		gd.updatePeerMeta(node)
+	}
 }
 
 func (gd *GossipDelegate) NotifyMerge(peers []*memberlist.Node) error {
@@ -246,19 +456,36 @@ func (gd *GossipDelegate) NotifyAlive(node *memberlist.Node) error {
 
 	err := gd.gossipChecks(node)
 	if err != nil {
+		gd.forgetNodeMeta(node)
 		gd.RemoveNode(types.NodeId(nodeName))
 		// Do not add this node to the memberlist.
 		// Returning a non-nil err value
 		return err
 	}
+	if !gd.isPeerMember(node) {
+		// Memberlist asks about all the nodes a peer sees alive,
+		// including the ones it has declared dead itself if their
+		// alive message is not newer. It notifies the join of the
+		// nodes it actually marks alive.
+		return nil
+	}
+	gd.updatePeerMeta(node)
+	if gd.GetInjectedFaults().SuppressAlive {
+		return nil
+	}
+	gd.markNodeAlive(types.NodeId(nodeName))
+	return nil
+}
 
-	diffNode, err := gd.GetLocalNodeInfo(types.NodeId(nodeName))
-	if err == nil && diffNode.Status != types.NODE_STATUS_UP {
-		gd.UpdateNodeStatus(types.NodeId(nodeName), types.NODE_STATUS_UP)
+// markNodeAlive marks the node UP if it is in our local map
+func (gd *GossipDelegate) markNodeAlive(id types.NodeId) {
+	diffNode, err := gd.GetLocalNodeInfo(id)
+	if err == nil && diffNode.Status != types.NODE_STATUS_UP &&
+		diffNode.Status != types.NODE_STATUS_MAINTENANCE {
+		gd.UpdateNodeStatus(id, types.NODE_STATUS_UP)
 		gd.triggerStateEvent(types.NODE_ALIVE)
 	} // else if err != nil -> A new node sending us data. We do not add node unless it is added
 	// in our local map externally
-	return nil
 }
 
 func (gd *GossipDelegate) triggerStateEvent(event types.StateEvent) {
@@ -266,60 +493,249 @@ func (gd *GossipDelegate) triggerStateEvent(event types.StateEvent) {
 	return
 }
 
+// flushStateEvents waits until the state events received so far
+// have been handled
+func (gd *GossipDelegate) flushStateEvents() {
+	done := make(chan struct{})
+	gd.flushEvents <- done
+	<-done
+}
+
 func (gd *GossipDelegate) startQuorumTimer() {
 	gd.timeoutVersionLock.Lock()
 	localVersion := gd.timeoutVersion + 1
 	gd.timeoutVersion = localVersion
 	gd.timeoutVersionLock.Unlock()
 
-	logrus.Infof("gossip: Starting Quorum Timer with version v%v. Waiting for quorum timeout of (%v)", localVersion, gd.quorumTimeout)
-	time.Sleep(gd.quorumTimeout)
-
-	gd.timeoutVersionLock.Lock()
-	if localVersion == gd.timeoutVersion {
+	gd.log(types.LOG_COMPONENT_QUORUM).Infof("gossip: Starting Quorum "+
+		"Timer with version v%v. Waiting for quorum timeout of (%v)",
+		localVersion, gd.quorumTimeout)
+	gd.clock.AfterFunc(gd.quorumTimeout, func() {
+		gd.timeoutVersionLock.Lock()
+		if localVersion == gd.timeoutVersion {
+			gd.timeoutVersionLock.Unlock()
+			gd.stateEvent <- types.TIMEOUT
+			return
+		} // else do not send an event. Another timer started
 		gd.timeoutVersionLock.Unlock()
-		gd.stateEvent <- types.TIMEOUT
+	})
+}
+
+// cachedMeta is the meta data of a node with its encoding
+type cachedMeta struct {
+	raw  string
+	meta types.NodeMetaInfo
+}
+
+// decodeNodeMeta returns the decoded meta data of the node. Memberlist
+// repeats the meta data of every node in all the alive messages and
+// push/pulls so the last decoded one of every node is cached.
+func (gd *GossipDelegate) decodeNodeMeta(
+	node *memberlist.Node,
+) (types.NodeMetaInfo, error) {
+	gd.metaCacheLock.Lock()
+	defer gd.metaCacheLock.Unlock()
+	if cached, ok := gd.metaCache[node.Name]; ok &&
+		cached.raw == string(node.Meta) {
+		return cached.meta, nil
+	}
+	var nodeMeta types.NodeMetaInfo
+	if err := gd.convertFromBytes(node.Meta, &nodeMeta); err != nil {
+		return nodeMeta, err
+	}
+	if gd.metaCache == nil {
+		gd.metaCache = make(map[string]cachedMeta)
+	}
+	gd.metaCache[node.Name] = cachedMeta{raw: string(node.Meta), meta: nodeMeta}
+	return nodeMeta, nil
+}
+
+// forgetNodeMeta drops the cached meta data of the node
+func (gd *GossipDelegate) forgetNodeMeta(node *memberlist.Node) {
+	gd.metaCacheLock.Lock()
+	defer gd.metaCacheLock.Unlock()
+	delete(gd.metaCache, node.Name)
+}
+
+// updatePeerMeta records the meta data advertised by a peer
+func (gd *GossipDelegate) updatePeerMeta(node *memberlist.Node) {
+	nodeMeta, err := gd.decodeNodeMeta(node)
+	if err != nil {
 		return
-	} // else do not send an event. Another timer started
-	gd.timeoutVersionLock.Unlock()
+	}
+	gd.peerMetaLock.Lock()
+	defer gd.peerMetaLock.Unlock()
+	if gd.peerMeta == nil {
+		gd.peerMeta = make(map[string]types.NodeMetaInfo)
+	}
+	gd.peerMeta[node.Name] = nodeMeta
 }
 
-func (gd *GossipDelegate) parseMemberlistNodeName(nodeName string) string {
-	return strings.TrimSuffix(nodeName, gd.GetGossipVersion())
+// isPeerMember returns true if memberlist has notified us of the join
+// of the peer and not of its leave since
+func (gd *GossipDelegate) isPeerMember(node *memberlist.Node) bool {
+	gd.peerMetaLock.Lock()
+	defer gd.peerMetaLock.Unlock()
+	_, ok := gd.peerMeta[node.Name]
+	return ok
+}
+
+// removePeerMeta forgets the meta data of the peer. It returns true if
+// the node is still alive under another memberlist name.
+func (gd *GossipDelegate) removePeerMeta(node *memberlist.Node) bool {
+	gd.forgetNodeMeta(node)
+	gd.peerMetaLock.Lock()
+	defer gd.peerMetaLock.Unlock()
+	delete(gd.peerMeta, node.Name)
+	nodeName := gd.parseMemberlistNodeName(node.Name)
+	for name := range gd.peerMeta {
+		if gd.parseMemberlistNodeName(name) == nodeName {
+			return true
+		}
+	}
+	return false
+}
+
+// getQuorumView returns the number of quorum members and the view of
+// the cluster on which the quorum decisions are based. With peer confirmed
+// quorum, a quorum member which does not report us as UP in its gossiped
+// state is considered DOWN. Based on the maintenance quorum policy nodes
+// in maintenance might not be considered as quorum members.
+func (gd *GossipDelegate) getQuorumView() (uint, types.NodeInfoMap) {
+	numQuorumMembers := gd.getNumQuorumMembers()
+	nodeInfoMap := gd.GetLocalState()
+	selfId := types.NodeId(gd.nodeId)
+	for id, nodeInfo := range nodeInfoMap {
+		if !nodeInfo.QuorumMember {
+			continue
+		}
+		if nodeInfo.Maintenance && gd.maintenanceQuorumPolicy ==
+			types.MAINTENANCE_QUORUM_POLICY_EXCLUDE {
+			nodeInfo.QuorumMember = false
+			if numQuorumMembers > 0 {
+				numQuorumMembers--
+			}
+		} else if gd.peerConfirmedQuorum && id != selfId &&
+			!peerConfirmed(nodeInfo, selfId) {
+			nodeInfo.Status = types.NODE_STATUS_DOWN
+		}
+		nodeInfoMap[id] = nodeInfo
+	}
+	return numQuorumMembers, nodeInfoMap
+}
+
+// getQuorumNodeInfoMap returns the view of the cluster on which the
+// quorum decisions are based.
+func (gd *GossipDelegate) getQuorumNodeInfoMap() types.NodeInfoMap {
+	_, nodeInfoMap := gd.getQuorumView()
+	return nodeInfoMap
+}
+
+// updateQuorumMembers recounts the quorum members as seen by the quorum view
+// and returns true if the count has changed. The quorum view can only change
+// through gossip if peer confirmed quorum or maintenance exclusion are used.
+func (gd *GossipDelegate) updateQuorumMembers() bool {
+	if !gd.peerConfirmedQuorum && gd.maintenanceQuorumPolicy ==
+		types.MAINTENANCE_QUORUM_POLICY_COUNT {
+		return false
+	}
+	quorumMembers, nodeInfoMap := gd.getQuorumView()
+	quorumMembersUp := state.NumQuorumMembersUp(nodeInfoMap)
+
+	gd.quorumMembersLock.Lock()
+	defer gd.quorumMembersLock.Unlock()
+	changed := quorumMembers != gd.quorumMembers ||
+		quorumMembersUp != gd.quorumMembersUp
+	gd.quorumMembers = quorumMembers
+	gd.quorumMembersUp = quorumMembersUp
+	return changed
+}
+
+// peerConfirmed returns true if the given peer reports the node
+// with id as alive in its gossiped state
+func peerConfirmed(peer types.NodeInfo, id types.NodeId) bool {
+	status, ok := peer.PeerStatus[id]
+	return ok && (status == types.NODE_STATUS_UP ||
+		status == types.NODE_STATUS_MAINTENANCE)
 }
 
 func (gd *GossipDelegate) handleStateEvents() {
 	for {
 		// We block here until we get an event
-		event := <-gd.stateEvent
-		previousStatus := gd.currentState.NodeStatus()
-		switch event {
-		case types.SELF_ALIVE:
-			gd.currentState, _ = gd.currentState.SelfAlive(gd.GetLocalState())
-		case types.NODE_ALIVE:
-			gd.currentState, _ = gd.currentState.NodeAlive(gd.GetLocalState())
-		case types.SELF_LEAVE:
-			gd.currentState, _ = gd.currentState.SelfLeave()
-		case types.NODE_LEAVE:
-			gd.currentState, _ = gd.currentState.NodeLeave(gd.GetLocalState())
-		case types.UPDATE_CLUSTER_SIZE:
-			gd.currentState, _ = gd.currentState.UpdateClusterSize(
-				gd.getNumQuorumMembers(), gd.GetLocalState())
-		case types.TIMEOUT:
-			newState, _ := gd.currentState.Timeout(
-				gd.getNumQuorumMembers(), gd.GetLocalState())
-			if newState.NodeStatus() != gd.currentState.NodeStatus() {
-				logrus.Infof("gossip: Quorum Timeout. Waited for (%v)",
-					gd.quorumTimeout)
+		var event types.StateEvent
+		select {
+		case event = <-gd.stateEvent:
+		case done := <-gd.flushEvents:
+			if !gd.GetInjectedFaults().FreezeStateHandler {
+				gd.handleHeldEvents()
 			}
-			gd.currentState = newState
+			close(done)
+			continue
+		case initState := <-gd.initState:
+			gd.currentState = initState
+			gd.recordState(gd.currentState.String(), nil)
+			continue
 		}
-		newStatus := gd.currentState.NodeStatus()
-		if previousStatus == types.NODE_STATUS_UP &&
-			newStatus == types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
-			// Start a timer
-			go gd.startQuorumTimer()
+		if gd.GetInjectedFaults().FreezeStateHandler {
+			gd.heldEvents = append(gd.heldEvents, event)
+			continue
 		}
-		gd.UpdateSelfStatus(gd.currentState.NodeStatus())
+		gd.handleHeldEvents()
+		gd.handleStateEvent(event)
+	}
+}
+
+// handleHeldEvents handles the state events held while the state
+// handler was frozen
+func (gd *GossipDelegate) handleHeldEvents() {
+	for _, event := range gd.heldEvents {
+		gd.handleStateEvent(event)
+	}
+	gd.heldEvents = nil
+}
+
+func (gd *GossipDelegate) handleStateEvent(event types.StateEvent) {
+	previousStatus := gd.currentState.NodeStatus()
+	switch event {
+	case types.SELF_ALIVE:
+		gd.currentState, _ = gd.currentState.SelfAlive(gd.getQuorumNodeInfoMap())
+	case types.NODE_ALIVE:
+		gd.currentState, _ = gd.currentState.NodeAlive(gd.getQuorumNodeInfoMap())
+	case types.SELF_LEAVE:
+		gd.currentState, _ = gd.currentState.SelfLeave()
+	case types.NODE_LEAVE:
+		gd.currentState, _ = gd.currentState.NodeLeave(gd.getQuorumNodeInfoMap())
+	case types.UPDATE_CLUSTER_SIZE:
+		gd.currentState, _ = gd.currentState.UpdateClusterSize(
+			gd.getQuorumView())
+	case types.TIMEOUT:
+		newState, _ := gd.currentState.Timeout(gd.getQuorumView())
+		if newState.NodeStatus() != gd.currentState.NodeStatus() {
+			gd.log(types.LOG_COMPONENT_QUORUM).Infof("gossip: Quorum "+
+				"Timeout. Waited for (%v)", gd.quorumTimeout)
+		}
+		gd.currentState = newState
+	}
+	newStatus := gd.currentState.NodeStatus()
+	if newStatus != previousStatus {
+		gd.metrics.incrCounter([]string{"gossip", "state", "transitions"}, 1)
+		gd.updateStats(func(stats *types.GossipStats) {
+			stats.StateTransitions++
+		})
+		gd.recordState(gd.currentState.String(), &types.StateTransition{
+			Ts:    gd.clock.Now(),
+			Event: stateEventNames[event],
+			From:  previousStatus,
+			To:    newStatus,
+		})
+	} else {
+		gd.recordState(gd.currentState.String(), nil)
+	}
+	gd.emitQuorumMetrics(newStatus)
+	if previousStatus == types.NODE_STATUS_UP &&
+		newStatus == types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
+		// Start a timer
+		gd.startQuorumTimer()
 	}
+	gd.UpdateSelfStatus(gd.currentState.NodeStatus())
 }
@@ -0,0 +1,38 @@
+package proto
+
+import (
+	"github.com/libopenstorage/gossip/types"
+)
+
+// InjectFaults makes the node misbehave as described by faults.
+// The faults take effect on the next push/pull, alive notification
+// or state event. Unfreezing the state handler handles the held
+// state events before returning.
+func (gd *GossipDelegate) InjectFaults(faults types.GossipFaults) {
+	gd.faultsLock.Lock()
+	unfreeze := gd.faults.FreezeStateHandler &&
+		!faults.FreezeStateHandler && gd.handlingEvents
+	gd.faults = faults
+	gd.faultsLock.Unlock()
+	gd.log(types.LOG_COMPONENT_GOSSIP).Warnf("gossip: Injected faults: %+v",
+		faults)
+	if unfreeze {
+		gd.flushStateEvents()
+	}
+}
+
+// GetInjectedFaults returns the faults injected in the node
+func (gd *GossipDelegate) GetInjectedFaults() types.GossipFaults {
+	gd.faultsLock.Lock()
+	defer gd.faultsLock.Unlock()
+	return gd.faults
+}
+
+// corruptState returns a copy of the state with all its bits flipped
+func corruptState(buf []byte) []byte {
+	corrupted := make([]byte, len(buf))
+	for i, b := range buf {
+		corrupted[i] = ^b
+	}
+	return corrupted
+}
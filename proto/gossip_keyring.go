@@ -0,0 +1,243 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	ml "github.com/hashicorp/memberlist"
+	"github.com/libopenstorage/gossip/types"
+)
+
+type keyringOp uint8
+
+const (
+	KEYRING_INSTALL_KEY keyringOp = iota
+	KEYRING_USE_KEY
+	KEYRING_REMOVE_KEY
+)
+
+// keyringMessage is broadcast to all the nodes to apply a keyring
+// operation cluster-wide
+type keyringMessage struct {
+	Op  keyringOp
+	Key []byte
+}
+
+// gossipKeyring manages the memberlist keyring used for encrypting the
+// gossip and push/pull traffic. Keyring operations are applied locally and
+// then broadcast to the other nodes. To rotate a key without downtime,
+// install the new key, then use it and finally remove the old key.
+//
+// The broadcasts are best effort, so every node also gossips the
+// fingerprints of its keys with its node info. A key is only made the
+// primary key once all the nodes we see UP report that they hold it, and
+// a key is only removed once they all report our primary key as theirs.
+type gossipKeyring struct {
+	sync.Mutex
+	keyring *ml.Keyring
+}
+
+func newGossipKeyring(primaryKey []byte, keys [][]byte) (*gossipKeyring, error) {
+	if len(primaryKey) == 0 {
+		if len(keys) != 0 {
+			return nil, fmt.Errorf("gossip: Encryption keys provided " +
+				"without a primary encryption key")
+		}
+		// Encryption is disabled
+		return &gossipKeyring{}, nil
+	}
+	keyring, err := ml.NewKeyring(keys, primaryKey)
+	if err != nil {
+		return nil, fmt.Errorf("gossip: Invalid encryption keys: %v", err)
+	}
+	return &gossipKeyring{keyring: keyring}, nil
+}
+
+func (k *gossipKeyring) apply(msg keyringMessage) error {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.keyring == nil {
+		return fmt.Errorf("gossip: Encryption is not enabled")
+	}
+	switch msg.Op {
+	case KEYRING_INSTALL_KEY:
+		return k.keyring.AddKey(msg.Key)
+	case KEYRING_USE_KEY:
+		// The install operation might not have reached us yet.
+		if err := k.keyring.AddKey(msg.Key); err != nil {
+			return err
+		}
+		return k.keyring.UseKey(msg.Key)
+	case KEYRING_REMOVE_KEY:
+		if !k.hasKey(msg.Key) {
+			return nil
+		}
+		return k.keyring.RemoveKey(msg.Key)
+	}
+	return fmt.Errorf("gossip: Unknown keyring operation %v", msg.Op)
+}
+
+func (k *gossipKeyring) hasKey(key []byte) bool {
+	for _, installedKey := range k.keyring.GetKeys() {
+		if bytes.Equal(installedKey, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprints returns the fingerprints of the installed keys, the
+// primary key first. It is nil if encryption is disabled.
+func (k *gossipKeyring) fingerprints() []string {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.keyring == nil {
+		return nil
+	}
+	var fingerprints []string
+	for _, key := range k.keyring.GetKeys() {
+		fingerprints = append(fingerprints, keyFingerprint(key))
+	}
+	return fingerprints
+}
+
+// keyFingerprint identifies a key in the gossiped state without
+// revealing it
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k *gossipKeyring) listKeys() [][]byte {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.keyring == nil {
+		return nil
+	}
+	installedKeys := k.keyring.GetKeys()
+	keys := make([][]byte, len(installedKeys))
+	for i, key := range installedKeys {
+		keys[i] = append([]byte{}, key...)
+	}
+	return keys
+}
+
+// keyringOperation applies the keyring operation locally and broadcasts it
+// to the other nodes.
+func (gd *GossipDelegate) keyringOperation(op keyringOp, key []byte) error {
+	msg := keyringMessage{Op: op, Key: key}
+	if err := gd.keyring.apply(msg); err != nil {
+		return err
+	}
+	gd.updateSelfKeyring(gd.keyring.fingerprints())
+	return gd.queueBroadcast(KEYRING_MESSAGE, msg)
+}
+
+// peersWithoutKey returns the peers we see UP which do not report holding
+// the key, or which do not report it as their primary key if primary is
+// set, in order
+func (s *GossipStoreImpl) peersWithoutKey(
+	fingerprint string,
+	primary bool,
+) []types.NodeId {
+	s.Lock()
+	defer s.Unlock()
+
+	var peers []types.NodeId
+	for id, nodeInfo := range s.nodeMap {
+		if id == s.id || (nodeInfo.Status != types.NODE_STATUS_UP &&
+			nodeInfo.Status != types.NODE_STATUS_MAINTENANCE) {
+			continue
+		}
+		fingerprints := nodeInfo.KeyFingerprints
+		if primary && len(fingerprints) != 0 {
+			fingerprints = fingerprints[:1]
+		}
+		found := false
+		for _, f := range fingerprints {
+			if f == fingerprint {
+				found = true
+				break
+			}
+		}
+		if !found {
+			peers = append(peers, id)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return peers
+}
+
+// updateSelfKeyring records the fingerprints of our keys in our node info
+// so that the peers can tell which keys we hold
+func (s *GossipStoreImpl) updateSelfKeyring(fingerprints []string) {
+	s.Lock()
+	defer s.Unlock()
+
+	nodeInfo := s.nodeMap[s.id]
+	if reflect.DeepEqual(nodeInfo.KeyFingerprints, fingerprints) {
+		return
+	}
+	nodeInfo.KeyFingerprints = fingerprints
+	nodeInfo.LastUpdateTs = s.updateTs(nodeInfo.LastUpdateTs)
+	s.nodeMap[s.id] = nodeInfo
+}
+
+func (gd *GossipDelegate) handleKeyringMessage(buf []byte) {
+	logger := gd.log(types.LOG_COMPONENT_GOSSIP)
+	var msg keyringMessage
+	if err := gd.convertFromBytes(buf, &msg); err != nil {
+		logger.Warnf("gossip: Error in unmarshalling keyring message: %v", err)
+		return
+	}
+	if err := gd.keyring.apply(msg); err != nil {
+		logger.Warnf("gossip: Unable to apply keyring operation %v: %v",
+			msg.Op, err)
+	}
+	gd.updateSelfKeyring(gd.keyring.fingerprints())
+}
+
+// InstallKey installs a new encryption key on all the nodes. The key is
+// only used for decryption until it is made the primary key with UseKey.
+func (gd *GossipDelegate) InstallKey(key []byte) error {
+	return gd.keyringOperation(KEYRING_INSTALL_KEY, key)
+}
+
+// UseKey makes an installed key the primary encryption key on all the nodes.
+// It fails if a peer we see UP does not report holding the key yet.
+func (gd *GossipDelegate) UseKey(key []byte) error {
+	if peers := gd.peersWithoutKey(keyFingerprint(key), false); len(peers) != 0 {
+		return fmt.Errorf("gossip: Nodes %v do not hold the key yet, "+
+			"install it again or retry later", peers)
+	}
+	return gd.keyringOperation(KEYRING_USE_KEY, key)
+}
+
+// RemoveKey removes an encryption key from all the nodes. The primary
+// key cannot be removed. It fails if a peer we see UP does not report
+// our primary key as its primary key yet.
+func (gd *GossipDelegate) RemoveKey(key []byte) error {
+	keys := gd.keyring.listKeys()
+	if len(keys) != 0 && !bytes.Equal(keys[0], key) {
+		fingerprint := keyFingerprint(keys[0])
+		if peers := gd.peersWithoutKey(fingerprint, true); len(peers) != 0 {
+			return fmt.Errorf("gossip: Nodes %v do not use the primary key "+
+				"yet, use it again or retry later", peers)
+		}
+	}
+	return gd.keyringOperation(KEYRING_REMOVE_KEY, key)
+}
+
+// ListKeys returns the encryption keys installed on this node. The first
+// key is the primary key.
+func (gd *GossipDelegate) ListKeys() [][]byte {
+	return gd.keyring.listKeys()
+}
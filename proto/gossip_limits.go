@@ -0,0 +1,113 @@
+package proto
+
+import (
+	"fmt"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+// limitWarningRatio is the fraction of a limit above which the
+// limit is considered to be approached
+const limitWarningRatio = 0.8
+
+// storeLimits bounds the size of the state gossiped by this node.
+// A zero limit disables the check.
+type storeLimits struct {
+	maxKeySize  int
+	maxNodeSize int
+}
+
+func (l storeLimits) enabled() bool {
+	return l.maxKeySize > 0 || l.maxNodeSize > 0
+}
+
+// checkLimit returns an error if size exceeds the limit and emits
+// metrics if the limit is exceeded or approached
+func (s *GossipStoreImpl) checkLimit(name string, size int, limit int) error {
+	if size > limit {
+		s.metrics.incrCounter([]string{"gossip", "store", name, "exceeded"}, 1)
+		return fmt.Errorf("gossip: Size %v bytes exceeds the %v size "+
+			"limit of %v bytes", size, name, limit)
+	}
+	if float64(size) >= limitWarningRatio*float64(limit) {
+		s.metrics.incrCounter([]string{"gossip", "store", name, "approached"}, 1)
+	}
+	return nil
+}
+
+// checkSelfLimits checks the limits for the values of the keys and the
+// updated node info of this node. Caller should hold the lock.
+func (s *GossipStoreImpl) checkSelfLimits(
+	values types.StoreMap,
+	nodeInfo types.NodeInfo,
+) error {
+	if s.limits.maxKeySize > 0 {
+		for key, val := range values {
+			buf, err := s.convertToBytes(types.StoreMap{key: val})
+			if err != nil {
+				return fmt.Errorf("gossip: Unable to encode key %v: %v",
+					key, err)
+			}
+			err = s.checkLimit("key", len(buf), s.limits.maxKeySize)
+			if err != nil {
+				return fmt.Errorf("%v for key %v", err, key)
+			}
+		}
+	}
+	if s.limits.maxNodeSize > 0 {
+		// Account for the fields added when the node info is gossiped
+		nodeInfo.PeerStatus = s.getPeerStatus()
+		nodeInfo.PeerVersions = s.getPeerVersions()
+		if s.auth.enabled() {
+			nodeInfo.Signature = s.auth.sign(nil)
+		}
+		buf, err := s.convertToBytes(nodeInfo)
+		if err != nil {
+			return fmt.Errorf("gossip: Unable to encode node info: %v", err)
+		}
+		s.metrics.setGauge([]string{"gossip", "store", "node_size"},
+			float32(len(buf)))
+		if err := s.checkLimit("node", len(buf), s.limits.maxNodeSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withValues returns a copy of the node info with the keys updated
+func withValues(
+	nodeInfo types.NodeInfo,
+	values types.StoreMap,
+) types.NodeInfo {
+	value := make(types.StoreMap, len(nodeInfo.Value)+len(values))
+	for k, v := range nodeInfo.Value {
+		value[k] = v
+	}
+	for k, v := range values {
+		value[k] = v
+	}
+	nodeInfo.Value = value
+	return nodeInfo
+}
+
+// withNamespaceValue returns a copy of the node info with the key
+// of the namespace updated
+func withNamespaceValue(
+	nodeInfo types.NodeInfo,
+	name string,
+	key types.StoreKey,
+	val interface{},
+) types.NodeInfo {
+	namespaces := make(map[string]types.StoreMap, len(nodeInfo.Namespaces)+1)
+	for n, values := range nodeInfo.Namespaces {
+		namespaces[n] = values
+	}
+	values := make(types.StoreMap, len(namespaces[name])+1)
+	for k, v := range namespaces[name] {
+		values[k] = v
+	}
+	values[key] = val
+	namespaces[name] = values
+	nodeInfo.Namespaces = namespaces
+	return nodeInfo
+}
@@ -0,0 +1,180 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libopenstorage/gossip/types"
+	"github.com/sirupsen/logrus"
+)
+
+// logrusLogger is the default logger which logs to the standard
+// logrus logger
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+func (l *logrusLogger) WithFields(fields map[string]interface{}) types.Logger {
+	return &logrusLogger{entry: l.entry.WithFields(logrus.Fields(fields))}
+}
+
+func (l *logrusLogger) Debugf(format string, args ...interface{}) {
+	l.entry.Debugf(format, args...)
+}
+
+func (l *logrusLogger) Infof(format string, args ...interface{}) {
+	l.entry.Infof(format, args...)
+}
+
+func (l *logrusLogger) Warnf(format string, args ...interface{}) {
+	l.entry.Warnf(format, args...)
+}
+
+func (l *logrusLogger) Errorf(format string, args ...interface{}) {
+	l.entry.Errorf(format, args...)
+}
+
+// leveledLogger drops the messages below its level
+type leveledLogger struct {
+	logger types.Logger
+	level  types.LogLevel
+}
+
+func (l *leveledLogger) WithFields(fields map[string]interface{}) types.Logger {
+	return &leveledLogger{logger: l.logger.WithFields(fields), level: l.level}
+}
+
+func (l *leveledLogger) Debugf(format string, args ...interface{}) {
+	if l.level <= types.LOG_LEVEL_DEBUG {
+		l.logger.Debugf(format, args...)
+	}
+}
+
+func (l *leveledLogger) Infof(format string, args ...interface{}) {
+	if l.level <= types.LOG_LEVEL_INFO {
+		l.logger.Infof(format, args...)
+	}
+}
+
+func (l *leveledLogger) Warnf(format string, args ...interface{}) {
+	if l.level <= types.LOG_LEVEL_WARN {
+		l.logger.Warnf(format, args...)
+	}
+}
+
+func (l *leveledLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Errorf(format, args...)
+}
+
+// gossipLogger holds the loggers of the components. A nil gossipLogger
+// logs to the standard logrus logger at the default level.
+type gossipLogger struct {
+	loggers map[types.LogComponent]types.Logger
+}
+
+func newGossipLogger(
+	logger types.Logger,
+	levels map[types.LogComponent]types.LogLevel,
+	nodeId types.NodeId,
+	clusterId string,
+) (*gossipLogger, error) {
+	for component, level := range levels {
+		if !knownLogComponent(component) {
+			return nil, fmt.Errorf("gossip: Unknown log component %v",
+				component)
+		}
+		if level > types.LOG_LEVEL_ERROR {
+			return nil, fmt.Errorf("gossip: Unknown log level %v for "+
+				"component %v", level, component)
+		}
+	}
+	if logger == nil {
+		logger = &logrusLogger{entry: logrus.NewEntry(logrus.StandardLogger())}
+	}
+	logger = logger.WithFields(map[string]interface{}{
+		"node_id":    string(nodeId),
+		"cluster_id": clusterId,
+	})
+	gl := &gossipLogger{loggers: make(map[types.LogComponent]types.Logger)}
+	for _, component := range types.LOG_COMPONENTS {
+		level, ok := levels[component]
+		if !ok {
+			level = types.LOG_LEVEL_INFO
+		}
+		gl.loggers[component] = &leveledLogger{
+			logger: logger.WithFields(map[string]interface{}{
+				"component": string(component),
+			}),
+			level: level,
+		}
+	}
+	return gl, nil
+}
+
+func knownLogComponent(component types.LogComponent) bool {
+	for _, c := range types.LOG_COMPONENTS {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+// component returns the logger of the component
+func (gl *gossipLogger) component(component types.LogComponent) types.Logger {
+	if gl == nil {
+		return &logrusLogger{entry: logrus.WithField("component",
+			string(component))}
+	}
+	return gl.loggers[component]
+}
+
+// memberlistLogWriter is the LogOutput of memberlist. It parses the level
+// out of memberlist's log lines, which look like
+// "2006/01/02 15:04:05 [DEBUG] memberlist: message", and logs them to
+// the memberlist component logger.
+type memberlistLogWriter struct {
+	logger types.Logger
+}
+
+var memberlistLogLevels = map[string]types.LogLevel{
+	"DEBUG": types.LOG_LEVEL_DEBUG,
+	"INFO":  types.LOG_LEVEL_INFO,
+	"WARN":  types.LOG_LEVEL_WARN,
+	"ERR":   types.LOG_LEVEL_ERROR,
+	"ERROR": types.LOG_LEVEL_ERROR,
+}
+
+// parseMemberlistLog returns the level and the message of a memberlist
+// log line. Lines without a known level are logged at LOG_LEVEL_INFO.
+func parseMemberlistLog(line string) (types.LogLevel, string) {
+	line = strings.TrimSpace(line)
+	start := strings.Index(line, "[")
+	if start < 0 {
+		return types.LOG_LEVEL_INFO, line
+	}
+	end := strings.Index(line[start:], "]")
+	if end < 0 {
+		return types.LOG_LEVEL_INFO, line
+	}
+	level, ok := memberlistLogLevels[line[start+1:start+end]]
+	if !ok {
+		return types.LOG_LEVEL_INFO, line
+	}
+	return level, strings.TrimSpace(line[start+end+1:])
+}
+
+func (w *memberlistLogWriter) Write(p []byte) (int, error) {
+	level, msg := parseMemberlistLog(string(p))
+	switch level {
+	case types.LOG_LEVEL_DEBUG:
+		w.logger.Debugf("%s", msg)
+	case types.LOG_LEVEL_INFO:
+		w.logger.Infof("%s", msg)
+	case types.LOG_LEVEL_WARN:
+		w.logger.Warnf("%s", msg)
+	default:
+		w.logger.Errorf("%s", msg)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,134 @@
+package proto
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+// sortedKeys are the keys of a node in order as of an update of the node
+type sortedKeys struct {
+	genNumber    uint64
+	lastUpdateTs time.Time
+	keys         []types.StoreKey
+}
+
+// Get returns the value of a node's key without copying the node's
+// other values. It returns false if the node or the key is not known.
+func (s *GossipStoreImpl) Get(
+	nodeId types.NodeId,
+	key types.StoreKey,
+) (types.NodeValue, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	nodeInfo, ok := s.nodeMap[nodeId]
+	if !ok {
+		return types.NodeValue{}, false
+	}
+	val, ok := nodeInfo.Value[key]
+	if !ok {
+		return types.NodeValue{}, false
+	}
+	return s.nodeValue(nodeInfo, val, s.clock.Now()), true
+}
+
+// GetNodeKeys returns the keys of a node in order
+func (s *GossipStoreImpl) GetNodeKeys(nodeId types.NodeId) []types.StoreKey {
+	s.Lock()
+	defer s.Unlock()
+
+	nodeInfo, ok := s.nodeMap[nodeId]
+	if !ok {
+		return nil
+	}
+	keys := s.nodeKeys(nodeInfo)
+	return append(make([]types.StoreKey, 0, len(keys)), keys...)
+}
+
+// ScanNodeKeys returns the values of a node's keys which start with
+// the prefix
+func (s *GossipStoreImpl) ScanNodeKeys(
+	nodeId types.NodeId,
+	prefix types.StoreKey,
+) types.StoreMap {
+	s.Lock()
+	defer s.Unlock()
+
+	values := make(types.StoreMap)
+	nodeInfo, ok := s.nodeMap[nodeId]
+	if !ok {
+		return values
+	}
+	for _, key := range prefixKeys(s.nodeKeys(nodeInfo), prefix) {
+		values[key] = nodeInfo.Value[key]
+	}
+	return values
+}
+
+// ScanStoreKeys returns the values of the keys which start with the
+// prefix on all the nodes with a valid status, keyed by key. Only the
+// nodes which have a key are in its values.
+func (s *GossipStoreImpl) ScanStoreKeys(
+	prefix types.StoreKey,
+) map[types.StoreKey]types.NodeValueMap {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.clock.Now()
+	scan := make(map[types.StoreKey]types.NodeValueMap)
+	for id, nodeInfo := range s.nodeMap {
+		if !statusValid(nodeInfo.Status) {
+			continue
+		}
+		for _, key := range prefixKeys(s.nodeKeys(nodeInfo), prefix) {
+			values, ok := scan[key]
+			if !ok {
+				values = make(types.NodeValueMap)
+				scan[key] = values
+			}
+			values[id] = s.nodeValue(nodeInfo, nodeInfo.Value[key], now)
+		}
+	}
+	return scan
+}
+
+// nodeKeys returns the keys of the node in order. They are sorted once
+// per update of the node. Caller should hold the lock and must not
+// modify the keys.
+func (s *GossipStoreImpl) nodeKeys(nodeInfo types.NodeInfo) []types.StoreKey {
+	cached, ok := s.keyIndex[nodeInfo.Id]
+	if ok && cached.genNumber == nodeInfo.GenNumber &&
+		cached.lastUpdateTs.Equal(nodeInfo.LastUpdateTs) &&
+		len(cached.keys) == len(nodeInfo.Value) {
+		return cached.keys
+	}
+	keys := make([]types.StoreKey, 0, len(nodeInfo.Value))
+	for key := range nodeInfo.Value {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if s.keyIndex == nil {
+		s.keyIndex = make(map[types.NodeId]sortedKeys)
+	}
+	s.keyIndex[nodeInfo.Id] = sortedKeys{
+		genNumber:    nodeInfo.GenNumber,
+		lastUpdateTs: nodeInfo.LastUpdateTs,
+		keys:         keys,
+	}
+	return keys
+}
+
+// prefixKeys returns the sorted keys which start with the prefix
+func prefixKeys(keys []types.StoreKey, prefix types.StoreKey) []types.StoreKey {
+	start := sort.Search(len(keys), func(i int) bool {
+		return keys[i] >= prefix
+	})
+	end := start
+	for end < len(keys) && strings.HasPrefix(string(keys[end]), string(prefix)) {
+		end++
+	}
+	return keys[start:end]
+}
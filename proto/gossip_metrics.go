@@ -0,0 +1,100 @@
+package proto
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/libopenstorage/gossip/proto/state"
+	"github.com/libopenstorage/gossip/types"
+)
+
+// gossipMetrics emits the gossip metrics to its own go-metrics instance.
+// A nil gossipMetrics emits to the global go-metrics instance.
+type gossipMetrics struct {
+	m *metrics.Metrics
+}
+
+func newGossipMetrics(sink metrics.MetricSink) (*gossipMetrics, error) {
+	if sink == nil {
+		return nil, nil
+	}
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	m, err := metrics.New(conf, sink)
+	if err != nil {
+		return nil, err
+	}
+	return &gossipMetrics{m: m}, nil
+}
+
+func (gm *gossipMetrics) incrCounter(key []string, val float32) {
+	if gm == nil {
+		metrics.IncrCounter(key, val)
+		return
+	}
+	gm.m.IncrCounter(key, val)
+}
+
+func (gm *gossipMetrics) setGauge(key []string, val float32) {
+	if gm == nil {
+		metrics.SetGauge(key, val)
+		return
+	}
+	gm.m.SetGauge(key, val)
+}
+
+func (gm *gossipMetrics) measureSince(key []string, start time.Time) {
+	if gm == nil {
+		metrics.MeasureSince(key, start)
+		return
+	}
+	gm.m.MeasureSince(key, start)
+}
+
+// emitQuorumMetrics emits our status and the quorum votes as seen by
+// the quorum view
+func (gd *GossipDelegate) emitQuorumMetrics(status types.NodeStatus) {
+	quorumMembers, nodeInfoMap := gd.getQuorumView()
+	gd.metrics.setGauge([]string{"gossip", "state", "status"}, float32(status))
+	gd.metrics.setGauge([]string{"gossip", "quorum", "members"},
+		float32(quorumMembers))
+	gd.metrics.setGauge([]string{"gossip", "quorum", "members_up"},
+		float32(state.NumQuorumMembersUp(nodeInfoMap)))
+}
+
+// emitPeriodicMetrics emits the metrics which change with time
+func (gd *GossipDelegate) emitPeriodicMetrics() {
+	stats := gd.GetStats()
+	if !stats.LastGossipTs.IsZero() {
+		gd.metrics.setGauge([]string{"gossip", "last_gossip_age"},
+			float32(gd.clock.Now().Sub(stats.LastGossipTs).Seconds()))
+	}
+	numNodes, numKeys, nodeSize := gd.storeSize()
+	gd.metrics.setGauge([]string{"gossip", "store", "nodes"}, float32(numNodes))
+	gd.metrics.setGauge([]string{"gossip", "store", "keys"}, float32(numKeys))
+	gd.metrics.setGauge([]string{"gossip", "store", "node_size"},
+		float32(nodeSize))
+}
+
+// GetStats returns the counters of the gossip activity of this node
+func (gd *GossipDelegate) GetStats() types.GossipStats {
+	gd.statsLock.Lock()
+	stats := gd.stats
+	gd.statsLock.Unlock()
+
+	gd.lastGossipTsLock.Lock()
+	stats.LastGossipTs = gd.lastGossipTs
+	gd.lastGossipTsLock.Unlock()
+	stats.ForgedUpdates = gd.NumForgedUpdates()
+	quorumMembers, nodeInfoMap := gd.getQuorumView()
+	stats.QuorumMembers = quorumMembers
+	stats.QuorumMembersUp = state.NumQuorumMembersUp(nodeInfoMap)
+	return stats
+}
+
+func (gd *GossipDelegate) updateStats(update func(stats *types.GossipStats)) {
+	gd.statsLock.Lock()
+	defer gd.statsLock.Unlock()
+	update(&gd.stats)
+}
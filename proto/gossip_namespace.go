@@ -0,0 +1,252 @@
+package proto
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+// namespaceEvent is a change of a key in a namespace to be
+// reported to the watchers
+type namespaceEvent struct {
+	namespace string
+	nodeId    types.NodeId
+	key       types.StoreKey
+	value     interface{}
+}
+
+// gossipNamespace implements the types.Namespace interface on
+// top of the gossip store
+type gossipNamespace struct {
+	name  string
+	store *GossipStoreImpl
+}
+
+// Namespace returns a handle to the namespace with the given name.
+// The namespace is created on the first update.
+func (s *GossipStoreImpl) Namespace(name string) types.Namespace {
+	return &gossipNamespace{name: name, store: s}
+}
+
+// GetNamespaces returns the namespaces present on any node
+func (s *GossipStoreImpl) GetNamespaces() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	nameMap := make(map[string]bool)
+	for _, nodeInfo := range s.nodeMap {
+		for name := range nodeInfo.Namespaces {
+			nameMap[name] = true
+		}
+	}
+	names := make([]string, 0, len(nameMap))
+	for name := range nameMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (n *gossipNamespace) Name() string {
+	return n.name
+}
+
+func (n *gossipNamespace) UpdateSelf(key types.StoreKey, val interface{}) error {
+	return n.store.updateSelfNamespace(n.name, key, val, false)
+}
+
+func (n *gossipNamespace) DeleteSelf(key types.StoreKey) {
+	n.store.updateSelfNamespace(n.name, key, nil, true)
+}
+
+func (n *gossipNamespace) GetStoreKeyValue(key types.StoreKey) types.NodeValueMap {
+	s := n.store
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.clock.Now()
+	nodeValueMap := make(types.NodeValueMap)
+	for id, nodeInfo := range s.nodeMap {
+		if !statusValid(nodeInfo.Status) {
+			continue
+		}
+		val, ok := nodeInfo.Namespaces[n.name][key]
+		if !ok {
+			continue
+		}
+		nodeValueMap[id] = s.nodeValue(nodeInfo, val, now)
+	}
+	return nodeValueMap
+}
+
+func (n *gossipNamespace) GetStoreKeys() []types.StoreKey {
+	s := n.store
+	s.Lock()
+	defer s.Unlock()
+
+	keyMap := make(map[types.StoreKey]bool)
+	for _, nodeInfo := range s.nodeMap {
+		for key := range nodeInfo.Namespaces[n.name] {
+			keyMap[key] = true
+		}
+	}
+	storeKeys := make([]types.StoreKey, 0, len(keyMap))
+	for key := range keyMap {
+		storeKeys = append(storeKeys, key)
+	}
+	return storeKeys
+}
+
+func (n *gossipNamespace) Watch(cb types.NamespaceWatchCb) {
+	s := n.store
+	s.Lock()
+	defer s.Unlock()
+
+	if s.namespaceWatches == nil {
+		s.namespaceWatches = make(map[string][]types.NamespaceWatchCb)
+	}
+	s.namespaceWatches[n.name] = append(s.namespaceWatches[n.name], cb)
+}
+
+func (n *gossipNamespace) Size() int {
+	s := n.store
+	s.Lock()
+	defer s.Unlock()
+
+	values, ok := s.nodeMap[s.id].Namespaces[n.name]
+	if !ok {
+		return 0
+	}
+	buf, err := s.convertToBytes(values)
+	if err != nil {
+		s.log(types.LOG_COMPONENT_STORE).Warnf("gossip: Unable to encode "+
+			"namespace %v: %v", n.name, err)
+		return 0
+	}
+	return len(buf)
+}
+
+func (s *GossipStoreImpl) updateSelfNamespace(
+	name string,
+	key types.StoreKey,
+	val interface{},
+	remove bool,
+) error {
+	s.Lock()
+	// The maps are copied rather than modified, so the node infos
+	// handed out before are not changed
+	nodeInfo, _ := s.nodeMap[s.id]
+	if remove {
+		nodeInfo = withoutNamespaceValue(nodeInfo, name, key)
+	} else {
+		nodeInfo = withNamespaceValue(nodeInfo, name, key, val)
+		if s.limits.enabled() {
+			err := s.checkSelfLimits(types.StoreMap{key: val}, nodeInfo)
+			if err != nil {
+				s.Unlock()
+				return err
+			}
+		}
+	}
+	nodeInfo.Version++
+	nodeInfo.LastUpdateTs = s.updateTs(nodeInfo.LastUpdateTs)
+	s.nodeMap[s.id] = nodeInfo
+	var events []namespaceEvent
+	if len(s.namespaceWatches[name]) != 0 {
+		events = append(events, namespaceEvent{
+			namespace: name,
+			nodeId:    s.id,
+			key:       key,
+			value:     val,
+		})
+	}
+	s.Unlock()
+
+	s.notifyNamespaceWatches(events)
+	return nil
+}
+
+// withoutNamespaceValue returns a copy of the node info without the key
+// of the namespace. The namespace is dropped once it has no keys.
+func withoutNamespaceValue(
+	nodeInfo types.NodeInfo,
+	name string,
+	key types.StoreKey,
+) types.NodeInfo {
+	namespaces := make(map[string]types.StoreMap, len(nodeInfo.Namespaces))
+	for n, values := range nodeInfo.Namespaces {
+		namespaces[n] = values
+	}
+	values := make(types.StoreMap, len(namespaces[name]))
+	for k, v := range namespaces[name] {
+		if k != key {
+			values[k] = v
+		}
+	}
+	if len(values) == 0 {
+		delete(namespaces, name)
+	} else {
+		namespaces[name] = values
+	}
+	nodeInfo.Namespaces = namespaces
+	return nodeInfo
+}
+
+// namespaceChanges returns the events for the watched namespaces which
+// have changed between the old and the new node info.
+// Caller should hold the lock.
+func (s *GossipStoreImpl) namespaceChanges(
+	oldInfo types.NodeInfo,
+	newInfo types.NodeInfo,
+) []namespaceEvent {
+	var events []namespaceEvent
+	for name, watches := range s.namespaceWatches {
+		if len(watches) == 0 {
+			continue
+		}
+		oldValues := oldInfo.Namespaces[name]
+		newValues := newInfo.Namespaces[name]
+		for key, val := range newValues {
+			if oldVal, ok := oldValues[key]; ok && reflect.DeepEqual(oldVal, val) {
+				continue
+			}
+			events = append(events, namespaceEvent{
+				namespace: name,
+				nodeId:    newInfo.Id,
+				key:       key,
+				value:     val,
+			})
+		}
+		for key := range oldValues {
+			if _, ok := newValues[key]; !ok {
+				events = append(events, namespaceEvent{
+					namespace: name,
+					nodeId:    newInfo.Id,
+					key:       key,
+				})
+			}
+		}
+	}
+	return events
+}
+
+// notifyNamespaceWatches invokes the watches for the events.
+// It should be called without holding the lock.
+func (s *GossipStoreImpl) notifyNamespaceWatches(events []namespaceEvent) {
+	if len(events) == 0 {
+		return
+	}
+	s.Lock()
+	watches := make(map[string][]types.NamespaceWatchCb)
+	for name, cbs := range s.namespaceWatches {
+		watches[name] = cbs
+	}
+	s.Unlock()
+
+	for _, event := range events {
+		for _, cb := range watches[event.namespace] {
+			cb(event.nodeId, event.key, event.value)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package proto
+
+import (
+	"math/rand"
+	"net"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/libopenstorage/gossip/types"
+)
+
+// pingRequestMessage asks a peer to probe the target on our behalf, like
+// the indirect pings of memberlist. The peer answers with a
+// pingResponseMessage carrying the same sequence number.
+type pingRequestMessage struct {
+	Seq    uint64
+	From   types.NodeId
+	Target types.NodeId
+}
+
+// pingResponseMessage tells whether the target responded to the probe
+// of the peer
+type pingResponseMessage struct {
+	Seq       uint64
+	From      types.NodeId
+	Reachable bool
+}
+
+// memberNode returns the memberlist node of the member with the id. It
+// is nil if the node is not a member.
+func (gd *GossipDelegate) memberNode(nodeId types.NodeId) *memberlist.Node {
+	if gd.mlist == nil {
+		return nil
+	}
+	for _, node := range gd.mlist.Members() {
+		if gd.parseMemberlistNodeName(node.Name) == string(nodeId) {
+			return node
+		}
+	}
+	return nil
+}
+
+// probeNode sends a direct ping to the node. It returns whether the node
+// could be probed and whether it responded.
+func (gd *GossipDelegate) probeNode(nodeId types.NodeId) (bool, bool) {
+	node := gd.memberNode(nodeId)
+	if node == nil {
+		// The node is not a member. It has been declared dead by memberlist.
+		return false, false
+	}
+	addr := &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
+	if _, err := gd.mlist.Ping(node.Name, addr); err != nil {
+		gd.log(types.LOG_COMPONENT_QUORUM).Infof("gossip: Probe to node "+
+			"%v failed: %v", nodeId, err)
+		return true, false
+	}
+	return true, true
+}
+
+// sendMessage sends a user data message to a member
+func (gd *GossipDelegate) sendMessage(
+	node *memberlist.Node,
+	msgType messageType,
+	msg interface{},
+) error {
+	msgBytes, err := gd.convertToBytes(msg)
+	if err != nil {
+		return err
+	}
+	return gd.mlist.SendToUDP(node, append([]byte{byte(msgType)}, msgBytes...))
+}
+
+// indirectProbe asks up to IndirectChecks of the members we see UP to
+// probe the node and returns their answers keyed by peer. It waits for
+// the answers until the end of a probe interval.
+func (g *GossiperImpl) indirectProbe(nodeId types.NodeId) map[types.NodeId]bool {
+	selfId := g.NodeId()
+	var peers []*memberlist.Node
+	for id, nodeInfo := range g.GetLocalState() {
+		if id == selfId || id == nodeId ||
+			(nodeInfo.Status != types.NODE_STATUS_UP &&
+				nodeInfo.Status != types.NODE_STATUS_MAINTENANCE) {
+			continue
+		}
+		if node := g.memberNode(id); node != nil {
+			peers = append(peers, node)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > g.mlConf.IndirectChecks {
+		peers = peers[:g.mlConf.IndirectChecks]
+	}
+
+	seq, responses := g.addPingRequest(len(peers))
+	defer g.removePingRequest(seq)
+	asked := make(map[types.NodeId]bool)
+	for _, peer := range peers {
+		id := types.NodeId(g.parseMemberlistNodeName(peer.Name))
+		err := g.sendMessage(peer, PING_REQUEST_MESSAGE, pingRequestMessage{
+			Seq:    seq,
+			From:   selfId,
+			Target: nodeId,
+		})
+		if err != nil {
+			g.log(types.LOG_COMPONENT_QUORUM).Warnf("gossip: Unable to ask "+
+				"node %v to probe node %v: %v", id, nodeId, err)
+			continue
+		}
+		asked[id] = true
+	}
+
+	results := make(map[types.NodeId]bool)
+	if len(asked) == 0 {
+		return results
+	}
+	expired := make(chan struct{})
+	timer := g.clock.AfterFunc(g.mlConf.ProbeInterval, func() {
+		close(expired)
+	})
+	defer timer.Stop()
+	for len(results) < len(asked) {
+		select {
+		case resp := <-responses:
+			if asked[resp.From] {
+				results[resp.From] = resp.Reachable
+			}
+		case <-expired:
+			return results
+		}
+	}
+	return results
+}
+
+// addPingRequest registers an indirect probe and returns its sequence
+// number and the channel receiving the answers
+func (gd *GossipDelegate) addPingRequest(
+	numPeers int,
+) (uint64, chan pingResponseMessage) {
+	gd.pingRequestsLock.Lock()
+	defer gd.pingRequestsLock.Unlock()
+	gd.pingRequestSeq++
+	responses := make(chan pingResponseMessage, numPeers)
+	gd.pingRequests[gd.pingRequestSeq] = responses
+	return gd.pingRequestSeq, responses
+}
+
+func (gd *GossipDelegate) removePingRequest(seq uint64) {
+	gd.pingRequestsLock.Lock()
+	defer gd.pingRequestsLock.Unlock()
+	delete(gd.pingRequests, seq)
+}
+
+func (gd *GossipDelegate) handlePingRequest(buf []byte) {
+	var req pingRequestMessage
+	if err := gd.convertFromBytes(buf, &req); err != nil {
+		gd.log(types.LOG_COMPONENT_QUORUM).Warnf("gossip: Error in "+
+			"unmarshalling ping request: %v", err)
+		return
+	}
+	// Probing the target blocks until it responds or times out
+	go gd.answerPingRequest(req)
+}
+
+// answerPingRequest probes the target of the request and sends the result
+// to the requester
+func (gd *GossipDelegate) answerPingRequest(req pingRequestMessage) {
+	_, reachable := gd.probeNode(req.Target)
+	from := gd.memberNode(req.From)
+	if from == nil {
+		gd.log(types.LOG_COMPONENT_QUORUM).Warnf("gossip: Unable to answer "+
+			"the ping request of node %v as it is not a member", req.From)
+		return
+	}
+	err := gd.sendMessage(from, PING_RESPONSE_MESSAGE, pingResponseMessage{
+		Seq:       req.Seq,
+		From:      types.NodeId(gd.nodeId),
+		Reachable: reachable,
+	})
+	if err != nil {
+		gd.log(types.LOG_COMPONENT_QUORUM).Warnf("gossip: Unable to answer "+
+			"the ping request of node %v: %v", req.From, err)
+	}
+}
+
+func (gd *GossipDelegate) handlePingResponse(buf []byte) {
+	var resp pingResponseMessage
+	if err := gd.convertFromBytes(buf, &resp); err != nil {
+		gd.log(types.LOG_COMPONENT_QUORUM).Warnf("gossip: Error in "+
+			"unmarshalling ping response: %v", err)
+		return
+	}
+	gd.pingRequestsLock.Lock()
+	defer gd.pingRequestsLock.Unlock()
+	responses, ok := gd.pingRequests[resp.Seq]
+	if !ok {
+		// The request has expired
+		return
+	}
+	select {
+	case responses <- resp:
+	default:
+		// Only the peers we asked answer, and once each
+	}
+}
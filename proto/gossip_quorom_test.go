@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"github.com/libopenstorage/gossip/proto/state"
 	"github.com/libopenstorage/gossip/types"
 	"strconv"
 	"testing"
@@ -16,15 +17,23 @@ func addKey(g *GossiperImpl) types.StoreKey {
 	return key
 }
 
+// startNode starts a gossiper on the simulated network which joins the
+// peer ips. Joining fails if none of them is on the network yet.
 func startNode(
 	t *testing.T,
+	n *SimNetwork,
 	selfIp string,
 	nodeId types.NodeId,
 	peerIps []string,
 	peers map[types.NodeId]types.NodeUpdate,
 ) (*GossiperImpl, types.StoreKey) {
-	g, _ := NewGossiperImpl(selfIp, nodeId, peerIps,
-		types.DEFAULT_GOSSIP_VERSION)
+	g, err := n.NewGossiper(selfIp, nodeId, 1, simIntervals,
+		types.DEFAULT_GOSSIP_VERSION, DEFAULT_CLUSTER_ID,
+		types.GossipOptions{})
+	if err != nil {
+		t.Fatal("Error in creating gossiper: ", err)
+	}
+	g.Start(peerIps)
 	g.UpdateCluster(peers)
 	key := addKey(g)
 	return g, key
@@ -33,6 +42,7 @@ func startNode(
 func TestQuorumAllNodesUpOneByOne(t *testing.T) {
 	printTestInfo()
 
+	n := NewSimNetwork(1)
 	nodes := []string{
 		"127.0.0.1:9900",
 		"127.0.0.2:9901",
@@ -40,11 +50,11 @@ func TestQuorumAllNodesUpOneByOne(t *testing.T) {
 
 	// Start Node0 with cluster size 1
 	node0 := types.NodeId("0")
-	g0, _ := startNode(t, nodes[0], node0, []string{},
+	g0, _ := startNode(t, n, nodes[0], node0, []string{},
 		map[types.NodeId]types.NodeUpdate{
-			node0: types.NodeUpdate{nodes[0], true}})
+			node0: types.NodeUpdate{Addr: nodes[0], QuorumMember: true}})
 
-	time.Sleep(g0.GossipInterval())
+	n.Advance(g0.GossipInterval())
 	status := g0.GetSelfStatus()
 	if status != types.NODE_STATUS_UP {
 		t.Error("Expected Node 0 to have status: ", types.NODE_STATUS_UP,
@@ -54,12 +64,12 @@ func TestQuorumAllNodesUpOneByOne(t *testing.T) {
 	// Start Node1 with cluster size 2
 	node1 := types.NodeId("1")
 	peers := map[types.NodeId]types.NodeUpdate{
-		node0: types.NodeUpdate{nodes[0], true},
-		node1: types.NodeUpdate{nodes[1], true}}
-	g1, _ := startNode(t, nodes[1], node1, []string{nodes[0]}, peers)
+		node0: types.NodeUpdate{Addr: nodes[0], QuorumMember: true},
+		node1: types.NodeUpdate{Addr: nodes[1], QuorumMember: true}}
+	g1, _ := startNode(t, n, nodes[1], node1, []string{nodes[0]}, peers)
 	g0.UpdateCluster(peers)
 
-	time.Sleep(g1.GossipInterval() * time.Duration(len(nodes)+1))
+	n.Advance(g1.GossipInterval() * time.Duration(len(nodes)+1))
 
 	if g1.GetSelfStatus() != types.NODE_STATUS_UP {
 		t.Error("Expected Node 1 to have status: ", types.NODE_STATUS_UP)
@@ -77,6 +87,7 @@ func TestQuorumAllNodesUpOneByOne(t *testing.T) {
 func TestQuorumNodeLoosesQuorumAndGainsBack(t *testing.T) {
 	printTestInfo()
 
+	n := NewSimNetwork(2)
 	nodes := []string{
 		"127.0.0.1:9902",
 		"127.0.0.2:9903",
@@ -85,11 +96,11 @@ func TestQuorumNodeLoosesQuorumAndGainsBack(t *testing.T) {
 	node0 := types.NodeId("0")
 	node1 := types.NodeId("1")
 	// Start Node 0
-	g0, _ := startNode(t, nodes[0], node0, []string{},
+	g0, _ := startNode(t, n, nodes[0], node0, []string{},
 		map[types.NodeId]types.NodeUpdate{
-			node0: types.NodeUpdate{nodes[0], true}})
+			node0: types.NodeUpdate{Addr: nodes[0], QuorumMember: true}})
 
-	time.Sleep(g0.GossipInterval())
+	n.Advance(g0.GossipInterval())
 	selfStatus := g0.GetSelfStatus()
 	if selfStatus != types.NODE_STATUS_UP {
 		t.Error("Expected Node 0 to have status: ", types.NODE_STATUS_UP,
@@ -99,9 +110,9 @@ func TestQuorumNodeLoosesQuorumAndGainsBack(t *testing.T) {
 	// Simulate new node was added by updating the cluster size, but the new node is not talking to node0
 	// Node 0 should loose quorom 1/2
 	g0.UpdateCluster(map[types.NodeId]types.NodeUpdate{
-		node0: types.NodeUpdate{nodes[0], true},
-		node1: types.NodeUpdate{nodes[1], true}})
-	time.Sleep(g0.GossipInterval() * time.Duration(len(nodes)+1))
+		node0: types.NodeUpdate{Addr: nodes[0], QuorumMember: true},
+		node1: types.NodeUpdate{Addr: nodes[1], QuorumMember: true}})
+	n.Advance(g0.GossipInterval() * time.Duration(len(nodes)+1))
 	selfStatus = g0.GetSelfStatus()
 	if selfStatus != types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
 		t.Error("Expected Node 0 to have status: ", types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM,
@@ -109,7 +120,7 @@ func TestQuorumNodeLoosesQuorumAndGainsBack(t *testing.T) {
 	}
 
 	// Sleep for quorum timeout
-	time.Sleep(g0.quorumTimeout + 2*time.Second)
+	n.Advance(g0.quorumTimeout + 2*time.Second)
 
 	selfStatus = g0.GetSelfStatus()
 	if selfStatus != types.NODE_STATUS_NOT_IN_QUORUM {
@@ -118,13 +129,13 @@ func TestQuorumNodeLoosesQuorumAndGainsBack(t *testing.T) {
 	}
 
 	// Lets start the actual Node 1
-	g1, _ := startNode(t, nodes[1], node1, []string{nodes[0]},
+	g1, _ := startNode(t, n, nodes[1], node1, []string{nodes[0]},
 		map[types.NodeId]types.NodeUpdate{
-			node0: types.NodeUpdate{nodes[0], true},
-			node1: types.NodeUpdate{nodes[1], true}})
+			node0: types.NodeUpdate{Addr: nodes[0], QuorumMember: true},
+			node1: types.NodeUpdate{Addr: nodes[1], QuorumMember: true}})
 
 	// Sleep so that nodes gossip
-	time.Sleep(g1.GossipInterval() * time.Duration(len(nodes)+1))
+	n.Advance(g1.GossipInterval() * time.Duration(len(nodes)+1))
 
 	selfStatus = g0.GetSelfStatus()
 	if selfStatus != types.NODE_STATUS_UP {
@@ -141,6 +152,7 @@ func TestQuorumNodeLoosesQuorumAndGainsBack(t *testing.T) {
 func TestQuorumTwoNodesLooseConnectivity(t *testing.T) {
 	printTestInfo()
 
+	n := NewSimNetwork(3)
 	nodes := []string{
 		"127.0.0.1:9904",
 		"127.0.0.2:9905",
@@ -148,11 +160,11 @@ func TestQuorumTwoNodesLooseConnectivity(t *testing.T) {
 
 	node0 := types.NodeId("0")
 	node1 := types.NodeId("1")
-	g0, _ := startNode(t, nodes[0], node0, []string{},
+	g0, _ := startNode(t, n, nodes[0], node0, []string{},
 		map[types.NodeId]types.NodeUpdate{
-			node0: types.NodeUpdate{nodes[0], true}})
+			node0: types.NodeUpdate{Addr: nodes[0], QuorumMember: true}})
 
-	time.Sleep(g0.GossipInterval())
+	n.Advance(g0.GossipInterval())
 	if g0.GetSelfStatus() != types.NODE_STATUS_UP {
 		t.Error("Expected Node 0 to have status: ", types.NODE_STATUS_UP)
 	}
@@ -160,23 +172,23 @@ func TestQuorumTwoNodesLooseConnectivity(t *testing.T) {
 	// Simulate new node was added by updating the cluster size, but the new node is not talking to node0
 	// Node 0 should loose quorom 1/2
 	g0.UpdateCluster(map[types.NodeId]types.NodeUpdate{
-		node0: types.NodeUpdate{nodes[0], true},
-		node1: types.NodeUpdate{nodes[1], true}})
-	time.Sleep(g0.GossipInterval() * time.Duration(len(nodes)+1))
+		node0: types.NodeUpdate{Addr: nodes[0], QuorumMember: true},
+		node1: types.NodeUpdate{Addr: nodes[1], QuorumMember: true}})
+	n.Advance(g0.GossipInterval() * time.Duration(len(nodes)+1))
 	if g0.GetSelfStatus() != types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
 		t.Error("Expected Node 0 to have status: ", types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM)
 	}
 
 	// Lets start the actual node 1. We do not supply node 0 Ip address here so that node 1 does not talk to node 0
 	// to simulate NO connectivity between node 0 and node 1
-	g1, _ := startNode(t, nodes[1], node1, []string{},
+	g1, _ := startNode(t, n, nodes[1], node1, []string{},
 		map[types.NodeId]types.NodeUpdate{
-			node0: types.NodeUpdate{nodes[0], true},
-			node1: types.NodeUpdate{nodes[1], true}})
+			node0: types.NodeUpdate{Addr: nodes[0], QuorumMember: true},
+			node1: types.NodeUpdate{Addr: nodes[1], QuorumMember: true}})
 
 	// For node 0 the status will change from UP_WAITING_QUORUM to WAITING_QUORUM after
 	// the quorum timeout
-	time.Sleep(g0.quorumTimeout + 5*time.Second)
+	n.Advance(g0.quorumTimeout + 5*time.Second)
 
 	if g0.GetSelfStatus() != types.NODE_STATUS_NOT_IN_QUORUM {
 		t.Error("Expected Node 0 to have status: ", types.NODE_STATUS_NOT_IN_QUORUM, " Got: ", g0.GetSelfStatus())
@@ -189,6 +201,7 @@ func TestQuorumTwoNodesLooseConnectivity(t *testing.T) {
 func TestQuorumOneNodeIsolated(t *testing.T) {
 	printTestInfo()
 
+	n := NewSimNetwork(4)
 	nodes := []string{
 		"127.0.0.1:9906",
 		"127.0.0.2:9907",
@@ -201,16 +214,16 @@ func TestQuorumOneNodeIsolated(t *testing.T) {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		var g *GossiperImpl
 		if i == 0 {
-			g, _ = startNode(t, ip, nodeId, []string{}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{}, peers)
 		} else {
-			g, _ = startNode(t, ip, nodeId, []string{nodes[0]}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{nodes[0]}, peers)
 		}
 
 		gossipers = append(gossipers, g)
 	}
 
 	// Lets sleep so that the nodes gossip and update their quorum
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
 
 	for i, g := range gossipers {
 		if g.GetSelfStatus() != types.NODE_STATUS_UP {
@@ -226,7 +239,7 @@ func TestQuorumOneNodeIsolated(t *testing.T) {
 	gossipers[1].Start([]string{})
 
 	// Lets sleep so that the nodes gossip and update their quorum
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
 
 	for i, g := range gossipers {
 		if i == 1 {
@@ -243,6 +256,7 @@ func TestQuorumOneNodeIsolated(t *testing.T) {
 
 func TestQuorumNetworkPartition(t *testing.T) {
 	printTestInfo()
+	n := NewSimNetwork(5)
 	nodes := []string{
 		"127.0.0.1:9909",
 		"127.0.0.2:9910",
@@ -257,23 +271,23 @@ func TestQuorumNetworkPartition(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		var g *GossiperImpl
-		g, _ = startNode(t, nodes[i], nodeId,
+		g, _ = startNode(t, n, nodes[i], nodeId,
 			[]string{nodes[0], nodes[1], nodes[2]},
 			map[types.NodeId]types.NodeUpdate{
-				nodeId: types.NodeUpdate{nodes[i], true}})
+				nodeId: types.NodeUpdate{Addr: nodes[i], QuorumMember: true}})
 		gossipers = append(gossipers, g)
 	}
 	// Parition 2
 	for i := 3; i < 5; i++ {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		var g *GossiperImpl
-		g, _ = startNode(t, nodes[i], nodeId, []string{nodes[3], nodes[4]},
+		g, _ = startNode(t, n, nodes[i], nodeId, []string{nodes[3], nodes[4]},
 			map[types.NodeId]types.NodeUpdate{
-				nodeId: types.NodeUpdate{nodes[i], true}})
+				nodeId: types.NodeUpdate{Addr: nodes[i], QuorumMember: true}})
 		gossipers = append(gossipers, g)
 	}
 	// Let the nodes gossip
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
 	for i, g := range gossipers {
 		if g.GetSelfStatus() != types.NODE_STATUS_UP {
 			t.Error("Expected Node ", i, " status to be ", types.NODE_STATUS_UP, " Got: ", g.GetSelfStatus())
@@ -287,7 +301,7 @@ func TestQuorumNetworkPartition(t *testing.T) {
 	}
 
 	// Let the nodes update their quorum
-	time.Sleep(time.Duration(3) * time.Second)
+	n.Advance(time.Duration(3) * time.Second)
 	// Partition 1
 	for i := 0; i < 3; i++ {
 		if gossipers[i].GetSelfStatus() != types.NODE_STATUS_UP {
@@ -302,7 +316,7 @@ func TestQuorumNetworkPartition(t *testing.T) {
 		}
 	}
 
-	time.Sleep(TestQuorumTimeout)
+	n.Advance(TestQuorumTimeout)
 	// Parition 2
 	for i := 3; i < 5; i++ {
 		if gossipers[i].GetSelfStatus() != types.NODE_STATUS_NOT_IN_QUORUM {
@@ -314,6 +328,7 @@ func TestQuorumNetworkPartition(t *testing.T) {
 func TestQuorumEventHandling(t *testing.T) {
 	printTestInfo()
 
+	n := NewSimNetwork(6)
 	nodes := []string{
 		"127.0.0.1:9914",
 		"127.0.0.2:9915",
@@ -327,14 +342,14 @@ func TestQuorumEventHandling(t *testing.T) {
 	for i := 0; i < len(nodes); i++ {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		var g *GossiperImpl
-		g, _ = startNode(t, nodes[i], nodeId, []string{nodes[0]},
+		g, _ = startNode(t, n, nodes[i], nodeId, []string{nodes[0]},
 			map[types.NodeId]types.NodeUpdate{
-				nodeId: types.NodeUpdate{nodes[0], true}})
+				nodeId: types.NodeUpdate{Addr: nodes[0], QuorumMember: true}})
 		gossipers = append(gossipers, g)
 	}
 
 	// Let the nodes gossip
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
 
 	peers := getNodeUpdateMap(nodes)
 	// Update the cluster size to 5
@@ -342,13 +357,13 @@ func TestQuorumEventHandling(t *testing.T) {
 		gossipers[i].UpdateCluster(peers)
 	}
 
-	time.Sleep(2 * time.Second)
+	n.Advance(2 * time.Second)
 
 	// Bring node 4 down.
 	gossipers[4].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
-	//time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
+	//n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
 
-	time.Sleep(2 * time.Second)
+	n.Advance(2 * time.Second)
 
 	for i := 0; i < len(nodes)-1; i++ {
 		if gossipers[i].GetSelfStatus() != types.NODE_STATUS_UP {
@@ -361,8 +376,8 @@ func TestQuorumEventHandling(t *testing.T) {
 	gossipers[2].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
 	gossipers[1].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
 
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
-	//time.Sleep(types.DEFAULT_GOSSIP_INTERVAL)
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	//n.Advance(types.DEFAULT_GOSSIP_INTERVAL)
 
 	if gossipers[0].GetSelfStatus() != types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
 		t.Error("Expected Node 0 status to be ", types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM, " Got: ", gossipers[0].GetSelfStatus())
@@ -372,7 +387,7 @@ func TestQuorumEventHandling(t *testing.T) {
 	gossipers[2].Start([]string{nodes[0]})
 	gossipers[2].UpdateCluster(peers)
 
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL)
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL)
 
 	// Node 0 still not in quorum. But should be up as quorum timeout not occured yet
 	if gossipers[0].GetSelfStatus() != types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
@@ -382,7 +397,7 @@ func TestQuorumEventHandling(t *testing.T) {
 	}
 
 	// Sleep for quorum timeout to occur
-	time.Sleep(gossipers[0].quorumTimeout + 2*time.Second)
+	n.Advance(gossipers[0].quorumTimeout + 2*time.Second)
 
 	if gossipers[0].GetSelfStatus() != types.NODE_STATUS_NOT_IN_QUORUM {
 		t.Error("Expected Node 0 status to be ", types.NODE_STATUS_NOT_IN_QUORUM,
@@ -393,7 +408,7 @@ func TestQuorumEventHandling(t *testing.T) {
 	gossipers[1].Start([]string{nodes[0]})
 	gossipers[1].UpdateCluster(peers)
 
-	time.Sleep(time.Duration(2) * types.DEFAULT_GOSSIP_INTERVAL)
+	n.Advance(time.Duration(2) * types.DEFAULT_GOSSIP_INTERVAL)
 
 	// Node 0 should now be up
 	if gossipers[0].GetSelfStatus() != types.NODE_STATUS_UP {
@@ -405,6 +420,7 @@ func TestQuorumEventHandling(t *testing.T) {
 func TestQuorumRemoveNodes(t *testing.T) {
 	printTestInfo()
 
+	n := NewSimNetwork(7)
 	nodes := []string{
 		"127.0.0.1:9919",
 		"127.0.0.2:9920",
@@ -418,16 +434,16 @@ func TestQuorumRemoveNodes(t *testing.T) {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		var g *GossiperImpl
 		if i == 0 {
-			g, _ = startNode(t, ip, nodeId, []string{}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{}, peers)
 		} else {
-			g, _ = startNode(t, ip, nodeId, []string{nodes[0]}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{nodes[0]}, peers)
 		}
 
 		gossipers = append(gossipers, g)
 	}
 
 	// Lets sleep so that the nodes gossip and update their quorum
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
 
 	for i, g := range gossipers {
 		if g.GetSelfStatus() != types.NODE_STATUS_UP {
@@ -439,7 +455,7 @@ func TestQuorumRemoveNodes(t *testing.T) {
 	gossipers[3].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
 	gossipers[2].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
 
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
 
 	for i := 0; i < 2; i++ {
 		if gossipers[i].GetSelfStatus() != types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
@@ -453,7 +469,7 @@ func TestQuorumRemoveNodes(t *testing.T) {
 	gossipers[0].UpdateCluster(peers)
 	gossipers[1].UpdateCluster(peers)
 
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL)
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL)
 
 	for i := 0; i < 2; i++ {
 		if gossipers[i].GetSelfStatus() != types.NODE_STATUS_UP {
@@ -464,14 +480,15 @@ func TestQuorumRemoveNodes(t *testing.T) {
 
 func TestQuorumAddNodes(t *testing.T) {
 	printTestInfo()
+	n := NewSimNetwork(8)
 	node0Ip := "127.0.0.1:9923"
 	node0 := types.NodeId("0")
 	peers := make(map[types.NodeId]types.NodeUpdate)
-	peers[node0] = types.NodeUpdate{node0Ip, true}
-	g0, _ := startNode(t, node0Ip, node0, []string{}, peers)
+	peers[node0] = types.NodeUpdate{Addr: node0Ip, QuorumMember: true}
+	g0, _ := startNode(t, n, node0Ip, node0, []string{}, peers)
 
 	// Lets sleep so that the nodes gossip and update their quorum
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(1))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(1))
 
 	if g0.GetSelfStatus() != types.NODE_STATUS_UP {
 		t.Error("Expected Node 0 status to be ", types.NODE_STATUS_UP,
@@ -481,19 +498,19 @@ func TestQuorumAddNodes(t *testing.T) {
 	// Add a new node
 	node1 := types.NodeId("1")
 	node1Ip := "127.0.0.2:9924"
-	peers[node1] = types.NodeUpdate{node1Ip, true}
+	peers[node1] = types.NodeUpdate{Addr: node1Ip, QuorumMember: true}
 	g0.UpdateCluster(peers)
 
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL)
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL)
 	if g0.GetSelfStatus() != types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
 		t.Error("Expected Node 0 status to be ", types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM, " Got: ", g0.GetSelfStatus())
 	}
 
 	// Start the new node
-	startNode(t, node1Ip, node1, []string{node0Ip}, peers)
+	startNode(t, n, node1Ip, node1, []string{node0Ip}, peers)
 
 	// Lets sleep so that the nodes gossip and update their quorum
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(3))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(3))
 
 	if g0.GetSelfStatus() != types.NODE_STATUS_UP {
 		t.Error("Expected Node 0 status to be ", types.NODE_STATUS_UP, " Got: ", g0.GetSelfStatus())
@@ -503,6 +520,7 @@ func TestQuorumAddNodes(t *testing.T) {
 func TestNonQuorumMembersAddRemove(t *testing.T) {
 	printTestInfo()
 
+	n := NewSimNetwork(9)
 	nodes := []string{
 		"127.0.0.1:9925",
 		"127.0.0.2:9926",
@@ -518,15 +536,15 @@ func TestNonQuorumMembersAddRemove(t *testing.T) {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		var g *GossiperImpl
 		if i == 0 {
-			g, _ = startNode(t, ip, nodeId, []string{}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{}, peers)
 		} else {
-			g, _ = startNode(t, ip, nodeId, []string{nodes[0]}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{nodes[0]}, peers)
 		}
 		gossipers = append(gossipers, g)
 	}
 
 	// Lets sleep so that the nodes gossip and update their quorum
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
 
 	for i, g := range gossipers {
 		if g.GetSelfStatus() != types.NODE_STATUS_NOT_IN_QUORUM {
@@ -546,16 +564,16 @@ func TestNonQuorumMembersAddRemove(t *testing.T) {
 	for i, node := range newNodes {
 		quorumMember := i != 0
 		nodeId := types.NodeId(strconv.Itoa(len(peers)))
-		peers[nodeId] = types.NodeUpdate{node, quorumMember}
+		peers[nodeId] = types.NodeUpdate{Addr: node, QuorumMember: quorumMember}
 		for _, g := range gossipers {
 			g.UpdateCluster(peers)
 		}
 
 		// Start the new node
-		newGossiper, _ := startNode(t, node, nodeId, []string{nodes[0]}, peers)
+		newGossiper, _ := startNode(t, n, node, nodeId, []string{nodes[0]}, peers)
 		gossipers = append(gossipers, newGossiper)
 		// Sleep so that the nodes gossip and update their quorum
-		time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(3))
+		n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(3))
 
 		expectedStatus := types.NODE_STATUS_NOT_IN_QUORUM
 		if quorumMember {
@@ -579,7 +597,7 @@ func TestNonQuorumMembersAddRemove(t *testing.T) {
 	for i, _ := range nodes {
 		gossipers[i].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(
 			totalNumNodes))
-		time.Sleep(
+		n.Advance(
 			types.DEFAULT_GOSSIP_INTERVAL * time.Duration(totalNumNodes+1))
 		for j := i + 1; j < totalNumNodes; j++ {
 			if gossipers[j].GetSelfStatus() != types.NODE_STATUS_UP {
@@ -594,7 +612,7 @@ func TestNonQuorumMembersAddRemove(t *testing.T) {
 		for j := i + 1; j < totalNumNodes; j++ {
 			gossipers[j].UpdateCluster(peers)
 		}
-		time.Sleep(
+		n.Advance(
 			types.DEFAULT_GOSSIP_INTERVAL * time.Duration(totalNumNodes+1))
 
 		for j := i + 1; j < totalNumNodes; j++ {
@@ -610,6 +628,7 @@ func TestNonQuorumMembersAddRemove(t *testing.T) {
 func TestMajorityNonQuorumMembersGoDown(t *testing.T) {
 	printTestInfo()
 
+	n := NewSimNetwork(10)
 	nodes := []string{
 		"127.0.0.1:9930",
 		"127.0.0.2:9931",
@@ -628,15 +647,15 @@ func TestMajorityNonQuorumMembersGoDown(t *testing.T) {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		var g *GossiperImpl
 		if i == 0 {
-			g, _ = startNode(t, ip, nodeId, []string{}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{}, peers)
 		} else {
-			g, _ = startNode(t, ip, nodeId, []string{nodes[0]}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{nodes[0]}, peers)
 		}
 		gossipers = append(gossipers, g)
 	}
 
 	// Sleep so that the nodes gossip and update their quorum
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
 
 	for i, g := range gossipers {
 		if g.GetSelfStatus() != types.NODE_STATUS_UP {
@@ -653,7 +672,7 @@ func TestMajorityNonQuorumMembersGoDown(t *testing.T) {
 	gossipers[1].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(
 		len(nodes)))
 
-	time.Sleep(
+	n.Advance(
 		types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
 	if gossipers[2].GetSelfStatus() != types.NODE_STATUS_UP {
 		t.Error("Expected Node 2 status to be ",
@@ -664,6 +683,7 @@ func TestMajorityNonQuorumMembersGoDown(t *testing.T) {
 func TestNonMajorityQuorumMembersGoDown(t *testing.T) {
 	printTestInfo()
 
+	n := NewSimNetwork(11)
 	nodes := []string{
 		"127.0.0.1:9934",
 		"127.0.0.2:9935",
@@ -683,15 +703,15 @@ func TestNonMajorityQuorumMembersGoDown(t *testing.T) {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		var g *GossiperImpl
 		if i == 0 {
-			g, _ = startNode(t, ip, nodeId, []string{}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{}, peers)
 		} else {
-			g, _ = startNode(t, ip, nodeId, []string{nodes[0]}, peers)
+			g, _ = startNode(t, n, ip, nodeId, []string{nodes[0]}, peers)
 		}
 		gossipers = append(gossipers, g)
 	}
 
 	// Sleep so that the nodes gossip and update their quorum
-	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	n.Advance(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
 
 	for i, g := range gossipers {
 		if g.GetSelfStatus() != types.NODE_STATUS_UP {
@@ -706,7 +726,7 @@ func TestNonMajorityQuorumMembersGoDown(t *testing.T) {
 	gossipers[2].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(
 		len(nodes)))
 
-	time.Sleep(
+	n.Advance(
 		types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
 	for i := 0; i < 2; i++ {
 		if gossipers[i].GetSelfStatus() !=
@@ -718,7 +738,7 @@ func TestNonMajorityQuorumMembersGoDown(t *testing.T) {
 	}
 
 	// Sleep for quorum timeout
-	time.Sleep(gossipers[0].quorumTimeout + 2*time.Second)
+	n.Advance(gossipers[0].quorumTimeout + 2*time.Second)
 	for i := 0; i < 2; i++ {
 		if gossipers[i].GetSelfStatus() !=
 			types.NODE_STATUS_NOT_IN_QUORUM {
@@ -728,3 +748,187 @@ func TestNonMajorityQuorumMembersGoDown(t *testing.T) {
 		}
 	}
 }
+
+func newTestGossipDelegate(
+	nodeId types.NodeId,
+	peers map[types.NodeId]types.NodeUpdate,
+	peerConfirmedQuorum bool,
+) *GossipDelegate {
+	gd := new(GossipDelegate)
+	gd.InitGossipDelegate(1, nodeId, types.DEFAULT_GOSSIP_VERSION,
+		TestQuorumTimeout, DEFAULT_CLUSTER_ID)
+	gd.peerConfirmedQuorum = peerConfirmedQuorum
+	gd.updateCluster(peers)
+	return gd
+}
+
+func TestQuorumPeerConfirmedAsymmetricPartition(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9937",
+		"127.0.0.2:9938",
+		"127.0.0.3:9939",
+	}
+	peers := getNodeUpdateMap(nodes)
+	node0 := types.NodeId("0")
+	node1 := types.NodeId("1")
+	node2 := types.NodeId("2")
+
+	for _, peerConfirmed := range []bool{false, true} {
+		g0 := newTestGossipDelegate(node0, peers, peerConfirmed)
+		g1 := newTestGossipDelegate(node1, peers, peerConfirmed)
+		g2 := newTestGossipDelegate(node2, peers, peerConfirmed)
+
+		// Asymmetric link failure: Node 0 can hear Node 1 and Node 2,
+		// but neither of them can hear Node 0.
+		g0.UpdateNodeStatus(node1, types.NODE_STATUS_UP)
+		g0.UpdateNodeStatus(node2, types.NODE_STATUS_UP)
+		g1.UpdateNodeStatus(node2, types.NODE_STATUS_UP)
+		g2.UpdateNodeStatus(node1, types.NODE_STATUS_UP)
+
+		// Gossip the state over the working links
+		g1.updateSelfTs()
+		g2.updateSelfTs()
+		g0.Update(g1.GetLocalState())
+		g0.Update(g2.GetLocalState())
+		g1.Update(g2.GetLocalState())
+		g2.Update(g1.GetLocalState())
+
+		s0, _ := state.GetNotInQuorum(uint(len(nodes)), node0, nil).
+			NodeAlive(g0.getQuorumNodeInfoMap())
+		s1, _ := state.GetNotInQuorum(uint(len(nodes)), node1, nil).
+			NodeAlive(g1.getQuorumNodeInfoMap())
+		s2, _ := state.GetNotInQuorum(uint(len(nodes)), node2, nil).
+			NodeAlive(g2.getQuorumNodeInfoMap())
+
+		expectedStatus := types.NODE_STATUS_UP
+		if peerConfirmed {
+			// Nobody sees Node 0, so it should not consider itself in quorum
+			expectedStatus = types.NODE_STATUS_NOT_IN_QUORUM
+		}
+		if s0.NodeStatus() != expectedStatus {
+			t.Error("PeerConfirmedQuorum: ", peerConfirmed, " Expected Node 0 ",
+				"status to be ", expectedStatus, " Got: ", s0.NodeStatus())
+		}
+		if s1.NodeStatus() != types.NODE_STATUS_UP {
+			t.Error("PeerConfirmedQuorum: ", peerConfirmed, " Expected Node 1 ",
+				"status to be ", types.NODE_STATUS_UP, " Got: ", s1.NodeStatus())
+		}
+		if s2.NodeStatus() != types.NODE_STATUS_UP {
+			t.Error("PeerConfirmedQuorum: ", peerConfirmed, " Expected Node 2 ",
+				"status to be ", types.NODE_STATUS_UP, " Got: ", s2.NodeStatus())
+		}
+	}
+}
+
+func TestQuorumPeerConfirmedLinkFailure(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9940",
+		"127.0.0.2:9941",
+		"127.0.0.3:9942",
+	}
+	peers := getNodeUpdateMap(nodes)
+	node0 := types.NodeId("0")
+	node1 := types.NodeId("1")
+	node2 := types.NodeId("2")
+
+	g0 := newTestGossipDelegate(node0, peers, true)
+	g1 := newTestGossipDelegate(node1, peers, true)
+	g2 := newTestGossipDelegate(node2, peers, true)
+	g0.InitCurrentState(uint(len(nodes)))
+
+	// All the nodes see each other
+	for _, g := range []*GossipDelegate{g0, g1, g2} {
+		for id := range peers {
+			if id != g.NodeId() {
+				g.UpdateNodeStatus(id, types.NODE_STATUS_UP)
+			}
+		}
+	}
+	g0.MergeRemoteState(g1.LocalState(false), false)
+	g0.MergeRemoteState(g2.LocalState(false), false)
+	time.Sleep(100 * time.Millisecond)
+
+	if g0.GetSelfStatus() != types.NODE_STATUS_UP {
+		t.Error("Expected Node 0 to have status: ", types.NODE_STATUS_UP,
+			" Got: ", g0.GetSelfStatus())
+	}
+
+	// The links from Node 0 to Node 1 and Node 2 fail in one direction.
+	// Node 0 can still hear the other nodes.
+	g1.UpdateNodeStatus(node0, types.NODE_STATUS_DOWN)
+	g2.UpdateNodeStatus(node0, types.NODE_STATUS_DOWN)
+	g0.MergeRemoteState(g1.LocalState(false), false)
+	g0.MergeRemoteState(g2.LocalState(false), false)
+	time.Sleep(100 * time.Millisecond)
+
+	if g0.GetSelfStatus() != types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
+		t.Error("Expected Node 0 to have status: ",
+			types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM,
+			" Got: ", g0.GetSelfStatus())
+	}
+
+	// Links are restored
+	g1.UpdateNodeStatus(node0, types.NODE_STATUS_UP)
+	g0.MergeRemoteState(g1.LocalState(false), false)
+	time.Sleep(100 * time.Millisecond)
+
+	if g0.GetSelfStatus() != types.NODE_STATUS_UP {
+		t.Error("Expected Node 0 to have status: ", types.NODE_STATUS_UP,
+			" Got: ", g0.GetSelfStatus())
+	}
+}
+
+func TestQuorumMaintenancePolicy(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9943",
+		"127.0.0.2:9944",
+		"127.0.0.3:9945",
+	}
+	peers := getNodeUpdateMap(nodes)
+	node0 := types.NodeId("0")
+	node1 := types.NodeId("1")
+	node2 := types.NodeId("2")
+
+	for _, policy := range []types.MaintenanceQuorumPolicy{
+		types.MAINTENANCE_QUORUM_POLICY_COUNT,
+		types.MAINTENANCE_QUORUM_POLICY_EXCLUDE,
+	} {
+		g0 := newTestGossipDelegate(node0, peers, false)
+		g0.maintenanceQuorumPolicy = policy
+		g2 := newTestGossipDelegate(node2, peers, false)
+
+		// Node 2 goes in maintenance and Node 1 is down
+		g0.UpdateNodeStatus(node2, types.NODE_STATUS_UP)
+		g2.updateSelfMaintenance(true)
+		g0.Update(g2.GetLocalState())
+
+		s0, _ := state.GetNotInQuorum(uint(len(nodes)), node0, nil).
+			UpdateClusterSize(g0.getQuorumView())
+		expectedStatus := types.NODE_STATUS_UP
+		if policy == types.MAINTENANCE_QUORUM_POLICY_EXCLUDE {
+			// Node 2 does not participate in quorum, Node 0 alone
+			// is not a majority amongst Node 0 and Node 1
+			expectedStatus = types.NODE_STATUS_NOT_IN_QUORUM
+		}
+		if s0.NodeStatus() != expectedStatus {
+			t.Error("Policy: ", policy, " Expected Node 0 status to be ",
+				expectedStatus, " Got: ", s0.NodeStatus())
+		}
+
+		// Node 1 comes up and Node 2 leaves
+		g0.UpdateNodeStatus(node1, types.NODE_STATUS_UP)
+		g0.UpdateNodeStatus(node2, types.NODE_STATUS_DOWN)
+		s0, _ = state.GetNotInQuorum(uint(len(nodes)), node0, nil).
+			UpdateClusterSize(g0.getQuorumView())
+		if s0.NodeStatus() != types.NODE_STATUS_UP {
+			t.Error("Policy: ", policy, " Expected Node 0 status to be ",
+				types.NODE_STATUS_UP, " Got: ", s0.NodeStatus())
+		}
+	}
+}
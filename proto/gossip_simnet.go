@@ -0,0 +1,717 @@
+package proto
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	ml "github.com/hashicorp/memberlist"
+	"github.com/libopenstorage/gossip/types"
+)
+
+const (
+	// simPacketSize and simPacketOverhead bound the user messages
+	// piggybacked on a gossip packet like memberlist's UDP packets
+	simPacketSize     = 1400
+	simPacketOverhead = 2
+)
+
+// simEpoch is the virtual time at which a simulated network starts
+var simEpoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// SimNetwork is an in-process network on which gossipers run without
+// binding any port. It replaces memberlist with a simplified model of
+// its gossip, push/pull and failure detection, driven by a virtual time
+// which only moves with Advance. All the randomness comes from the seed
+// so that a test replays the same way every time.
+//
+// Links can be blocked to partition the network. Packets, which carry
+// the broadcasts and the probes, can be dropped and delayed. Push/pull
+// exchanges run over reliable connections and only fail on blocked links.
+// Each node detects failures with its own direct and indirect probes
+// and gossips the nodes it declares dead to the others. A node declared
+// dead is declared alive again by the first probe which reaches it.
+type SimNetwork struct {
+	lock     sync.Mutex
+	rand     *rand.Rand
+	clock    *ManualClock
+	nodes    map[string]*simMemberList
+	blocked  map[simLink]bool
+	delays   map[simLink]time.Duration
+	delay    time.Duration
+	dropRate float64
+	packets  []*simPacket
+	seq      uint64
+}
+
+type simLink struct {
+	from string
+	to   string
+}
+
+// simPacket is a user message or a dead notice in flight
+type simPacket struct {
+	deliverAt time.Time
+	seq       uint64
+	to        string
+	msg       []byte
+	// dead is the name of the node declared dead by a dead notice
+	dead string
+}
+
+// simNotice is a dead notice queued for gossip
+type simNotice struct {
+	name      string
+	transmits int
+}
+
+// simMember is a member as seen by another member
+type simMember struct {
+	node         *ml.Node
+	alive        bool
+	suspect      bool
+	suspectSince time.Time
+}
+
+// simMemberList is the membership layer of a gossiper on a
+// simulated network
+type simMemberList struct {
+	net     *SimNetwork
+	g       *GossiperImpl
+	conf    *ml.Config
+	addr    string
+	self    *ml.Node
+	members map[string]*simMember
+	// virtual times of the next gossip, push/pull and probe
+	nextGossip   time.Time
+	nextPushPull time.Time
+	nextProbe    time.Time
+	probeIndex   int
+	left         bool
+	// dead notices still to be gossiped
+	notices []*simNotice
+}
+
+// NewSimNetwork returns an empty simulated network whose randomness
+// is seeded with the seed
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		rand:    rand.New(rand.NewSource(seed)),
+		clock:   NewManualClock(simEpoch),
+		nodes:   make(map[string]*simMemberList),
+		blocked: make(map[simLink]bool),
+		delays:  make(map[simLink]time.Duration),
+	}
+}
+
+// NewGossiper returns a gossiper which runs on the simulated network
+// once started. The ipPort is its address on the network. The gossiper
+// uses the network's virtual clock unless the options set a clock.
+func (n *SimNetwork) NewGossiper(
+	ipPort string,
+	selfNodeId types.NodeId,
+	genNumber uint64,
+	gossipIntervals types.GossipIntervals,
+	gossipVersion string,
+	clusterId string,
+	options types.GossipOptions,
+) (*GossiperImpl, error) {
+	if options.Clock == nil {
+		options.Clock = n.clock
+	}
+	g := new(GossiperImpl)
+	g.newMemberList = func(conf *ml.Config) (memberList, error) {
+		return n.newMemberList(g, conf)
+	}
+	err := g.InitWithOptions(ipPort, selfNodeId, genNumber, gossipIntervals,
+		gossipVersion, clusterId, options)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Now returns the virtual time of the network
+func (n *SimNetwork) Now() time.Time {
+	return n.clock.Now()
+}
+
+// Partition blocks the links between the addresses of different groups.
+// Links of addresses which are not in any group are left as is.
+func (n *SimNetwork) Partition(groups ...[]string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for i, group := range groups {
+		for j, other := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range group {
+				for _, to := range other {
+					n.blocked[simLink{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+// BlockLink blocks the traffic from one address to another
+func (n *SimNetwork) BlockLink(from, to string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.blocked[simLink{from, to}] = true
+}
+
+// UnblockLink unblocks the traffic from one address to another
+func (n *SimNetwork) UnblockLink(from, to string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.blocked, simLink{from, to})
+}
+
+// Heal unblocks all the links
+func (n *SimNetwork) Heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.blocked = make(map[simLink]bool)
+}
+
+// SetDropRate sets the probability with which a packet is dropped
+func (n *SimNetwork) SetDropRate(rate float64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.dropRate = rate
+}
+
+// SetDelay sets the delay of the packets on all the links which do
+// not have their own delay
+func (n *SimNetwork) SetDelay(delay time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.delay = delay
+}
+
+// SetLinkDelay sets the delay of the packets from one address to another
+func (n *SimNetwork) SetLinkDelay(from, to string, delay time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.delays[simLink{from, to}] = delay
+}
+
+// Advance moves the virtual time forward by d. The gossip, push/pull
+// and probe rounds, the packet deliveries and the calls scheduled on
+// the clock, like the quorum timeouts, which fall in this period run
+// in order. The state events they cause are handled before the next
+// one runs.
+func (n *SimNetwork) Advance(d time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	end := n.clock.Now().Add(d)
+	for {
+		at, step := n.nextStep()
+		if deadline, ok := n.clock.nextDeadline(); ok &&
+			!deadline.After(end) && (step == nil || deadline.Before(at)) {
+			n.clock.fireNext(deadline)
+			n.flushStateEvents()
+			continue
+		}
+		if step == nil || at.After(end) {
+			break
+		}
+		n.clock.advanceTo(at)
+		step()
+		n.flushStateEvents()
+	}
+	n.clock.advanceTo(end)
+	n.flushStateEvents()
+}
+
+// nextStep returns the earliest pending step. Packets are delivered
+// before the rounds due at the same time and nodes run in the order
+// of their addresses.
+func (n *SimNetwork) nextStep() (time.Time, func()) {
+	var at time.Time
+	var step func()
+	if len(n.packets) != 0 {
+		p := n.packets[0]
+		at = p.deliverAt
+		step = func() {
+			n.packets = n.packets[1:]
+			n.deliver(p)
+		}
+	}
+	for _, addr := range n.addrs() {
+		m := n.nodes[addr]
+		if m.left {
+			continue
+		}
+		rounds := []struct {
+			at  time.Time
+			run func()
+		}{
+			{m.nextGossip, m.gossipRound},
+			{m.nextPushPull, m.pushPullRound},
+			{m.nextProbe, m.probeRound},
+		}
+		for _, r := range rounds {
+			if step == nil || r.at.Before(at) {
+				at, step = r.at, r.run
+			}
+		}
+	}
+	return at, step
+}
+
+func (n *SimNetwork) addrs() []string {
+	addrs := make([]string, 0, len(n.nodes))
+	for addr := range n.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// flushStateEvents waits until all the gossipers have handled
+// their state events
+func (n *SimNetwork) flushStateEvents() {
+	for _, addr := range n.addrs() {
+		n.nodes[addr].g.flushStateEvents()
+	}
+}
+
+// connected returns true if a packet can go from one member to the other
+func (n *SimNetwork) connected(from, to *simMemberList) bool {
+	if to.left || n.nodes[to.addr] != to {
+		return false
+	}
+	return !n.blocked[simLink{from.addr, to.addr}]
+}
+
+func (n *SimNetwork) linkDelay(from, to string) time.Duration {
+	if delay, ok := n.delays[simLink{from, to}]; ok {
+		return delay
+	}
+	return n.delay
+}
+
+func (n *SimNetwork) dropped() bool {
+	return n.dropRate > 0 && n.rand.Float64() < n.dropRate
+}
+
+// send sends a packet. It is delivered after the link's delay unless
+// it is dropped.
+func (n *SimNetwork) send(from, to *simMemberList, p *simPacket) {
+	if !n.connected(from, to) || n.dropped() {
+		return
+	}
+	n.seq++
+	p.deliverAt = n.clock.Now().Add(n.linkDelay(from.addr, to.addr))
+	p.seq = n.seq
+	p.to = to.addr
+	n.packets = append(n.packets, p)
+	sort.Slice(n.packets, func(i, j int) bool {
+		if n.packets[i].deliverAt.Equal(n.packets[j].deliverAt) {
+			return n.packets[i].seq < n.packets[j].seq
+		}
+		return n.packets[i].deliverAt.Before(n.packets[j].deliverAt)
+	})
+}
+
+func (n *SimNetwork) deliver(p *simPacket) {
+	to, ok := n.nodes[p.to]
+	if !ok || to.left {
+		return
+	}
+	if p.dead != "" {
+		to.declareDead(p.dead)
+		return
+	}
+	to.conf.Delegate.NotifyMsg(p.msg)
+}
+
+// probe returns the round trip time of a probe from one member to the
+// other. It fails if a link is blocked, a packet is dropped or the
+// round trip takes longer than the probe timeout.
+func (n *SimNetwork) probe(
+	from, to *simMemberList,
+	timeout time.Duration,
+) (time.Duration, bool) {
+	if !n.connected(from, to) || !n.connected(to, from) ||
+		n.dropped() || n.dropped() {
+		return 0, false
+	}
+	rtt := n.linkDelay(from.addr, to.addr) + n.linkDelay(to.addr, from.addr)
+	return rtt, rtt <= timeout
+}
+
+func (n *SimNetwork) newMemberList(
+	g *GossiperImpl,
+	conf *ml.Config,
+) (memberList, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	addr := net.JoinHostPort(conf.BindAddr, strconv.Itoa(conf.BindPort))
+	if _, ok := n.nodes[addr]; ok {
+		return nil, fmt.Errorf("gossip: Address %v is already in use", addr)
+	}
+	m := &simMemberList{
+		net:     n,
+		g:       g,
+		conf:    conf,
+		addr:    addr,
+		members: make(map[string]*simMember),
+		self: &ml.Node{
+			Name: conf.Name,
+			Addr: net.ParseIP(conf.BindAddr),
+			Port: uint16(conf.BindPort),
+			Meta: conf.Delegate.NodeMeta(ml.MetaMaxSize),
+			PMin: ml.ProtocolVersionMin,
+			PMax: ml.ProtocolVersionMax,
+			PCur: conf.ProtocolVersion,
+			DCur: conf.DelegateProtocolVersion,
+		},
+	}
+	// Spread the rounds of the nodes like memberlist does
+	m.nextGossip = n.clock.Now().Add(n.stagger(conf.GossipInterval))
+	m.nextPushPull = n.clock.Now().Add(n.stagger(conf.PushPullInterval))
+	m.nextProbe = n.clock.Now().Add(n.stagger(conf.ProbeInterval))
+	n.nodes[addr] = m
+
+	if conf.Alive != nil {
+		conf.Alive.NotifyAlive(m.self)
+	}
+	conf.Events.NotifyJoin(m.self)
+	g.flushStateEvents()
+	return m, nil
+}
+
+func (n *SimNetwork) stagger(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	return time.Duration(n.rand.Int63n(int64(interval)))
+}
+
+// aliveNodes returns ourself and the members we see alive
+func (m *simMemberList) aliveNodes() []*ml.Node {
+	nodes := []*ml.Node{m.self}
+	for _, name := range m.memberNames() {
+		if member := m.members[name]; member.alive {
+			nodes = append(nodes, member.node)
+		}
+	}
+	return nodes
+}
+
+func (m *simMemberList) memberNames() []string {
+	names := make([]string, 0, len(m.members))
+	for name := range m.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// peer returns the member list of a node we see alive
+func (m *simMemberList) peer(node *ml.Node) *simMemberList {
+	addr := net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port)))
+	peer, ok := m.net.nodes[addr]
+	if !ok || peer.self.Name != node.Name {
+		return nil
+	}
+	return peer
+}
+
+// randomPeers returns up to count random members we see alive
+func (m *simMemberList) randomPeers(count int) []*simMemberList {
+	var peers []*simMemberList
+	for _, node := range m.aliveNodes()[1:] {
+		if peer := m.peer(node); peer != nil {
+			peers = append(peers, peer)
+		}
+	}
+	m.net.rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > count {
+		peers = peers[:count]
+	}
+	return peers
+}
+
+// markAlive marks the node alive unless the alive delegate rejects it
+func (m *simMemberList) markAlive(node *ml.Node) {
+	if node.Name == m.self.Name {
+		return
+	}
+	member, ok := m.members[node.Name]
+	if ok && member.alive {
+		member.suspect = false
+		return
+	}
+	if m.conf.Alive != nil {
+		if err := m.conf.Alive.NotifyAlive(node); err != nil {
+			return
+		}
+	}
+	m.members[node.Name] = &simMember{node: node, alive: true}
+	m.conf.Events.NotifyJoin(node)
+}
+
+// markDead marks the node dead
+func (m *simMemberList) markDead(name string) {
+	member, ok := m.members[name]
+	if !ok || !member.alive {
+		return
+	}
+	member.alive = false
+	member.suspect = false
+	m.conf.Events.NotifyLeave(member.node)
+}
+
+// declareDead marks the node dead and gossips it to the others. Like
+// memberlist, a node applying a dead notice gossips it further.
+func (m *simMemberList) declareDead(name string) {
+	member, ok := m.members[name]
+	if !ok || !member.alive {
+		return
+	}
+	m.markDead(name)
+	m.notices = append(m.notices, &simNotice{
+		name:      name,
+		transmits: m.conf.RetransmitMult * m.scale(),
+	})
+}
+
+// learn handles the alive nodes of a peer. Like memberlist, the alive
+// delegate sees all of them, but only the nodes we have never seen
+// become members. The nodes we declared dead are only declared alive
+// again by our own probes.
+func (m *simMemberList) learn(nodes []*ml.Node) {
+	for _, node := range nodes {
+		if m.conf.Alive != nil {
+			if err := m.conf.Alive.NotifyAlive(node); err != nil {
+				continue
+			}
+		}
+		if _, ok := m.members[node.Name]; ok || node.Name == m.self.Name {
+			continue
+		}
+		m.members[node.Name] = &simMember{node: node, alive: true}
+		m.conf.Events.NotifyJoin(node)
+	}
+}
+
+// pushPull exchanges the membership and the local states of two nodes.
+// On a join both nodes first check the other's members with their
+// merge delegate.
+func (m *simMemberList) pushPull(peer *simMemberList, join bool) error {
+	localNodes, peerNodes := m.aliveNodes(), peer.aliveNodes()
+	if join && m.conf.Merge != nil {
+		if err := m.conf.Merge.NotifyMerge(peerNodes); err != nil {
+			return err
+		}
+	}
+	if join && peer.conf.Merge != nil {
+		if err := peer.conf.Merge.NotifyMerge(localNodes); err != nil {
+			return err
+		}
+	}
+	localState := m.conf.Delegate.LocalState(join)
+	peerState := peer.conf.Delegate.LocalState(join)
+	// Like memberlist an empty user state is not merged
+	peer.learn(localNodes)
+	if len(localState) != 0 {
+		peer.conf.Delegate.MergeRemoteState(localState, join)
+	}
+	m.learn(peerNodes)
+	if len(peerState) != 0 {
+		m.conf.Delegate.MergeRemoteState(peerState, join)
+	}
+	return nil
+}
+
+// gossipRound sends the queued user messages and dead notices to random
+// members and declares dead the suspects whose suspicion timed out
+func (m *simMemberList) gossipRound() {
+	m.nextGossip = m.net.clock.Now().Add(m.conf.GossipInterval)
+	timeout := m.suspicionTimeout()
+	for _, name := range m.memberNames() {
+		member := m.members[name]
+		if member.suspect &&
+			!m.net.clock.Now().Before(member.suspectSince.Add(timeout)) {
+			m.declareDead(name)
+		}
+	}
+	msgs := m.conf.Delegate.GetBroadcasts(simPacketOverhead, simPacketSize)
+	notices := m.notices
+	m.notices = nil
+	for _, notice := range notices {
+		if notice.transmits--; notice.transmits > 0 {
+			m.notices = append(m.notices, notice)
+		}
+	}
+	if len(msgs) == 0 && len(notices) == 0 {
+		return
+	}
+	for _, peer := range m.randomPeers(m.conf.GossipNodes) {
+		for _, notice := range notices {
+			m.net.send(m, peer, &simPacket{dead: notice.name})
+		}
+		for _, msg := range msgs {
+			m.net.send(m, peer, &simPacket{msg: msg})
+		}
+	}
+}
+
+// scale is memberlist's factor for the cluster size applied to the
+// suspicion timeout and the retransmits
+func (m *simMemberList) scale() int {
+	return int(math.Ceil(math.Log10(float64(len(m.aliveNodes()) + 1))))
+}
+
+func (m *simMemberList) suspicionTimeout() time.Duration {
+	return time.Duration(m.conf.SuspicionMult) * time.Duration(m.scale()) *
+		m.conf.ProbeInterval
+}
+
+// pushPullRound exchanges the state with a random member
+func (m *simMemberList) pushPullRound() {
+	m.nextPushPull = m.net.clock.Now().Add(m.conf.PushPullInterval)
+	for _, peer := range m.randomPeers(1) {
+		if m.net.connected(m, peer) && m.net.connected(peer, m) {
+			m.pushPull(peer, false)
+		}
+	}
+}
+
+// probeRound probes the next member, directly and then through other
+// members. Members which do not respond become suspects. Dead members
+// are probed as well and declared alive again when they respond.
+func (m *simMemberList) probeRound() {
+	m.nextProbe = m.net.clock.Now().Add(m.conf.ProbeInterval)
+	names := m.memberNames()
+	if len(names) == 0 {
+		return
+	}
+	m.probeIndex = (m.probeIndex + 1) % len(names)
+	member := m.members[names[m.probeIndex]]
+	target := m.peer(member.node)
+	if target != nil && m.probeMember(target) {
+		m.markAlive(target.self)
+		return
+	}
+	if member.alive && !member.suspect {
+		member.suspect = true
+		member.suspectSince = m.net.clock.Now()
+	}
+}
+
+// probeMember returns true if the member responds to a direct probe or
+// to an indirect probe through one of our other members
+func (m *simMemberList) probeMember(target *simMemberList) bool {
+	if _, ok := m.net.probe(m, target, m.conf.ProbeTimeout); ok {
+		return true
+	}
+	for _, peer := range m.randomPeers(m.conf.IndirectChecks + 1) {
+		if peer == target {
+			continue
+		}
+		if _, ok := m.net.probe(m, peer, m.conf.ProbeTimeout); !ok {
+			continue
+		}
+		if _, ok := m.net.probe(peer, target, m.conf.ProbeTimeout); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *simMemberList) Members() []*ml.Node {
+	m.net.lock.Lock()
+	defer m.net.lock.Unlock()
+	return m.aliveNodes()
+}
+
+func (m *simMemberList) Join(existing []string) (int, error) {
+	m.net.lock.Lock()
+	defer m.net.lock.Unlock()
+	defer m.net.flushStateEvents()
+	joined := 0
+	var err error
+	for _, addr := range existing {
+		peer, ok := m.net.nodes[addr]
+		if !ok || !m.net.connected(m, peer) || !m.net.connected(peer, m) {
+			err = fmt.Errorf("gossip: Unable to connect to %v", addr)
+			continue
+		}
+		if peer == m {
+			continue
+		}
+		if pushPullErr := m.pushPull(peer, true); pushPullErr != nil {
+			err = pushPullErr
+			continue
+		}
+		joined++
+	}
+	if joined == 0 && err != nil {
+		return 0, err
+	}
+	return joined, nil
+}
+
+// Leave notifies the members we can reach that we are leaving
+func (m *simMemberList) Leave(timeout time.Duration) error {
+	m.net.lock.Lock()
+	defer m.net.lock.Unlock()
+	defer m.net.flushStateEvents()
+	for _, node := range m.aliveNodes()[1:] {
+		if peer := m.peer(node); peer != nil && m.net.connected(m, peer) {
+			peer.markDead(m.self.Name)
+		}
+	}
+	m.left = true
+	m.conf.Events.NotifyLeave(m.self)
+	return nil
+}
+
+// Shutdown removes us from the network
+func (m *simMemberList) Shutdown() error {
+	m.net.lock.Lock()
+	defer m.net.lock.Unlock()
+	m.left = true
+	if m.net.nodes[m.addr] == m {
+		delete(m.net.nodes, m.addr)
+	}
+	return nil
+}
+
+// SendToUDP sends a user message to a member as a packet
+func (m *simMemberList) SendToUDP(to *ml.Node, msg []byte) error {
+	m.net.lock.Lock()
+	defer m.net.lock.Unlock()
+	peer := m.peer(to)
+	if peer == nil {
+		return fmt.Errorf("gossip: Unknown node %v", to.Name)
+	}
+	m.net.send(m, peer, &simPacket{msg: append([]byte{}, msg...)})
+	return nil
+}
+
+func (m *simMemberList) Ping(name string, addr net.Addr) (time.Duration, error) {
+	m.net.lock.Lock()
+	defer m.net.lock.Unlock()
+	if member, ok := m.members[name]; ok {
+		if target := m.peer(member.node); target != nil {
+			if rtt, ok := m.net.probe(m, target, m.conf.ProbeTimeout); ok {
+				return rtt, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("gossip: No response from node %v", name)
+}
@@ -0,0 +1,153 @@
+package proto
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+var simIntervals = types.GossipIntervals{
+	GossipInterval:   200 * time.Millisecond,
+	PushPullInterval: 1 * time.Second,
+	ProbeInterval:    1 * time.Second,
+	ProbeTimeout:     200 * time.Millisecond,
+	QuorumTimeout:    TestQuorumTimeout,
+}
+
+// startSimNodes starts a gossiper per address on the network. All the
+// nodes join the first one and are quorum members.
+func startSimNodes(
+	t *testing.T,
+	n *SimNetwork,
+	nodes []string,
+) []*GossiperImpl {
+	peers := getNodeUpdateMap(nodes)
+	var gossipers []*GossiperImpl
+	for i, addr := range nodes {
+		g, err := n.NewGossiper(addr, types.NodeId(strconv.Itoa(i)), 1,
+			simIntervals, types.DEFAULT_GOSSIP_VERSION, DEFAULT_CLUSTER_ID,
+			types.GossipOptions{})
+		if err != nil {
+			t.Fatal("Error in creating gossiper: ", err)
+		}
+		var knownIps []string
+		if i != 0 {
+			knownIps = []string{nodes[0]}
+		}
+		if err := g.Start(knownIps); err != nil {
+			t.Fatal("Error in starting gossiper: ", err)
+		}
+		g.UpdateCluster(peers)
+		gossipers = append(gossipers, g)
+	}
+	return gossipers
+}
+
+func checkSimStatus(
+	t *testing.T,
+	gossipers []*GossiperImpl,
+	expected types.NodeStatus,
+) {
+	for i, g := range gossipers {
+		if status := g.GetSelfStatus(); status != expected {
+			t.Error("Expected node ", i, " status to be ", expected,
+				" got: ", status)
+		}
+	}
+}
+
+func TestSimNetworkPartition(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"10.0.0.1:9000",
+		"10.0.0.2:9000",
+		"10.0.0.3:9000",
+		"10.0.0.4:9000",
+		"10.0.0.5:9000",
+	}
+	n := NewSimNetwork(1)
+	gossipers := startSimNodes(t, n, nodes)
+	n.Advance(10 * time.Second)
+	checkSimStatus(t, gossipers, types.NODE_STATUS_UP)
+	for i, g := range gossipers {
+		if members := g.GetNodes(); len(members) != len(nodes) {
+			t.Error("Expected node ", i, " to see ", len(nodes),
+				" members, got: ", members)
+		}
+	}
+
+	// The minority loses quorum once it declares the majority dead
+	n.Partition(nodes[:3], nodes[3:])
+	n.Advance(30 * time.Second)
+	checkSimStatus(t, gossipers[:3], types.NODE_STATUS_UP)
+	checkSimStatus(t, gossipers[3:], types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM)
+	nodeInfo, _ := gossipers[0].GetLocalNodeInfo(types.NodeId("4"))
+	if nodeInfo.Status != types.NODE_STATUS_DOWN {
+		t.Error("Expected node 4 to be down on node 0, got: ", nodeInfo.Status)
+	}
+
+	// The quorum timeout runs on the network's virtual clock
+	n.Advance(TestQuorumTimeout)
+	checkSimStatus(t, gossipers[3:], types.NODE_STATUS_NOT_IN_QUORUM)
+
+	n.Heal()
+	n.Advance(30 * time.Second)
+	checkSimStatus(t, gossipers, types.NODE_STATUS_UP)
+
+	for _, g := range gossipers {
+		g.Stop(time.Second)
+	}
+	if len(n.nodes) != 0 {
+		t.Error("Expected all the nodes to have left the network")
+	}
+}
+
+func TestSimNetworkLossyLinks(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"10.0.0.1:9000",
+		"10.0.0.2:9000",
+		"10.0.0.3:9000",
+	}
+	n := NewSimNetwork(2)
+	gossipers := startSimNodes(t, n, nodes)
+	n.Advance(5 * time.Second)
+	checkSimStatus(t, gossipers, types.NODE_STATUS_UP)
+
+	// Indirect probes keep a node alive behind a slow link and
+	// occasional packet loss
+	n.SetLinkDelay(nodes[0], nodes[2], time.Second)
+	n.SetDropRate(0.05)
+	gossipers[2].UpdateSelf("key", "value")
+	n.Advance(30 * time.Second)
+	checkSimStatus(t, gossipers, types.NODE_STATUS_UP)
+	values := gossipers[0].GetStoreKeyValue("key")
+	if values[types.NodeId("2")].Value != "value" {
+		t.Error("Expected the value of node 2 on node 0, got: ", values)
+	}
+	if _, err := gossipers[0].mlist.Ping("2"+types.DEFAULT_GOSSIP_VERSION,
+		nil); err == nil {
+		t.Error("Expected a direct ping over the slow link to fail")
+	}
+
+	// A blocked link in one direction makes direct probes fail
+	n.SetDropRate(0)
+	n.BlockLink(nodes[1], nodes[0])
+	if _, err := gossipers[0].mlist.Ping("1"+types.DEFAULT_GOSSIP_VERSION,
+		nil); err == nil {
+		t.Error("Expected a ping over a blocked link to fail")
+	}
+	n.UnblockLink(nodes[1], nodes[0])
+	if _, err := gossipers[0].mlist.Ping("1"+types.DEFAULT_GOSSIP_VERSION,
+		nil); err != nil {
+		t.Error("Expected a ping to succeed once unblocked: ", err)
+	}
+
+	for _, g := range gossipers {
+		g.Stop(time.Second)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/libopenstorage/gossip/types"
 )
 
@@ -33,6 +32,24 @@ type GossipStoreImpl struct {
 	numQuorumMembers uint
 	// Ts at which we lost quorum
 	lostQuorumTs time.Time
+	// auth signs our state and identity and verifies the ones of the peers
+	auth *nodeAuthenticator
+	// number of forged node infos which were rejected
+	forgedUpdates uint64
+	// callbacks watching the namespaces
+	namespaceWatches map[string][]types.NamespaceWatchCb
+	// limits on the size of our state
+	limits storeLimits
+	// metrics emitted by the store
+	metrics *gossipMetrics
+	// logger of the components
+	logger *gossipLogger
+	// clock of the update timestamps
+	clock types.Clock
+	// last time we were up to date with the info of each node
+	receivedTs map[types.NodeId]time.Time
+	// sorted keys of the nodes for the lookups
+	keyIndex map[types.NodeId]sortedKeys
 }
 
 func NewGossipStore(id types.NodeId, version, clusterId string) *GossipStoreImpl {
@@ -50,7 +67,7 @@ func (s *GossipStoreImpl) UpdateLostQuorumTs() {
 	s.Lock()
 	defer s.Unlock()
 
-	s.lostQuorumTs = time.Now()
+	s.lostQuorumTs = s.clock.Now()
 }
 
 func (s *GossipStoreImpl) GetLostQuorumTs() time.Time {
@@ -64,37 +81,111 @@ func (s *GossipStoreImpl) InitStore(
 	clusterId string,
 ) {
 	s.nodeMap = make(types.NodeInfoMap)
+	s.receivedTs = make(map[types.NodeId]time.Time)
 	s.id = id
 	s.selfCorrect = true
 	s.GossipVersion = version
 	s.ClusterId = clusterId
+	s.auth, _ = newNodeAuthenticator(nil, nil)
+	if s.clock == nil {
+		s.clock = systemClock{}
+	}
 	nodeInfo := types.NodeInfo{
 		Id:           s.id,
 		GenNumber:    s.GenNumber,
 		Value:        make(types.StoreMap),
-		LastUpdateTs: time.Now(),
+		LastUpdateTs: s.clock.Now(),
 		Status:       status,
 	}
 	s.nodeMap[s.id] = nodeInfo
 }
 
+// log returns the logger of the component
+func (s *GossipStoreImpl) log(component types.LogComponent) types.Logger {
+	return s.logger.component(component)
+}
+
+// updateTs returns the timestamp of a new update of a node info. It is
+// after the previous one even if the clock did not move, so that the
+// peers always merge the update.
+func (s *GossipStoreImpl) updateTs(previous time.Time) time.Time {
+	now := s.clock.Now()
+	if !now.After(previous) {
+		now = previous.Add(time.Nanosecond)
+	}
+	return now
+}
+
 func (s *GossipStoreImpl) updateSelfTs() {
 	s.Lock()
 	defer s.Unlock()
 
 	nodeInfo, _ := s.nodeMap[s.id]
-	nodeInfo.LastUpdateTs = time.Now()
+	nodeInfo.LastUpdateTs = s.updateTs(nodeInfo.LastUpdateTs)
 	s.nodeMap[s.id] = nodeInfo
 }
 
-func (s *GossipStoreImpl) UpdateSelf(key types.StoreKey, val interface{}) {
+func (s *GossipStoreImpl) UpdateSelf(key types.StoreKey, val interface{}) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.updateSelfValues(types.StoreMap{key: val})
+}
 
-	nodeInfo, _ := s.nodeMap[s.id]
-	nodeInfo.Value[key] = val
-	nodeInfo.LastUpdateTs = time.Now()
+// CompareAndSwapSelf updates the key only if it is still at the version
+// returned by GetKeyVersion. An old version of 0 means the key must not
+// be set. It returns false if the key is at another version.
+func (s *GossipStoreImpl) CompareAndSwapSelf(
+	key types.StoreKey,
+	oldVersion uint64,
+	val interface{},
+) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.nodeMap[s.id].KeyVersions[key] != oldVersion {
+		return false, nil
+	}
+	if err := s.updateSelfValues(types.StoreMap{key: val}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateSelfMulti updates all the keys at once. Readers and peers see
+// either none or all of the values, which share a single version.
+func (s *GossipStoreImpl) UpdateSelfMulti(values types.StoreMap) error {
+	if len(values) == 0 {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.updateSelfValues(values)
+}
+
+// updateSelfValues updates the keys of this node with a single version
+// bump. The maps of the node info are copied rather than modified, so
+// the node infos handed out before are not changed. Caller should hold
+// the lock.
+func (s *GossipStoreImpl) updateSelfValues(values types.StoreMap) error {
+	nodeInfo := withValues(s.nodeMap[s.id], values)
+	if s.limits.enabled() {
+		if err := s.checkSelfLimits(values, nodeInfo); err != nil {
+			return err
+		}
+	}
+	nodeInfo.Version++
+	keyVersions := make(map[types.StoreKey]uint64,
+		len(nodeInfo.KeyVersions)+len(values))
+	for key, version := range nodeInfo.KeyVersions {
+		keyVersions[key] = version
+	}
+	for key := range values {
+		keyVersions[key] = nodeInfo.Version
+	}
+	nodeInfo.KeyVersions = keyVersions
+	nodeInfo.LastUpdateTs = s.updateTs(nodeInfo.LastUpdateTs)
 	s.nodeMap[s.id] = nodeInfo
+	return nil
 }
 
 func (s *GossipStoreImpl) UpdateSelfStatus(status types.NodeStatus) {
@@ -117,34 +208,147 @@ func (s *GossipStoreImpl) UpdateNodeStatus(nodeId types.NodeId, status types.Nod
 	if !ok {
 		return fmt.Errorf("Node with id (%v) not found", nodeId)
 	}
-	nodeInfo.Status = status
-	nodeInfo.LastUpdateTs = time.Now()
+	nodeInfo.Status = maintenanceStatus(status, nodeInfo.Maintenance)
+	nodeInfo.StatusUpdateTs = s.clock.Now()
+	if nodeId == s.id {
+		nodeInfo.LastUpdateTs = s.updateTs(nodeInfo.LastUpdateTs)
+	}
+	// The info of the other nodes is kept as signed by its owner so
+	// that we can relay it
 	s.nodeMap[nodeId] = nodeInfo
 	return nil
 }
 
+func (s *GossipStoreImpl) updateSelfMaintenance(maintenance bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	nodeInfo, _ := s.nodeMap[s.id]
+	nodeInfo.Maintenance = maintenance
+	nodeInfo.Status = maintenanceStatus(nodeInfo.Status, maintenance)
+	nodeInfo.LastUpdateTs = s.updateTs(nodeInfo.LastUpdateTs)
+	s.nodeMap[s.id] = nodeInfo
+}
+
+// maintenanceStatus returns the status to be recorded for an alive node
+// based on whether the node is in maintenance
+func maintenanceStatus(
+	status types.NodeStatus,
+	maintenance bool,
+) types.NodeStatus {
+	if maintenance && status == types.NODE_STATUS_UP {
+		return types.NODE_STATUS_MAINTENANCE
+	}
+	if !maintenance && status == types.NODE_STATUS_MAINTENANCE {
+		return types.NODE_STATUS_UP
+	}
+	return status
+}
+
+// GetStoreKeyValue returns the values of the key on the nodes with a
+// valid status which have the key
 func (s *GossipStoreImpl) GetStoreKeyValue(key types.StoreKey) types.NodeValueMap {
+	return s.queryStoreKeyValue(key, types.QueryOptions{}, types.MAX_STALENESS)
+}
+
+// GetFreshStoreKeyValue returns the values of the key like
+// GetStoreKeyValue leaving out the nodes whose info we received
+// longer than maxStaleness ago
+func (s *GossipStoreImpl) GetFreshStoreKeyValue(
+	key types.StoreKey,
+	maxStaleness time.Duration,
+) types.NodeValueMap {
+	return s.queryStoreKeyValue(key, types.QueryOptions{}, maxStaleness)
+}
+
+// QueryStoreKeyValue returns the values of the key on the nodes
+// selected by the options, keyed by node id
+func (s *GossipStoreImpl) QueryStoreKeyValue(
+	key types.StoreKey,
+	opts types.QueryOptions,
+) types.NodeValueMap {
+	maxStaleness := types.MAX_STALENESS
+	if opts.MaxStaleness > 0 {
+		maxStaleness = opts.MaxStaleness
+	}
+	return s.queryStoreKeyValue(key, opts, maxStaleness)
+}
+
+func (s *GossipStoreImpl) queryStoreKeyValue(
+	key types.StoreKey,
+	opts types.QueryOptions,
+	maxStaleness time.Duration,
+) types.NodeValueMap {
 	s.Lock()
 	defer s.Unlock()
 
+	now := s.clock.Now()
 	nodeValueMap := make(types.NodeValueMap)
 	for id, nodeInfo := range s.nodeMap {
-		if statusValid(nodeInfo.Status) && nodeInfo.Value != nil {
-			ok := len(nodeInfo.Value) == 0
-			val, exists := nodeInfo.Value[key]
-			if ok || exists {
-				n := types.NodeValue{Id: nodeInfo.Id,
-					GenNumber:    nodeInfo.GenNumber,
-					LastUpdateTs: nodeInfo.LastUpdateTs,
-					Status:       nodeInfo.Status}
-				n.Value = val
-				nodeValueMap[id] = n
-			}
+		if !statusSelected(nodeInfo.Status, opts.Statuses) ||
+			(opts.QuorumMembersOnly && !nodeInfo.QuorumMember) {
+			continue
+		}
+		val, ok := nodeInfo.Value[key]
+		if !ok && !opts.IncludeMissing {
+			continue
+		}
+		n := s.nodeValue(nodeInfo, val, now)
+		if n.Staleness <= maxStaleness {
+			nodeValueMap[id] = n
 		}
 	}
 	return nodeValueMap
 }
 
+// statusSelected returns true if the status is one of the statuses or,
+// when there are none, if the status is valid
+func statusSelected(status types.NodeStatus, statuses []types.NodeStatus) bool {
+	if len(statuses) == 0 {
+		return statusValid(status)
+	}
+	for _, selected := range statuses {
+		if status == selected {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeValue returns the value of a node with its freshness at the
+// given time. Caller should hold the lock.
+func (s *GossipStoreImpl) nodeValue(
+	nodeInfo types.NodeInfo,
+	val interface{},
+	now time.Time,
+) types.NodeValue {
+	n := types.NodeValue{
+		Id:           nodeInfo.Id,
+		GenNumber:    nodeInfo.GenNumber,
+		LastUpdateTs: nodeInfo.LastUpdateTs,
+		Status:       nodeInfo.Status,
+		Value:        val,
+		ReceivedTs:   s.receivedTs[nodeInfo.Id],
+		Staleness:    types.MAX_STALENESS,
+	}
+	if nodeInfo.Id == s.id {
+		// We are always up to date with ourselves
+		n.ReceivedTs = now
+	}
+	if !n.ReceivedTs.IsZero() {
+		n.Staleness = now.Sub(n.ReceivedTs)
+	}
+	return n
+}
+
+// staleness returns how long ago we received the info of the node. It
+// is MAX_STALENESS if we never received it.
+func (s *GossipStoreImpl) staleness(id types.NodeId) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.nodeValue(s.nodeMap[id], nil, s.clock.Now()).Staleness
+}
+
 func (s *GossipStoreImpl) GetStoreKeys() []types.StoreKey {
 	s.Lock()
 	defer s.Unlock()
@@ -195,8 +399,8 @@ func (s *GossipStoreImpl) addNodeUnlocked(
 	quorumMember bool,
 ) {
 	if nodeInfo, ok := s.nodeMap[id]; ok {
-		nodeInfo.Status = status
-		nodeInfo.LastUpdateTs = time.Now()
+		nodeInfo.Status = maintenanceStatus(status, nodeInfo.Maintenance)
+		nodeInfo.StatusUpdateTs = s.clock.Now()
 		nodeInfo.QuorumMember = quorumMember
 		s.nodeMap[id] = nodeInfo
 		return
@@ -205,13 +409,15 @@ func (s *GossipStoreImpl) addNodeUnlocked(
 	s.nodeMap[id] = types.NodeInfo{
 		Id:                 id,
 		GenNumber:          0,
-		LastUpdateTs:       time.Now(),
-		WaitForGenUpdateTs: time.Now(),
+		LastUpdateTs:       s.clock.Now(),
+		WaitForGenUpdateTs: s.clock.Now(),
 		Status:             status,
+		StatusUpdateTs:     s.clock.Now(),
 		Value:              make(types.StoreMap),
 		QuorumMember:       quorumMember,
 	}
-	logrus.Infof("gossip: Adding Node to gossip map: %v", id)
+	s.log(types.LOG_COMPONENT_STORE).Infof("gossip: Adding Node to "+
+		"gossip map: %v", id)
 }
 
 func (s *GossipStoreImpl) RemoveNode(id types.NodeId) error {
@@ -224,8 +430,11 @@ func (s *GossipStoreImpl) removeNodeUnlocked(id types.NodeId) error {
 	if _, ok := s.nodeMap[id]; !ok {
 		return fmt.Errorf("Node %v does not exist in map", id)
 	}
-	logrus.Infof("gossip: Removing node from gossip map: %v", id)
+	s.log(types.LOG_COMPONENT_STORE).Infof("gossip: Removing node from "+
+		"gossip map: %v", id)
 	delete(s.nodeMap, id)
+	delete(s.receivedTs, id)
+	delete(s.keyIndex, id)
 	return nil
 }
 
@@ -252,7 +461,25 @@ func (s *GossipStoreImpl) GetLocalState() types.NodeInfoMap {
 func (s *GossipStoreImpl) GetLocalStateInBytes() ([]byte, error) {
 	s.Lock()
 	defer s.Unlock()
-	return s.convertToBytes(s.getLocalState())
+	localState := s.getLocalState()
+	if s.auth.enabled() {
+		// Sign our node info so that the nodes receiving it through
+		// other nodes can verify its origin.
+		selfInfo := localState[s.id]
+		if err := s.auth.signNodeInfo(&selfInfo); err != nil {
+			s.log(types.LOG_COMPONENT_STORE).Warnf("gossip: Unable to sign "+
+				"node info: %v", err)
+		}
+		localState[s.id] = selfInfo
+		// The nodes we have not heard from yet only have a placeholder
+		// which the peers cannot verify
+		for id, nodeInfo := range localState {
+			if len(nodeInfo.Signature) == 0 {
+				delete(localState, id)
+			}
+		}
+	}
+	return s.convertToBytes(localState)
 }
 
 func (s *GossipStoreImpl) GetLocalNodeInfo(id types.NodeId) (types.NodeInfo, error) {
@@ -267,9 +494,10 @@ func (s *GossipStoreImpl) GetLocalNodeInfo(id types.NodeId) (types.NodeInfo, err
 }
 
 func (s *GossipStoreImpl) Update(diff types.NodeInfoMap) {
+	var events []namespaceEvent
+	var merged []types.NodeInfo
 	s.Lock()
-	defer s.Unlock()
-
+	now := s.clock.Now()
 	for id, newNodeInfo := range diff {
 		if id == s.id {
 			continue
@@ -281,13 +509,39 @@ func (s *GossipStoreImpl) Update(diff types.NodeInfoMap) {
 		}
 		if !statusValid(selfValue.Status) ||
 			selfValue.LastUpdateTs.Before(newNodeInfo.LastUpdateTs) {
+			if s.auth.enabled() {
+				// The node info might have been relayed by another node.
+				// Only merge it if it was signed by its owner.
+				if err := s.auth.verifyNodeInfo(newNodeInfo); err != nil {
+					s.forgedUpdates++
+					s.log(types.LOG_COMPONENT_STORE).Warnf("gossip: Rejecting "+
+						"node info for node %v: %v", id, err)
+					continue
+				}
+			}
 			// Our view of Status of a Node, should only be determined by
 			// memberlist. We should not update the Status field in our
 			// nodeInfo based on what other node's value is.
-			newNodeInfo.Status = selfValue.Status
+			// The node itself decides whether it is in maintenance.
+			newNodeInfo.Status = maintenanceStatus(selfValue.Status,
+				newNodeInfo.Maintenance)
+			newNodeInfo.StatusUpdateTs = selfValue.StatusUpdateTs
+			if newNodeInfo.Status != selfValue.Status {
+				newNodeInfo.StatusUpdateTs = now
+			}
+			events = append(events, s.namespaceChanges(selfValue, newNodeInfo)...)
 			s.nodeMap[id] = newNodeInfo
+			s.receivedTs[id] = now
+			merged = append(merged, newNodeInfo)
+		} else if selfValue.LastUpdateTs.Equal(newNodeInfo.LastUpdateTs) {
+			// Nothing changed since we last merged the node's info
+			s.receivedTs[id] = now
 		}
 	}
+	s.absorbCRDTs(merged)
+	s.Unlock()
+
+	s.notifyNamespaceWatches(events)
 }
 
 func (s *GossipStoreImpl) updateCluster(
@@ -332,6 +586,35 @@ func (s *GossipStoreImpl) updateCluster(
 	}
 }
 
+// NumForgedUpdates returns the number of node infos which were rejected
+// as they were not signed by their owner
+func (s *GossipStoreImpl) NumForgedUpdates() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.forgedUpdates
+}
+
+// storeSize returns the number of nodes, the number of our keys and the
+// encoded size in bytes of our node info
+func (s *GossipStoreImpl) storeSize() (int, int, int) {
+	s.Lock()
+	defer s.Unlock()
+
+	selfInfo := s.nodeMap[s.id]
+	numKeys := len(selfInfo.Value)
+	for _, values := range selfInfo.Namespaces {
+		numKeys += len(values)
+	}
+	buf, _ := s.convertToBytes(selfInfo)
+	return len(s.nodeMap), numKeys, len(buf)
+}
+
+func (s *GossipStoreImpl) numNodes() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.nodeMap)
+}
+
 func (s *GossipStoreImpl) getNumQuorumMembers() uint {
 	return s.numQuorumMembers
 }
@@ -356,10 +639,45 @@ func (s *GossipStoreImpl) convertFromBytes(buf []byte, msg interface{}) error {
 	return nil
 }
 
+// getLocalState returns a copy of the node info map. The maps of the
+// node infos are replaced rather than modified on updates, so the copy
+// can be read without the lock.
 func (s *GossipStoreImpl) getLocalState() types.NodeInfoMap {
 	localCopy := make(types.NodeInfoMap)
 	for key, value := range s.nodeMap {
 		localCopy[key] = value
 	}
+	if selfInfo, ok := localCopy[s.id]; ok {
+		selfInfo.PeerStatus = s.getPeerStatus()
+		selfInfo.PeerVersions = s.getPeerVersions()
+		localCopy[s.id] = selfInfo
+	}
 	return localCopy
 }
+
+// getPeerStatus returns our view of the status of all the other nodes
+func (s *GossipStoreImpl) getPeerStatus() map[types.NodeId]types.NodeStatus {
+	peerStatus := make(map[types.NodeId]types.NodeStatus)
+	for id, nodeInfo := range s.nodeMap {
+		if id == s.id {
+			continue
+		}
+		peerStatus[id] = nodeInfo.Status
+	}
+	return peerStatus
+}
+
+// getPeerVersions returns the digest of our view of the other nodes
+func (s *GossipStoreImpl) getPeerVersions() map[types.NodeId]types.NodeVersion {
+	peerVersions := make(map[types.NodeId]types.NodeVersion)
+	for id, nodeInfo := range s.nodeMap {
+		if id == s.id {
+			continue
+		}
+		peerVersions[id] = types.NodeVersion{
+			GenNumber: nodeInfo.GenNumber,
+			Version:   nodeInfo.Version,
+		}
+	}
+	return peerVersions
+}
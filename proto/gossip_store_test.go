@@ -1,11 +1,17 @@
 package proto
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
+	"github.com/armon/go-metrics"
 	"github.com/libopenstorage/gossip/types"
 	"math/rand"
+	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -115,7 +121,12 @@ func TestGossipStoreGetStoreKeyValue(t *testing.T) {
 	keyList := []types.StoreKey{"key1", "key2"}
 
 	nodeInfoMap := g.GetStoreKeyValue(keyList[0])
-	if len(nodeInfoMap) != 1 {
+	if len(nodeInfoMap) != 0 {
+		t.Error("Expected empty node info list, got: ", nodeInfoMap)
+	}
+	nodeInfoMap = g.QueryStoreKeyValue(keyList[0],
+		types.QueryOptions{IncludeMissing: true})
+	if len(nodeInfoMap) != 1 || nodeInfoMap[ID].Value != nil {
 		t.Error("Expected self node info list, got: ", nodeInfoMap)
 	}
 
@@ -151,6 +162,97 @@ func TestGossipStoreGetStoreKeyValue(t *testing.T) {
 	}
 }
 
+func TestGossipStoreQueryOptions(t *testing.T) {
+	printTestInfo()
+
+	clock := NewManualClock(simEpoch)
+	g := &GossipStoreImpl{clock: clock}
+	g.InitStore("0", types.DEFAULT_GOSSIP_VERSION, types.NODE_STATUS_UP,
+		DEFAULT_CLUSTER_ID)
+	g.updateCluster(map[types.NodeId]types.NodeUpdate{
+		"0": {QuorumMember: true},
+		"1": {QuorumMember: true},
+		"2": {QuorumMember: false},
+		"3": {QuorumMember: true},
+		"4": {QuorumMember: true},
+	})
+	key := types.StoreKey("key")
+	g.UpdateSelf(key, "0")
+	clock.Advance(time.Minute)
+	nodeInfoMap := make(types.NodeInfoMap)
+	for id, val := range map[types.NodeId]interface{}{
+		"1": "1", "2": "2", "3": nil,
+	} {
+		nodeInfo := types.NodeInfo{
+			Id:           id,
+			LastUpdateTs: clock.Now(),
+			Value:        types.StoreMap{"other": "value"},
+			QuorumMember: id != "2",
+		}
+		if val != nil {
+			nodeInfo.Value[key] = val
+		}
+		nodeInfoMap[id] = nodeInfo
+	}
+	g.Update(nodeInfoMap)
+	g.UpdateNodeStatus("1", types.NODE_STATUS_UP)
+	g.UpdateNodeStatus("2", types.NODE_STATUS_UP)
+	g.UpdateNodeStatus("3", types.NODE_STATUS_UP)
+	g.UpdateNodeStatus("4", types.NODE_STATUS_NEVER_GOSSIPED)
+	clock.Advance(time.Minute)
+	// Node 1 is heard from again
+	g.Update(types.NodeInfoMap{"1": g.nodeMap["1"]})
+
+	testCases := []struct {
+		name     string
+		opts     types.QueryOptions
+		expected map[types.NodeId]interface{}
+	}{
+		{
+			"default",
+			types.QueryOptions{},
+			map[types.NodeId]interface{}{"0": "0", "1": "1", "2": "2"},
+		},
+		{
+			"include missing",
+			types.QueryOptions{IncludeMissing: true},
+			map[types.NodeId]interface{}{"0": "0", "1": "1", "2": "2", "3": nil},
+		},
+		{
+			"statuses",
+			types.QueryOptions{
+				IncludeMissing: true,
+				Statuses:       []types.NodeStatus{types.NODE_STATUS_NEVER_GOSSIPED},
+			},
+			map[types.NodeId]interface{}{"4": nil},
+		},
+		{
+			"quorum members",
+			types.QueryOptions{QuorumMembersOnly: true, IncludeMissing: true},
+			map[types.NodeId]interface{}{"0": "0", "1": "1", "3": nil},
+		},
+		{
+			"max staleness",
+			types.QueryOptions{MaxStaleness: time.Second},
+			map[types.NodeId]interface{}{"0": "0", "1": "1"},
+		},
+	}
+	for _, tc := range testCases {
+		res := g.QueryStoreKeyValue(key, tc.opts)
+		if len(res) != len(tc.expected) {
+			t.Error(tc.name, ": Expected ", tc.expected, " got: ", res)
+			continue
+		}
+		for id, val := range tc.expected {
+			n, ok := res[id]
+			if !ok || n.Id != id || n.Value != val {
+				t.Error(tc.name, ": Expected value ", val, " of node ", id,
+					" got: ", n)
+			}
+		}
+	}
+}
+
 func TestGossipStoreMetaInfo(t *testing.T) {
 	printTestInfo()
 
@@ -390,3 +492,955 @@ func TestGossipStoreBlackBoxTests(t *testing.T) {
 		}
 	}
 }
+
+func TestGossipStoreMaintenance(t *testing.T) {
+	printTestInfo()
+
+	g1 := NewGossipStore(types.NodeId("1"), types.DEFAULT_GOSSIP_VERSION,
+		DEFAULT_CLUSTER_ID)
+	g2 := NewGossipStore(types.NodeId("2"), types.DEFAULT_GOSSIP_VERSION,
+		DEFAULT_CLUSTER_ID)
+	g1.AddNode(g2.NodeId(), types.NODE_STATUS_UP, true)
+	g2.AddNode(g1.NodeId(), types.NODE_STATUS_UP, true)
+	key := types.StoreKey("key")
+	g1.UpdateSelf(key, "value1")
+	g2.UpdateSelf(key, "value2")
+
+	g1.UpdateSelfStatus(types.NODE_STATUS_UP)
+	g1.updateSelfMaintenance(true)
+	if g1.GetSelfStatus() != types.NODE_STATUS_MAINTENANCE {
+		t.Error("Expected self status to be ", types.NODE_STATUS_MAINTENANCE,
+			" Got: ", g1.GetSelfStatus())
+	}
+	// The status of a node in maintenance stays in maintenance while UP
+	g1.UpdateSelfStatus(types.NODE_STATUS_UP)
+	if g1.GetSelfStatus() != types.NODE_STATUS_MAINTENANCE {
+		t.Error("Expected self status to be ", types.NODE_STATUS_MAINTENANCE,
+			" Got: ", g1.GetSelfStatus())
+	}
+	// but not if the node is out of quorum
+	g1.UpdateSelfStatus(types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM)
+	if g1.GetSelfStatus() != types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM {
+		t.Error("Expected self status to be ",
+			types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM,
+			" Got: ", g1.GetSelfStatus())
+	}
+	g1.UpdateSelfStatus(types.NODE_STATUS_UP)
+
+	// The maintenance status is propagated through gossip
+	g1.updateSelfTs()
+	g2.Update(g1.GetLocalState())
+	res := g2.GetStoreKeyValue(key)
+	if res[g1.NodeId()].Status != types.NODE_STATUS_MAINTENANCE {
+		t.Error("Expected node 1 status to be ", types.NODE_STATUS_MAINTENANCE,
+			" Got: ", res[g1.NodeId()].Status)
+	}
+	if res[g2.NodeId()].Status == types.NODE_STATUS_MAINTENANCE {
+		t.Error("Node 2 unexpectedly in maintenance")
+	}
+
+	// The node is still reported as in maintenance when memberlist
+	// reports it alive again.
+	g2.UpdateNodeStatus(g1.NodeId(), types.NODE_STATUS_DOWN)
+	g2.UpdateNodeStatus(g1.NodeId(), types.NODE_STATUS_UP)
+	nodeInfo, _ := g2.GetLocalNodeInfo(g1.NodeId())
+	if nodeInfo.Status != types.NODE_STATUS_MAINTENANCE {
+		t.Error("Expected node 1 status to be ", types.NODE_STATUS_MAINTENANCE,
+			" Got: ", nodeInfo.Status)
+	}
+
+	// Node comes out of maintenance
+	g1.updateSelfMaintenance(false)
+	if g1.GetSelfStatus() != types.NODE_STATUS_UP {
+		t.Error("Expected self status to be ", types.NODE_STATUS_UP,
+			" Got: ", g1.GetSelfStatus())
+	}
+	g1.updateSelfTs()
+	g2.Update(g1.GetLocalState())
+	nodeInfo, _ = g2.GetLocalNodeInfo(g1.NodeId())
+	if nodeInfo.Status != types.NODE_STATUS_UP {
+		t.Error("Expected node 1 status to be ", types.NODE_STATUS_UP,
+			" Got: ", nodeInfo.Status)
+	}
+}
+
+// receivedState returns the local state of the store as received by a peer
+func receivedState(t *testing.T, g *GossipStoreImpl) types.NodeInfoMap {
+	buf, err := g.GetLocalStateInBytes()
+	if err != nil {
+		t.Fatal("Error in getting local state: ", err)
+	}
+	var nodeInfoMap types.NodeInfoMap
+	if err := g.convertFromBytes(buf, &nodeInfoMap); err != nil {
+		t.Fatal("Error in unmarshalling local state: ", err)
+	}
+	return nodeInfoMap
+}
+
+func TestGossipStoreSignedUpdates(t *testing.T) {
+	printTestInfo()
+
+	ids := []types.NodeId{"1", "2", "3"}
+	stores := make(map[types.NodeId]*GossipStoreImpl)
+	privateKeys := make(map[types.NodeId]ed25519.PrivateKey)
+	peers := make(map[types.NodeId]types.NodeUpdate)
+	for _, id := range ids {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal("Error in generating key: ", err)
+		}
+		privateKeys[id] = privateKey
+		peers[id] = types.NodeUpdate{QuorumMember: true, PublicKey: publicKey}
+	}
+	for _, id := range ids {
+		g := NewGossipStore(id, types.DEFAULT_GOSSIP_VERSION, DEFAULT_CLUSTER_ID)
+		auth, err := newNodeAuthenticator(nil, privateKeys[id])
+		if err != nil {
+			t.Fatal("Error in creating authenticator: ", err)
+		}
+		auth.updateKeys(peers)
+		g.auth = auth
+		g.updateCluster(peers)
+		stores[id] = g
+	}
+	g1, g2, g3 := stores["1"], stores["2"], stores["3"]
+	key := types.StoreKey("key")
+	g1.UpdateSelf(key, "value1")
+
+	// Node 3 does not relay its placeholder for node 2
+	g1.Update(receivedState(t, g3))
+
+	// Node 1's state reaches node 3 through node 2
+	g2.Update(receivedState(t, g1))
+	g3.Update(receivedState(t, g2))
+	if res := g3.GetStoreKeyValue(key); res["1"].Value != "value1" {
+		t.Error("Expected relayed value from node 1, got: ", res["1"])
+	}
+	if g1.NumForgedUpdates() != 0 || g2.NumForgedUpdates() != 0 ||
+		g3.NumForgedUpdates() != 0 {
+		t.Error("Unexpected forged updates: ", g1.NumForgedUpdates(),
+			g2.NumForgedUpdates(), g3.NumForgedUpdates())
+	}
+
+	// Node 2 tampers with node 1's value while relaying it
+	g1.UpdateSelf(key, "value2")
+	relayed := receivedState(t, g1)
+	nodeInfo := relayed["1"]
+	nodeInfo.Value = types.StoreMap{key: "forged"}
+	relayed["1"] = nodeInfo
+	g3.Update(relayed)
+	if res := g3.GetStoreKeyValue(key); res["1"].Value != "value1" {
+		t.Error("Expected forged value to be rejected, got: ", res["1"])
+	}
+
+	// Node 2 signs node 1's info with its own key
+	if err := g2.auth.signNodeInfo(&nodeInfo); err != nil {
+		t.Fatal("Error in signing node info: ", err)
+	}
+	relayed["1"] = nodeInfo
+	g3.Update(relayed)
+
+	// An unsigned node info
+	nodeInfo.Signature = nil
+	relayed["1"] = nodeInfo
+	g3.Update(relayed)
+	if res := g3.GetStoreKeyValue(key); res["1"].Value != "value1" {
+		t.Error("Expected forged value to be rejected, got: ", res["1"])
+	}
+	if g3.NumForgedUpdates() != 3 {
+		t.Error("Expected 3 forged updates, got: ", g3.NumForgedUpdates())
+	}
+
+	// The genuine update is still accepted
+	g3.Update(receivedState(t, g1))
+	if res := g3.GetStoreKeyValue(key); res["1"].Value != "value2" {
+		t.Error("Expected value from node 1, got: ", res["1"])
+	}
+
+	// Node 2's view of the status of node 1 changes after it merged
+	// node 1's info, which it still relays as signed by node 1
+	g1.UpdateSelf(key, "value3")
+	g2.Update(receivedState(t, g1))
+	g2.UpdateNodeStatus("1", types.NODE_STATUS_DOWN)
+	g2.AddNode("1", types.NODE_STATUS_UP, true)
+	g2.UpdateNodeStatus("1", types.NODE_STATUS_UP)
+	nodeInfo, _ = g2.GetLocalNodeInfo("1")
+	selfInfo, _ := g1.GetLocalNodeInfo("1")
+	if !nodeInfo.LastUpdateTs.Equal(selfInfo.LastUpdateTs) ||
+		!nodeInfo.StatusUpdateTs.After(selfInfo.LastUpdateTs) {
+		t.Error("Expected the update timestamp of node 1 and a local "+
+			"status timestamp, got: ", nodeInfo.LastUpdateTs,
+			nodeInfo.StatusUpdateTs)
+	}
+	g3.Update(receivedState(t, g2))
+	if res := g3.GetStoreKeyValue(key); res["1"].Value != "value3" {
+		t.Error("Expected relayed value from node 1, got: ", res["1"])
+	}
+	if g3.NumForgedUpdates() != 3 {
+		t.Error("Expected no more forged updates, got: ",
+			g3.NumForgedUpdates())
+	}
+}
+
+func TestGossipStoreNamespaces(t *testing.T) {
+	printTestInfo()
+
+	g1 := NewGossipStore(types.NodeId("1"), types.DEFAULT_GOSSIP_VERSION,
+		DEFAULT_CLUSTER_ID)
+	g2 := NewGossipStore(types.NodeId("2"), types.DEFAULT_GOSSIP_VERSION,
+		DEFAULT_CLUSTER_ID)
+	g1.AddNode(g2.NodeId(), types.NODE_STATUS_UP, true)
+	g2.AddNode(g1.NodeId(), types.NODE_STATUS_UP, true)
+	g1.UpdateSelfStatus(types.NODE_STATUS_UP)
+	g2.UpdateSelfStatus(types.NODE_STATUS_UP)
+
+	type watchEvent struct {
+		nodeId types.NodeId
+		key    types.StoreKey
+		value  interface{}
+	}
+	var events []watchEvent
+	g2.Namespace("volumes").Watch(
+		func(nodeId types.NodeId, key types.StoreKey, value interface{}) {
+			events = append(events, watchEvent{nodeId, key, value})
+		})
+
+	// The same key in the default store and in different namespaces
+	key := types.StoreKey("key")
+	g1.UpdateSelf(key, "default")
+	g1.Namespace("volumes").UpdateSelf(key, "volume")
+	g1.Namespace("nodes").UpdateSelf(key, "node")
+	if size := g1.Namespace("volumes").Size(); size == 0 {
+		t.Error("Expected non zero size for namespace volumes")
+	}
+	if size := g1.Namespace("unknown").Size(); size != 0 {
+		t.Error("Expected zero size for unknown namespace, got: ", size)
+	}
+
+	g2.Update(receivedState(t, g1))
+	names := g2.GetNamespaces()
+	if len(names) != 2 || names[0] != "nodes" || names[1] != "volumes" {
+		t.Error("Expected namespaces nodes and volumes, got: ", names)
+	}
+	if res := g2.GetStoreKeyValue(key); res[g1.NodeId()].Value != "default" {
+		t.Error("Expected default value, got: ", res[g1.NodeId()])
+	}
+	for name, expected := range map[string]string{
+		"volumes": "volume",
+		"nodes":   "node",
+	} {
+		res := g2.Namespace(name).GetStoreKeyValue(key)
+		if len(res) != 1 || res[g1.NodeId()].Value != expected {
+			t.Error("Expected value ", expected, " in namespace ", name,
+				" got: ", res)
+		}
+		keys := g2.Namespace(name).GetStoreKeys()
+		if len(keys) != 1 || keys[0] != key {
+			t.Error("Expected keys [", key, "] in namespace ", name,
+				" got: ", keys)
+		}
+	}
+	if len(events) != 1 || events[0] != (watchEvent{g1.NodeId(), key, "volume"}) {
+		t.Error("Expected a watch event for the new key, got: ", events)
+	}
+
+	// Unchanged values are not reported
+	events = nil
+	g1.UpdateSelf(key, "default2")
+	g2.Update(receivedState(t, g1))
+	if len(events) != 0 {
+		t.Error("Expected no watch events, got: ", events)
+	}
+
+	// Deleted keys are reported with a nil value
+	g1.Namespace("volumes").DeleteSelf(key)
+	g2.Update(receivedState(t, g1))
+	if len(events) != 1 || events[0] != (watchEvent{g1.NodeId(), key, nil}) {
+		t.Error("Expected a watch event for the deleted key, got: ", events)
+	}
+	if res := g2.Namespace("volumes").GetStoreKeyValue(key); len(res) != 0 {
+		t.Error("Expected no values after delete, got: ", res)
+	}
+
+	// Own updates are reported as well
+	events = nil
+	g2.Namespace("volumes").UpdateSelf(key, "local")
+	if len(events) != 1 || events[0] != (watchEvent{g2.NodeId(), key, "local"}) {
+		t.Error("Expected a watch event for the local update, got: ", events)
+	}
+}
+
+func TestGossipStoreLocalStateSnapshot(t *testing.T) {
+	printTestInfo()
+
+	g := NewGossipStore(types.NodeId("1"), types.DEFAULT_GOSSIP_VERSION,
+		DEFAULT_CLUSTER_ID)
+	snapshot := g.GetLocalState()
+
+	// The local state is encoded without the lock, like the debug
+	// handler does, while the node updates its values
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if _, err := json.Marshal(g.GetLocalState()); err != nil {
+				t.Error("Error in encoding the local state: ", err)
+			}
+		}
+	}()
+	for i, updating := 0, true; updating; i++ {
+		key := types.StoreKey(strconv.Itoa(i % 10))
+		g.UpdateSelf(key, i)
+		g.Namespace("ns").UpdateSelf(key, i)
+		if i%3 == 0 {
+			g.Namespace("ns").DeleteSelf(key)
+		}
+		select {
+		case <-done:
+			updating = false
+		default:
+		}
+	}
+
+	selfInfo := snapshot[g.NodeId()]
+	if len(selfInfo.Value) != 0 || len(selfInfo.Namespaces) != 0 ||
+		len(selfInfo.KeyVersions) != 0 {
+		t.Error("Expected the snapshot to be unchanged, got: ", selfInfo)
+	}
+}
+
+func TestGossipStoreLimits(t *testing.T) {
+	printTestInfo()
+
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	conf := metrics.DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	metrics.NewGlobal(conf, sink)
+	defer metrics.NewGlobal(conf, &metrics.BlackholeSink{})
+
+	g := NewGossipStore(types.NodeId("1"), types.DEFAULT_GOSSIP_VERSION,
+		DEFAULT_CLUSTER_ID)
+	g.limits = storeLimits{maxKeySize: 200, maxNodeSize: 1000}
+	smallValue := strings.Repeat("a", 10)
+	largeValue := strings.Repeat("a", 300)
+	nearLimitValue := strings.Repeat("a", 140)
+
+	if err := g.UpdateSelf("key", smallValue); err != nil {
+		t.Error("Unexpected error for a small value: ", err)
+	}
+	if err := g.UpdateSelf("key", largeValue); err == nil {
+		t.Error("Expected an error for a value above the key limit")
+	}
+	if err := g.Namespace("ns").UpdateSelf("key", largeValue); err == nil {
+		t.Error("Expected an error for a namespace value above the key limit")
+	}
+	if res := g.GetStoreKeyValue("key"); res[g.NodeId()].Value != smallValue {
+		t.Error("Rejected update should not change the value, got: ",
+			res[g.NodeId()].Value)
+	}
+	if err := g.UpdateSelf("key", nearLimitValue); err != nil {
+		t.Error("Unexpected error for a value below the key limit: ", err)
+	}
+
+	// Fill up the node until the node limit is reached
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = g.Namespace("ns").UpdateSelf(
+			types.StoreKey(strconv.Itoa(i)), smallValue)
+	}
+	if err == nil {
+		t.Error("Expected an error for exceeding the node limit")
+	}
+	buf, _ := g.convertToBytes(g.GetLocalState()[g.NodeId()])
+	if len(buf) > g.limits.maxNodeSize {
+		t.Error("Node size ", len(buf), " exceeds the limit")
+	}
+
+	data := sink.Data()
+	counters := data[len(data)-1].Counters
+	for _, name := range []string{
+		"gossip.store.key.exceeded",
+		"gossip.store.key.approached",
+		"gossip.store.node.exceeded",
+		"gossip.store.node.approached",
+	} {
+		if _, ok := counters[name]; !ok {
+			t.Error("Expected metric ", name, " in ", counters)
+		}
+	}
+}
+
+func TestGossipStoreManualClock(t *testing.T) {
+	printTestInfo()
+
+	clock := NewManualClock(simEpoch)
+	newStore := func(id types.NodeId) *GossipStoreImpl {
+		g := &GossipStoreImpl{clock: clock}
+		g.InitStore(id, types.DEFAULT_GOSSIP_VERSION,
+			types.NODE_STATUS_UP, DEFAULT_CLUSTER_ID)
+		return g
+	}
+	g1 := newStore(types.NodeId("1"))
+	g2 := newStore(types.NodeId("2"))
+	g2.AddNode(types.NodeId("1"), types.NODE_STATUS_UP, true)
+	if ts := g1.getLocalState()[g1.id].LastUpdateTs; !ts.Equal(simEpoch) {
+		t.Error("Expected the update timestamp to be ", simEpoch, " got: ", ts)
+	}
+
+	// Updates are merged by the peers even if the clock did not move
+	for i := 0; i < 3; i++ {
+		g1.UpdateSelf("key", i)
+		g2.Update(receivedState(t, g1))
+		value := g2.GetStoreKeyValue("key")[g1.id].Value
+		if value != i {
+			t.Error("Expected value ", i, " got: ", value)
+		}
+	}
+
+	clock.Advance(time.Minute)
+	g1.UpdateSelf("key", 3)
+	ts := g1.getLocalState()[g1.id].LastUpdateTs
+	if !ts.Equal(simEpoch.Add(time.Minute)) {
+		t.Error("Expected the update timestamp to follow the clock, got: ", ts)
+	}
+
+	// Calls run in order when the clock moves past them
+	var calls []int
+	clock.AfterFunc(2*time.Second, func() { calls = append(calls, 2) })
+	clock.AfterFunc(time.Second, func() { calls = append(calls, 1) })
+	stopped := clock.AfterFunc(time.Second, func() { calls = append(calls, 0) })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("Expected only the first stop to succeed")
+	}
+	clock.Advance(time.Second)
+	clock.Advance(time.Second)
+	if len(calls) != 2 || calls[0] != 1 || calls[1] != 2 {
+		t.Error("Expected the calls to run in order, got: ", calls)
+	}
+}
+
+func TestGossipStoreAcknowledgements(t *testing.T) {
+	printTestInfo()
+
+	ids := []types.NodeId{"1", "2", "3"}
+	peers := make(map[types.NodeId]types.NodeUpdate)
+	stores := make(map[types.NodeId]*GossipStoreImpl)
+	for _, id := range ids {
+		peers[id] = types.NodeUpdate{QuorumMember: true}
+	}
+	for _, id := range ids {
+		g := NewGossipStore(id, types.DEFAULT_GOSSIP_VERSION, DEFAULT_CLUSTER_ID)
+		g.updateCluster(peers)
+		stores[id] = g
+	}
+	g1, g2, g3 := stores["1"], stores["2"], stores["3"]
+	key := types.StoreKey("key")
+
+	if _, err := g1.GetAcknowledgements(key, 1); err == nil {
+		t.Error("Expected an error for a key which is not set")
+	}
+	g1.UpdateSelf(key, "value1")
+	g1.UpdateSelf("other", "value")
+	version, ok := g1.GetKeyVersion(key)
+	if !ok || version != 1 {
+		t.Error("Expected version 1 of the key, got: ", version, ok)
+	}
+	if _, err := g1.GetAcknowledgements(key, 3); err == nil {
+		t.Error("Expected an error for a future version")
+	}
+
+	checkAcks := func(version uint64, expected map[types.NodeId]bool) {
+		acks, err := g1.GetAcknowledgements(key, version)
+		if err != nil {
+			t.Fatal("Error in getting acknowledgements: ", err)
+		}
+		if len(acks) != len(expected) {
+			t.Error("Expected acknowledgements of ", len(expected),
+				" nodes, got: ", acks)
+		}
+		for id, acked := range expected {
+			if acks[id].Acked != acked {
+				t.Error("Expected node ", id, " acked to be ", acked,
+					" for version ", version, ", got: ", acks[id])
+			}
+		}
+	}
+	checkAcks(version, map[types.NodeId]bool{"2": false, "3": false})
+
+	// Node 2 acknowledges once its digest reaches node 1
+	g2.Update(receivedState(t, g1))
+	checkAcks(version, map[types.NodeId]bool{"2": false, "3": false})
+	g1.Update(receivedState(t, g2))
+	checkAcks(version, map[types.NodeId]bool{"2": true, "3": false})
+
+	// A newer version of the key is not acknowledged yet
+	g1.UpdateSelf(key, "value2")
+	newVersion, _ := g1.GetKeyVersion(key)
+	checkAcks(version, map[types.NodeId]bool{"2": true, "3": false})
+	checkAcks(newVersion, map[types.NodeId]bool{"2": false, "3": false})
+
+	// Node 3 acknowledges the newer version through node 2
+	g2.Update(receivedState(t, g1))
+	g3.Update(receivedState(t, g2))
+	g2.Update(receivedState(t, g3))
+	g1.Update(receivedState(t, g2))
+	checkAcks(newVersion, map[types.NodeId]bool{"2": false, "3": true})
+
+	// Versions seen before a restart of node 1 are not acknowledgements
+	restarted := NewGossipStore("1", types.DEFAULT_GOSSIP_VERSION,
+		DEFAULT_CLUSTER_ID)
+	restarted.GenNumber = 2
+	restarted.InitStore("1", types.DEFAULT_GOSSIP_VERSION,
+		types.NODE_STATUS_UP, DEFAULT_CLUSTER_ID)
+	restarted.updateCluster(peers)
+	restarted.UpdateSelf(key, "value3")
+	restarted.Update(receivedState(t, g3))
+	acks, _ := restarted.GetAcknowledgements(key, 1)
+	if acks["3"].Acked {
+		t.Error("Expected no acknowledgement across generations, got: ",
+			acks["3"])
+	}
+}
+
+func TestGossipStoreCompareAndSwap(t *testing.T) {
+	printTestInfo()
+
+	g1 := NewGossipStore(types.NodeId("1"), types.DEFAULT_GOSSIP_VERSION,
+		DEFAULT_CLUSTER_ID)
+	g2 := NewGossipStore(types.NodeId("2"), types.DEFAULT_GOSSIP_VERSION,
+		DEFAULT_CLUSTER_ID)
+	g2.AddNode(g1.NodeId(), types.NODE_STATUS_UP, true)
+	key := types.StoreKey("key")
+
+	// A version of 0 only swaps a key which is not set
+	if ok, err := g1.CompareAndSwapSelf(key, 0, "value1"); !ok || err != nil {
+		t.Error("Expected swap of a key which is not set, got: ", ok, err)
+	}
+	if ok, _ := g1.CompareAndSwapSelf(key, 0, "value2"); ok {
+		t.Error("Expected no swap of a key which is set")
+	}
+	version, _ := g1.GetKeyVersion(key)
+	if ok, _ := g1.CompareAndSwapSelf(key, version, "value2"); !ok {
+		t.Error("Expected swap at the current version ", version)
+	}
+	if ok, _ := g1.CompareAndSwapSelf(key, version, "value3"); ok {
+		t.Error("Expected no swap at the previous version ", version)
+	}
+	if val, _ := g1.Get(g1.NodeId(), key); val.Value != "value2" {
+		t.Error("Expected value2, got: ", val.Value)
+	}
+
+	// Concurrent increments are not lost
+	g1.UpdateSelf("counter", 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				version, _ := g1.GetKeyVersion("counter")
+				val, _ := g1.Get(g1.NodeId(), "counter")
+				ok, err := g1.CompareAndSwapSelf("counter", version,
+					val.Value.(int)+1)
+				if err != nil {
+					t.Error("Unexpected error in swap: ", err)
+				}
+				if ok || err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val, _ := g1.Get(g1.NodeId(), "counter"); val.Value != 10 {
+		t.Error("Expected counter 10, got: ", val.Value)
+	}
+
+	// A batch is a single version and is seen by readers and peers all
+	// at once
+	nodeInfo, _ := g1.GetLocalNodeInfo(g1.NodeId())
+	before := nodeInfo.Version
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			info, _ := g1.GetLocalNodeInfo(g1.NodeId())
+			_, a := info.Value["a"]
+			_, b := info.Value["b"]
+			if a != b || len(info.KeyVersions) != len(info.Value) {
+				t.Error("Expected all or none of the batch, got: ",
+					info.Value, info.KeyVersions)
+			}
+		}
+	}()
+	err := g1.UpdateSelfMulti(types.StoreMap{"a": "1", "b": "2", key: "4"})
+	if err != nil {
+		t.Error("Unexpected error in batch update: ", err)
+	}
+	<-done
+	if _, ok := nodeInfo.Value["a"]; ok {
+		t.Error("Expected the node info read before the batch to be "+
+			"unchanged, got: ", nodeInfo.Value)
+	}
+	nodeInfo, _ = g1.GetLocalNodeInfo(g1.NodeId())
+	if nodeInfo.Version != before+1 {
+		t.Error("Expected version ", before+1, " after the batch, got: ",
+			nodeInfo.Version)
+	}
+	for _, k := range []types.StoreKey{"a", "b", key} {
+		if v, _ := g1.GetKeyVersion(k); v != nodeInfo.Version {
+			t.Error("Expected version ", nodeInfo.Version, " of key ", k,
+				", got: ", v)
+		}
+	}
+	g2.Update(receivedState(t, g1))
+	values := g2.ScanNodeKeys(g1.NodeId(), "")
+	if values["a"] != "1" || values["b"] != "2" || values[key] != "4" {
+		t.Error("Expected the batch on the peer, got: ", values)
+	}
+
+	// A batch exceeding the limits is not applied
+	g1.limits = storeLimits{maxKeySize: 200}
+	err = g1.UpdateSelfMulti(types.StoreMap{
+		"a": "5", "b": strings.Repeat("a", 300)})
+	if err == nil {
+		t.Error("Expected an error for a batch above the key limit")
+	}
+	if val, _ := g1.Get(g1.NodeId(), "a"); val.Value != "1" {
+		t.Error("Rejected batch should not change the value, got: ",
+			val.Value)
+	}
+	if info, _ := g1.GetLocalNodeInfo(g1.NodeId()); info.Version != nodeInfo.Version {
+		t.Error("Rejected batch should not change the version, got: ",
+			info.Version)
+	}
+}
+
+func TestGossipStoreCRDTs(t *testing.T) {
+	printTestInfo()
+
+	ids := []types.NodeId{"1", "2", "3"}
+	peers := make(map[types.NodeId]types.NodeUpdate)
+	for _, id := range ids {
+		peers[id] = types.NodeUpdate{QuorumMember: true}
+	}
+	newStore := func(id types.NodeId, genNumber uint64) *GossipStoreImpl {
+		g := NewGossipStore(id, types.DEFAULT_GOSSIP_VERSION,
+			DEFAULT_CLUSTER_ID)
+		g.GenNumber = genNumber
+		g.InitStore(id, types.DEFAULT_GOSSIP_VERSION, types.NODE_STATUS_UP,
+			DEFAULT_CLUSTER_ID)
+		g.updateCluster(peers)
+		return g
+	}
+	stores := make(map[types.NodeId]*GossipStoreImpl)
+	for _, id := range ids {
+		stores[id] = newStore(id, 1)
+	}
+	g1, g2, g3 := stores["1"], stores["2"], stores["3"]
+	// The nodes send their own node info to the others
+	exchange := func(from ...*GossipStoreImpl) {
+		for _, g := range from {
+			nodeInfo := receivedState(t, g)[g.NodeId()]
+			for _, other := range stores {
+				if other != g {
+					other.Update(types.NodeInfoMap{g.NodeId(): nodeInfo})
+				}
+			}
+		}
+	}
+	checkCounter := func(key types.StoreKey, expected int64) {
+		for _, g := range stores {
+			if count, err := g.GetCounter(key); err != nil || count != expected {
+				t.Error("Expected ", key, " ", expected, " on node ",
+					g.NodeId(), ", got: ", count, err)
+			}
+		}
+	}
+	checkSet := func(key types.StoreKey, expected ...string) {
+		for _, g := range stores {
+			elements, err := g.GetSet(key)
+			if err != nil || !reflect.DeepEqual(elements, expected) {
+				t.Error("Expected ", key, " ", expected, " on node ",
+					g.NodeId(), ", got: ", elements, err)
+			}
+		}
+	}
+
+	// Counters sum the contributions of all the nodes
+	for i, g := range []*GossipStoreImpl{g1, g2, g3} {
+		if err := g.IncrementCounter("requests", uint64(i+1)); err != nil {
+			t.Error("Unexpected error in incrementing counter: ", err)
+		}
+		g.AddCounter("balance", 10)
+	}
+	g1.IncrementCounter("requests", 4)
+	g2.AddCounter("balance", -25)
+	exchange(g1, g2, g3)
+	checkCounter("requests", 10)
+	checkCounter("balance", 5)
+
+	// A concurrent addition wins over a removal
+	g1.AddToSet("tags", "ssd", "gpu")
+	exchange(g1)
+	g2.RemoveFromSet("tags", "gpu", "ssd")
+	g3.AddToSet("tags", "gpu")
+	exchange(g2, g3)
+	checkSet("tags", "gpu")
+	g1.RemoveFromSet("tags", "gpu")
+	g1.AddToSet("tags", "nvme")
+	exchange(g1)
+	checkSet("tags", "nvme")
+
+	// The register is the value set last, even by a node behind
+	if register, _ := g1.GetRegister("leader"); register.Value != nil {
+		t.Error("Expected an unset register, got: ", register)
+	}
+	g3.clock = NewManualClock(time.Now().Add(time.Hour))
+	g3.SetRegister("leader", "3")
+	exchange(g3)
+	g1.SetRegister("leader", "1")
+	exchange(g1)
+	for _, g := range stores {
+		register, err := g.GetRegister("leader")
+		if err != nil || register.Value != "1" || register.NodeId != "1" {
+			t.Error("Expected leader 1 on node ", g.NodeId(), ", got: ",
+				register, err)
+		}
+	}
+
+	// Node 1 restarts and counts again before it hears from its peers.
+	// Its earlier contributions are kept by the peers.
+	g1 = newStore("1", 2)
+	stores["1"] = g1
+	g1.IncrementCounter("requests", 5)
+	exchange(g1, g2)
+	checkCounter("requests", 15)
+	checkCounter("balance", 5)
+	checkSet("tags", "nvme")
+
+	// Node 3 is removed from the cluster along with its info
+	delete(peers, "3")
+	delete(stores, "3")
+	g1.updateCluster(peers)
+	g2.updateCluster(peers)
+	checkCounter("requests", 15)
+	checkSet("tags", "nvme")
+
+	// A value of another type is an error
+	g1.UpdateSelf("plain", "value")
+	if err := g1.IncrementCounter("plain", 1); err == nil {
+		t.Error("Expected an error for incrementing a plain value")
+	}
+	exchange(g1)
+	if _, err := g2.GetSet("plain"); err == nil {
+		t.Error("Expected an error for reading a plain value as a set")
+	}
+	if _, ok := g2.Get(g2.NodeId(), "plain"); ok {
+		t.Error("Expected a plain value not to be merged")
+	}
+}
+
+func TestGossipStoreFreshness(t *testing.T) {
+	printTestInfo()
+
+	clock := NewManualClock(simEpoch)
+	newStore := func(id types.NodeId) *GossipStoreImpl {
+		g := &GossipStoreImpl{clock: clock}
+		g.InitStore(id, types.DEFAULT_GOSSIP_VERSION,
+			types.NODE_STATUS_UP, DEFAULT_CLUSTER_ID)
+		return g
+	}
+	g1 := newStore(types.NodeId("1"))
+	g2 := newStore(types.NodeId("2"))
+	g2.AddNode(g1.id, types.NODE_STATUS_UP, true)
+	key := types.StoreKey("key")
+	g1.UpdateSelf(key, "value")
+	g2.UpdateSelf(key, "value")
+
+	// We never heard from node 1
+	values := g2.QueryStoreKeyValue(key,
+		types.QueryOptions{IncludeMissing: true})
+	if v := values[g1.id]; !v.ReceivedTs.IsZero() ||
+		v.Staleness != types.MAX_STALENESS {
+		t.Error("Expected node 1 to have never been received, got: ", v)
+	}
+	if v := values[g2.id]; !v.ReceivedTs.Equal(simEpoch) || v.Staleness != 0 {
+		t.Error("Expected our own value to be fresh, got: ", v)
+	}
+
+	clock.Advance(time.Second)
+	g2.Update(receivedState(t, g1))
+	clock.Advance(time.Minute)
+	v := g2.GetStoreKeyValue(key)[g1.id]
+	if !v.ReceivedTs.Equal(simEpoch.Add(time.Second)) ||
+		v.Staleness != time.Minute {
+		t.Error("Expected node 1 to be received a minute ago, got: ", v)
+	}
+	if v := g2.GetFreshStoreKeyValue(key, 30*time.Second); len(v) != 1 {
+		t.Error("Expected only our own fresh value, got: ", v)
+	}
+	if v := g2.GetFreshStoreKeyValue(key, time.Minute); len(v) != 2 {
+		t.Error("Expected both the values, got: ", v)
+	}
+
+	// Receiving an unchanged node info refreshes it
+	g2.Update(receivedState(t, g1))
+	if v := g2.GetStoreKeyValue(key)[g1.id]; v.Staleness != 0 ||
+		v.LastUpdateTs.After(simEpoch.Add(time.Second)) {
+		t.Error("Expected node 1 to be refreshed but unchanged, got: ", v)
+	}
+
+	// An outdated node info does not refresh it
+	outdated := receivedState(t, g1)
+	clock.Advance(time.Second)
+	g1.UpdateSelf(key, "newer")
+	g2.Update(receivedState(t, g1))
+	clock.Advance(time.Minute)
+	g2.Update(outdated)
+	if v := g2.GetStoreKeyValue(key)[g1.id]; v.Staleness != time.Minute ||
+		v.Value != "newer" {
+		t.Error("Expected an outdated node info to be ignored, got: ", v)
+	}
+
+	// Namespace values carry the freshness of their node
+	g1.Namespace("ns").UpdateSelf(key, "value")
+	g2.Update(receivedState(t, g1))
+	clock.Advance(time.Second)
+	if v := g2.Namespace("ns").GetStoreKeyValue(key)[g1.id]; v.Staleness !=
+		time.Second {
+		t.Error("Expected the namespace value received a second ago, got: ", v)
+	}
+}
+
+func TestGossipStoreLookups(t *testing.T) {
+	printTestInfo()
+
+	g := NewGossipStore(ID, types.DEFAULT_GOSSIP_VERSION, DEFAULT_CLUSTER_ID)
+	nodeInfoMap := make(types.NodeInfoMap)
+	for i := 0; i < 3; i++ {
+		id := types.NodeId(strconv.Itoa(i))
+		g.AddNode(id, types.NODE_STATUS_DOWN, true)
+		nodeInfo := types.NodeInfo{
+			Id:           id,
+			GenNumber:    1,
+			LastUpdateTs: time.Now(),
+			Status:       types.NODE_STATUS_UP,
+			Value: types.StoreMap{
+				"disk/sda": i,
+				"disk/sdb": i + 10,
+				"cpu":      i + 20,
+			},
+		}
+		if i == 2 {
+			nodeInfo.Value = types.StoreMap{"cpu": 22}
+		}
+		nodeInfoMap[id] = nodeInfo
+	}
+	g.Update(nodeInfoMap)
+	g.UpdateNodeStatus("0", types.NODE_STATUS_UP)
+	g.UpdateNodeStatus("1", types.NODE_STATUS_UP)
+	g.UpdateNodeStatus("2", types.NODE_STATUS_NEVER_GOSSIPED)
+
+	if v, ok := g.Get("1", "disk/sdb"); !ok || v.Value != 11 || v.Id != "1" {
+		t.Error("Expected value 11 of node 1, got: ", v, ok)
+	}
+	if v, ok := g.Get("1", "missing"); ok {
+		t.Error("Expected a missing key, got: ", v)
+	}
+	if v, ok := g.Get("5", "cpu"); ok {
+		t.Error("Expected a missing node, got: ", v)
+	}
+
+	keys := g.GetNodeKeys("0")
+	expected := []types.StoreKey{"cpu", "disk/sda", "disk/sdb"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Error("Expected keys ", expected, " got: ", keys)
+	}
+	// The returned keys are a copy
+	keys[0] = "modified"
+	if keys := g.GetNodeKeys("0"); keys[0] != "cpu" {
+		t.Error("Expected the keys to be unchanged, got: ", keys)
+	}
+	if keys := g.GetNodeKeys("5"); len(keys) != 0 {
+		t.Error("Expected no keys for a missing node, got: ", keys)
+	}
+
+	values := g.ScanNodeKeys("1", "disk/")
+	if len(values) != 2 || values["disk/sda"] != 1 || values["disk/sdb"] != 11 {
+		t.Error("Expected the disks of node 1, got: ", values)
+	}
+	if values := g.ScanNodeKeys("1", "mem"); len(values) != 0 {
+		t.Error("Expected no values, got: ", values)
+	}
+	if values := g.ScanNodeKeys("1", ""); len(values) != 3 {
+		t.Error("Expected all the values, got: ", values)
+	}
+
+	// Nodes which never gossiped are left out of the store scans
+	scan := g.ScanStoreKeys("")
+	if len(scan) != 3 || len(scan["cpu"]) != 2 || len(scan["disk/sda"]) != 2 {
+		t.Error("Expected the keys of nodes 0 and 1, got: ", scan)
+	}
+	scan = g.ScanStoreKeys("disk/sd")
+	if len(scan) != 2 || scan["disk/sdb"]["0"].Value != 10 {
+		t.Error("Expected the disks of nodes 0 and 1, got: ", scan)
+	}
+
+	// The lookups follow our own updates
+	g.UpdateSelf("disk/sdc", "self")
+	g.UpdateSelf("disk/sda", "self")
+	if values := g.ScanNodeKeys(ID, "disk/"); len(values) != 2 {
+		t.Error("Expected our own disks, got: ", values)
+	}
+	g.UpdateSelf("disk/sdd", "self")
+	if keys := g.GetNodeKeys(ID); len(keys) != 3 || keys[2] != "disk/sdd" {
+		t.Error("Expected our updated keys, got: ", keys)
+	}
+}
+
+func benchmarkLookup(b *testing.B, lookup func(gd *GossipDelegate)) {
+	gd := newLargeStore(100, 1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookup(gd)
+	}
+}
+
+func BenchmarkGetStoreKeyValue(b *testing.B) {
+	benchmarkLookup(b, func(gd *GossipDelegate) {
+		gd.GetStoreKeyValue("key500")
+	})
+}
+
+func BenchmarkGetLocalNodeInfo(b *testing.B) {
+	benchmarkLookup(b, func(gd *GossipDelegate) {
+		nodeInfo, _ := gd.GetLocalNodeInfo("50")
+		_ = nodeInfo.Value["key500"]
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchmarkLookup(b, func(gd *GossipDelegate) {
+		gd.Get("50", "key500")
+	})
+}
+
+func BenchmarkGetNodeKeys(b *testing.B) {
+	benchmarkLookup(b, func(gd *GossipDelegate) {
+		gd.GetNodeKeys("50")
+	})
+}
+
+func BenchmarkScanNodeKeys(b *testing.B) {
+	benchmarkLookup(b, func(gd *GossipDelegate) {
+		gd.ScanNodeKeys("50", "key50")
+	})
+}
+
+func BenchmarkScanStoreKeys(b *testing.B) {
+	benchmarkLookup(b, func(gd *GossipDelegate) {
+		gd.ScanStoreKeys("key50")
+	})
+}
@@ -1,10 +1,17 @@
 package proto
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"github.com/armon/go-metrics"
+	ml "github.com/hashicorp/memberlist"
 	"github.com/libopenstorage/gossip/types"
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -30,6 +37,41 @@ func newGossiperImpl(ip string, selfNodeId types.NodeId, knownIps []string, vers
 	return g, err
 }
 
+func newGossiperImplWithOptions(
+	ip string,
+	selfNodeId types.NodeId,
+	knownIps []string,
+	options types.GossipOptions,
+) (*GossiperImpl, error) {
+	return newGossiperImplWithVersion(ip, selfNodeId, knownIps,
+		types.DEFAULT_GOSSIP_VERSION, options)
+}
+
+func newGossiperImplWithVersion(
+	ip string,
+	selfNodeId types.NodeId,
+	knownIps []string,
+	version string,
+	options types.GossipOptions,
+) (*GossiperImpl, error) {
+	g := new(GossiperImpl)
+	gi := types.GossipIntervals{
+		GossipInterval:   types.DEFAULT_GOSSIP_INTERVAL,
+		PushPullInterval: types.DEFAULT_PUSH_PULL_INTERVAL,
+		ProbeInterval:    types.DEFAULT_PROBE_INTERVAL,
+		ProbeTimeout:     types.DEFAULT_PROBE_TIMEOUT,
+		QuorumTimeout:    TestQuorumTimeout,
+	}
+	err := g.InitWithOptions(ip, selfNodeId, 1, gi, version,
+		DEFAULT_CLUSTER_ID, options)
+	if err != nil {
+		return nil, err
+	}
+	g.selfCorrect = false
+	err = g.Start(knownIps)
+	return g, err
+}
+
 func NewGossiperImpl(
 	ip string,
 	selfNodeId types.NodeId,
@@ -53,7 +95,7 @@ func getNodeUpdateMap(nodesIp []string) map[types.NodeId]types.NodeUpdate {
 	peers := make(map[types.NodeId]types.NodeUpdate)
 	for i, ip := range nodesIp {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
-		peers[nodeId] = types.NodeUpdate{ip, true}
+		peers[nodeId] = types.NodeUpdate{Addr: ip, QuorumMember: true}
 	}
 	return peers
 }
@@ -169,7 +211,8 @@ func TestGossiperOnlyOneNodeGossips(t *testing.T) {
 	// Sleep for gossip quorum timeout
 	time.Sleep(gZero.quorumTimeout + 2*time.Second)
 
-	res := gZero.GetStoreKeyValue(key)
+	res := gZero.QueryStoreKeyValue(key,
+		types.QueryOptions{IncludeMissing: true})
 	if len(res) != 3 {
 		t.Error("Available nodes not reported ", res)
 	}
@@ -380,9 +423,9 @@ func TestGossiperGroupingOfNodesWithSameVersion(t *testing.T) {
 	for i, ip := range nodes {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		if i != 0 && i%2 == 0 {
-			peers2[nodeId] = types.NodeUpdate{ip, true}
+			peers2[nodeId] = types.NodeUpdate{Addr: ip, QuorumMember: true}
 		} else {
-			peers1[nodeId] = types.NodeUpdate{ip, true}
+			peers1[nodeId] = types.NodeUpdate{Addr: ip, QuorumMember: true}
 		}
 	}
 
@@ -721,7 +764,7 @@ func TestGossiperAddNodeExternally(t *testing.T) {
 	}
 
 	nodes = append(nodes, "127.0.0.3:9160")
-	peers[types.NodeId("2")] = types.NodeUpdate{nodes[2], true}
+	peers[types.NodeId("2")] = types.NodeUpdate{Addr: nodes[2], QuorumMember: true}
 
 	for _, g := range gossipers {
 		g.UpdateCluster(peers)
@@ -874,7 +917,8 @@ func TestGossiperExternalNodeLeaveSelfKill(t *testing.T) {
 	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
 
 	// Call ExternalNodeLeave on node1. It should kill itself.
-	killedNode := gossipers[1].ExternalNodeLeave(types.NodeId("0"))
+	verdict := gossipers[1].ExternalNodeLeave(types.NodeId("0"))
+	killedNode := verdict.NodeId
 	if killedNode != types.NodeId("1") {
 		t.Error("ExternalNodeLeave should have killed Node 1 but killed Node ", killedNode)
 	}
@@ -908,10 +952,411 @@ func TestGossiperExternalNodeLeavePeerKill(t *testing.T) {
 	// Let the nodes gossip and populate their memberlists
 	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
 
-	// Call ExternalNodeLeave on node1. It should kill the peer node.
-	killedNode := gossipers[1].ExternalNodeLeave(types.NodeId("0"))
-	if killedNode != types.NodeId("0") {
-		t.Error("ExternalNodeLeave should have killed Node 1 but killed Node ", killedNode)
+	// Call ExternalNodeLeave on node1. It should not kill the reachable
+	// peer node.
+	verdict := gossipers[1].ExternalNodeLeave(types.NodeId("0"))
+	killedNode := verdict.NodeId
+	if killedNode != "" {
+		t.Error("ExternalNodeLeave should not have killed any node but killed Node ", killedNode)
+	}
+	if !verdict.TargetProbed || !verdict.TargetReachable || verdict.Confirmed {
+		t.Error("ExternalNodeLeave should have reached Node 0. Verdict: ", verdict)
+	}
+	if verdict.Reason != "target reachable" || len(verdict.IndirectProbes) != 0 {
+		t.Error("Expected Node 0 to be reached directly. Verdict: ", verdict)
+	}
+	if status, ok := verdict.PeerReports[types.NodeId("2")]; !ok ||
+		status != types.NODE_STATUS_UP {
+		t.Error("Expected Node 2 to report Node 0 up. Verdict: ", verdict)
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		gossipers[i].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	}
+}
+
+func TestGossiperExternalNodeLeaveConfirmed(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9175",
+		"127.0.0.2:9176",
+		"127.0.0.3:9177",
+	}
+
+	peers := getNodeUpdateMap(nodes)
+
+	gossipers := make(map[int]*GossiperImpl)
+	var g *GossiperImpl
+	for i, nodeId := range nodes {
+		id := types.NodeId(strconv.Itoa(i))
+		g, _ = NewGossiperImpl(nodeId, id, []string{nodes[0]}, types.DEFAULT_GOSSIP_VERSION)
+		g.UpdateCluster(peers)
+		gossipers[i] = g
+	}
+
+	// Let the nodes gossip and populate their memberlists
+	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
+
+	// Bring down node 0 and let the other nodes gossip about it
+	gossipers[0].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)))
+
+	verdict := gossipers[1].ExternalNodeLeave(types.NodeId("0"))
+	if verdict.NodeId != types.NodeId("0") {
+		t.Error("ExternalNodeLeave should have killed Node 0 but killed Node ",
+			verdict.NodeId)
+	}
+	if verdict.TargetReachable || !verdict.Confirmed {
+		t.Error("ExternalNodeLeave should have confirmed Node 0 is down. Verdict: ",
+			verdict)
+	}
+	if status, ok := verdict.PeerReports[types.NodeId("2")]; !ok ||
+		status != types.NODE_STATUS_DOWN {
+		t.Error("Expected Node 2 to report Node 0 down. Verdict: ", verdict)
+	}
+	if reachable, ok := verdict.IndirectProbes[types.NodeId("2")]; !ok ||
+		reachable {
+		t.Error("Expected Node 2 to fail to probe Node 0. Verdict: ", verdict)
+	}
+
+	for i := 1; i < len(nodes); i++ {
+		gossipers[i].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	}
+}
+
+func TestGossiperExternalNodeLeaveIndirectProbe(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"10.0.0.1:9000",
+		"10.0.0.2:9000",
+		"10.0.0.3:9000",
+	}
+	n := NewSimNetwork(4)
+	gossipers := startSimNodes(t, n, nodes)
+	n.Advance(5 * time.Second)
+	checkSimStatus(t, gossipers, types.NODE_STATUS_UP)
+
+	// Node 1 cannot reach node 0 but node 2 can
+	n.BlockLink(nodes[0], nodes[1])
+	n.BlockLink(nodes[1], nodes[0])
+	done := make(chan types.NodeLeaveVerdict, 1)
+	go func() {
+		done <- gossipers[1].ExternalNodeLeave(types.NodeId("0"))
+	}()
+	var verdict types.NodeLeaveVerdict
+	waiting := true
+	for i := 0; i < 20 && waiting; i++ {
+		select {
+		case verdict = <-done:
+			waiting = false
+		case <-time.After(100 * time.Millisecond):
+			// Deliver the ping requests and their answers
+			n.Advance(simIntervals.GossipInterval)
+		}
+	}
+	if waiting {
+		t.Fatal("Expected the indirect probe to end as the clock moved")
+	}
+	if verdict.NodeId != "" || verdict.Reason != "target reachable" {
+		t.Error("ExternalNodeLeave should not have killed any node. Verdict: ",
+			verdict)
+	}
+	if !verdict.TargetProbed || !verdict.TargetReachable {
+		t.Error("Expected Node 0 to be reached. Verdict: ", verdict)
+	}
+	if reachable, ok := verdict.IndirectProbes[types.NodeId("2")]; !ok ||
+		!reachable {
+		t.Error("Expected Node 2 to reach Node 0. Verdict: ", verdict)
+	}
+
+	for _, g := range gossipers {
+		g.Stop(time.Second)
+	}
+}
+
+func TestGossiperExternalNodeLeavePeerReports(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9952",
+		"127.0.0.2:9953",
+		"127.0.0.3:9954",
+		"127.0.0.4:9955",
+	}
+	peers := getNodeUpdateMap(nodes)
+	gi := types.GossipIntervals{
+		GossipInterval:   types.DEFAULT_GOSSIP_INTERVAL,
+		PushPullInterval: types.DEFAULT_PUSH_PULL_INTERVAL,
+		ProbeInterval:    types.DEFAULT_PROBE_INTERVAL,
+		ProbeTimeout:     types.DEFAULT_PROBE_TIMEOUT,
+		QuorumTimeout:    TestQuorumTimeout,
+	}
+	clock := NewManualClock(time.Now())
+	g := new(GossiperImpl)
+	err := g.InitWithOptions(nodes[0], types.NodeId("0"), 1, gi,
+		types.DEFAULT_GOSSIP_VERSION, DEFAULT_CLUSTER_ID,
+		types.GossipOptions{Clock: clock})
+	if err != nil {
+		t.Fatal("Error in initializing gossiper: ", err)
+	}
+	g.updateCluster(peers)
+	g.UpdateSelfStatus(types.NODE_STATUS_UP)
+	for id := range peers {
+		if id != g.NodeId() {
+			g.UpdateNodeStatus(id, types.NODE_STATUS_UP)
+		}
+	}
+
+	// Node 1 cannot be probed, but peers 2 and 3 see it up
+	for _, id := range []types.NodeId{"2", "3"} {
+		d := newTestGossipDelegate(id, peers, false)
+		for peer := range peers {
+			if peer != id {
+				d.UpdateNodeStatus(peer, types.NODE_STATUS_UP)
+			}
+		}
+		d.updateSelfTs()
+		g.Update(types.NodeInfoMap{id: d.GetLocalState()[id]})
+	}
+	verdict := g.ExternalNodeLeave(types.NodeId("1"))
+	if verdict.NodeId != "" || verdict.Reason != "majority of peers see target" {
+		t.Error("ExternalNodeLeave should not have killed any node. Verdict: ",
+			verdict)
+	}
+	if len(verdict.PeerReports) != 2 || verdict.TargetProbed {
+		t.Error("Expected reports from peers 2 and 3 only. Verdict: ", verdict)
+	}
+
+	// The reports of peers we have not heard from in a while are ignored
+	clock.Advance(TestQuorumTimeout + time.Second)
+	verdict = g.ExternalNodeLeave(types.NodeId("1"))
+	if verdict.NodeId != types.NodeId("1") || !verdict.Confirmed {
+		t.Error("ExternalNodeLeave should have killed Node 1. Verdict: ",
+			verdict)
+	}
+	if len(verdict.PeerReports) != 0 {
+		t.Error("Expected the stale peer reports to be ignored. Verdict: ",
+			verdict)
+	}
+}
+
+func TestGossiperEncryption(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9178",
+		"127.0.0.2:9179",
+		"127.0.0.3:9180",
+	}
+	key := []byte("0123456789abcdef")
+	wrongKey := []byte("fedcba9876543210")
+
+	_, err := newGossiperImplWithOptions(nodes[0], types.NodeId("0"), []string{},
+		types.GossipOptions{EncryptionKey: []byte("short")})
+	if err == nil {
+		t.Fatal("Expected an error for an invalid encryption key")
+	}
+
+	peers := getNodeUpdateMap(nodes)
+	gossipers := make(map[int]*GossiperImpl)
+	for i := 0; i < 2; i++ {
+		id := types.NodeId(strconv.Itoa(i))
+		g, err := newGossiperImplWithOptions(nodes[i], id, []string{nodes[0]},
+			types.GossipOptions{EncryptionKey: key})
+		if err != nil {
+			t.Fatal("Error in creating gossiper: ", err)
+		}
+		g.UpdateCluster(peers)
+		gossipers[i] = g
+	}
+	// A node with the wrong key should not be able to join
+	g, err := newGossiperImplWithOptions(nodes[2], types.NodeId("2"),
+		[]string{nodes[0]}, types.GossipOptions{EncryptionKey: wrongKey})
+	if err == nil {
+		t.Error("Expected node with the wrong key to fail joining")
+	}
+	gossipers[2] = g
+
+	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+
+	for i := 0; i < 2; i++ {
+		nodeInfoMap := gossipers[i].GetLocalState()
+		for j := 0; j < 2; j++ {
+			id := types.NodeId(strconv.Itoa(j))
+			if nodeInfoMap[id].Status != types.NODE_STATUS_UP {
+				t.Error("Expected node ", id, " to be up on node ", i,
+					" but got ", nodeInfoMap[id].Status)
+			}
+		}
+		if nodeInfoMap[types.NodeId("2")].Status == types.NODE_STATUS_UP {
+			t.Error("Node 2 with the wrong key should not be up on node ", i)
+		}
+		if len(gossipers[i].GetNodes()) != 2 {
+			t.Error("Expected 2 members on node ", i, " got ",
+				gossipers[i].GetNodes())
+		}
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		gossipers[i].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	}
+}
+
+func TestGossiperKeyRotation(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9181",
+		"127.0.0.2:9182",
+		"127.0.0.3:9183",
+	}
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+
+	peers := getNodeUpdateMap(nodes)
+	gossipers := make(map[int]*GossiperImpl)
+	for i, nodeIp := range nodes {
+		id := types.NodeId(strconv.Itoa(i))
+		g, err := newGossiperImplWithOptions(nodeIp, id, []string{nodes[0]},
+			types.GossipOptions{EncryptionKey: oldKey})
+		if err != nil {
+			t.Fatal("Error in creating gossiper: ", err)
+		}
+		g.UpdateCluster(peers)
+		gossipers[i] = g
+	}
+	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+
+	verifyKeys := func(step string, expected [][]byte) {
+		for i, g := range gossipers {
+			keys := g.ListKeys()
+			if len(keys) != len(expected) {
+				t.Error(step, ": Expected keys ", expected, " on node ", i,
+					" got ", keys)
+				continue
+			}
+			for j := range keys {
+				if !bytes.Equal(keys[j], expected[j]) {
+					t.Error(step, ": Expected keys ", expected, " on node ", i,
+						" got ", keys)
+					break
+				}
+			}
+		}
+	}
+	verifyUp := func(step string) {
+		for i, g := range gossipers {
+			for id, nodeInfo := range g.GetLocalState() {
+				if nodeInfo.Status != types.NODE_STATUS_UP {
+					t.Error(step, ": Expected node ", id, " to be up on node ",
+						i, " got ", nodeInfo.Status)
+				}
+			}
+		}
+	}
+	waitTime := types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1)
+	// retry retries the keyring operation until the fingerprints of the
+	// peers' keys have reached the node
+	retry := func(op func() error) error {
+		var err error
+		for i := 0; i < 10; i++ {
+			if err = op(); err == nil {
+				break
+			}
+			time.Sleep(types.DEFAULT_GOSSIP_INTERVAL)
+		}
+		return err
+	}
+
+	// Node 0 installs the key but the broadcast is lost
+	msg := keyringMessage{Op: KEYRING_INSTALL_KEY, Key: newKey}
+	if err := gossipers[0].keyring.apply(msg); err != nil {
+		t.Fatal("Error in installing key: ", err)
+	}
+	gossipers[0].updateSelfKeyring(gossipers[0].keyring.fingerprints())
+	time.Sleep(waitTime)
+	if err := gossipers[0].UseKey(newKey); err == nil {
+		t.Fatal("Expected an error for using a key the peers do not hold")
+	}
+	if keys := gossipers[0].ListKeys(); !bytes.Equal(keys[0], oldKey) {
+		t.Fatal("Expected the primary key to be unchanged, got ", keys)
+	}
+
+	if err := gossipers[0].InstallKey(newKey); err != nil {
+		t.Fatal("Error in installing key: ", err)
+	}
+	time.Sleep(waitTime)
+	verifyKeys("InstallKey", [][]byte{oldKey, newKey})
+	verifyUp("InstallKey")
+
+	if err := retry(func() error { return gossipers[1].UseKey(newKey) }); err != nil {
+		t.Fatal("Error in using key: ", err)
+	}
+	time.Sleep(waitTime)
+	verifyKeys("UseKey", [][]byte{newKey, oldKey})
+	verifyUp("UseKey")
+
+	if err := gossipers[2].RemoveKey(newKey); err == nil {
+		t.Error("Expected an error for removing the primary key")
+	}
+	if err := retry(func() error { return gossipers[2].RemoveKey(oldKey) }); err != nil {
+		t.Fatal("Error in removing key: ", err)
+	}
+	time.Sleep(waitTime)
+	verifyKeys("RemoveKey", [][]byte{newKey})
+	verifyUp("RemoveKey")
+
+	for i := 0; i < len(nodes); i++ {
+		gossipers[i].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	}
+}
+
+func TestGossiperSharedSecretAuthentication(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9184",
+		"127.0.0.2:9185",
+		"127.0.0.3:9186",
+	}
+	secret := []byte("cluster-secret")
+
+	peers := getNodeUpdateMap(nodes)
+	gossipers := make(map[int]*GossiperImpl)
+	for i := 0; i < 2; i++ {
+		id := types.NodeId(strconv.Itoa(i))
+		g, err := newGossiperImplWithOptions(nodes[i], id, []string{nodes[0]},
+			types.GossipOptions{AuthSecret: secret})
+		if err != nil {
+			t.Fatal("Error in creating gossiper: ", err)
+		}
+		g.UpdateCluster(peers)
+		gossipers[i] = g
+	}
+	// A node with the wrong secret should not be able to join
+	g, err := newGossiperImplWithOptions(nodes[2], types.NodeId("2"),
+		[]string{nodes[0]}, types.GossipOptions{AuthSecret: []byte("wrong")})
+	if err == nil {
+		t.Error("Expected node with the wrong secret to fail joining")
+	}
+	gossipers[2] = g
+
+	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+
+	for i := 0; i < 2; i++ {
+		nodeInfoMap := gossipers[i].GetLocalState()
+		for j := 0; j < 2; j++ {
+			id := types.NodeId(strconv.Itoa(j))
+			if nodeInfoMap[id].Status != types.NODE_STATUS_UP {
+				t.Error("Expected node ", id, " to be up on node ", i,
+					" but got ", nodeInfoMap[id].Status)
+			}
+		}
+		if nodeInfoMap[types.NodeId("2")].Status == types.NODE_STATUS_UP {
+			t.Error("Node 2 with the wrong secret should not be up on node ", i)
+		}
 	}
 
 	for i := 0; i < len(nodes); i++ {
@@ -919,6 +1364,818 @@ func TestGossiperExternalNodeLeavePeerKill(t *testing.T) {
 	}
 }
 
+func TestGossiperIdentityKeyAuthentication(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9940",
+		"127.0.0.2:9941",
+		"127.0.0.3:9942",
+	}
+	peers := getNodeUpdateMap(nodes)
+	privateKeys := make(map[types.NodeId]ed25519.PrivateKey)
+	for id, update := range peers {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal("Error in generating key: ", err)
+		}
+		privateKeys[id] = privateKey
+		// Node 2's key is not pinned
+		if id != types.NodeId("2") {
+			update.PublicKey = publicKey
+		}
+		peers[id] = update
+	}
+
+	delegates := make(map[types.NodeId]*GossipDelegate)
+	for id := range peers {
+		gd := newTestGossipDelegate(id, peers, false)
+		auth, err := newNodeAuthenticator(nil, privateKeys[id])
+		if err != nil {
+			t.Fatal("Error in creating authenticator: ", err)
+		}
+		auth.updateKeys(peers)
+		gd.auth = auth
+		delegates[id] = gd
+	}
+	memberlistNode := func(name types.NodeId, gd *GossipDelegate) *ml.Node {
+		return &ml.Node{
+			Name: string(name) + types.DEFAULT_GOSSIP_VERSION,
+			Meta: gd.NodeMeta(ml.MetaMaxSize),
+		}
+	}
+
+	node0 := delegates[types.NodeId("0")]
+	node1 := types.NodeId("1")
+	if err := node0.gossipChecks(memberlistNode(node1, delegates[node1])); err != nil {
+		t.Error("Expected node 1 to be verified: ", err)
+	}
+	// Node 2 has a valid signature but its key is not pinned
+	node2 := types.NodeId("2")
+	if err := node0.gossipChecks(memberlistNode(node2, delegates[node2])); err == nil {
+		t.Error("Expected node 2 with an unpinned key to be rejected")
+	}
+	// Node 2 tries to impersonate node 1
+	if err := node0.gossipChecks(memberlistNode(node1, delegates[node2])); err == nil {
+		t.Error("Expected node 2 impersonating node 1 to be rejected")
+	}
+	// A node which does not sign its identity
+	unsigned := newTestGossipDelegate(node1, peers, false)
+	if err := node0.gossipChecks(memberlistNode(node1, unsigned)); err == nil {
+		t.Error("Expected node without an identity to be rejected")
+	}
+	if err := node0.NotifyMerge([]*ml.Node{
+		memberlistNode(node1, delegates[node1]),
+		memberlistNode(node2, delegates[node2]),
+	}); err == nil {
+		t.Error("Expected merge with an unverified node to be rejected")
+	}
+}
+
+func TestGossiperNodeMetaLimit(t *testing.T) {
+	printTestInfo()
+
+	peers := getNodeUpdateMap([]string{"127.0.0.1:9943"})
+	gd := newTestGossipDelegate(types.NodeId("0"), peers, false)
+	gd.ClusterId = strings.Repeat("c", 150)
+	node := &ml.Node{Name: "0" + types.DEFAULT_GOSSIP_VERSION}
+
+	full := gd.NodeMeta(ml.MetaMaxSize)
+	node.Meta = full
+	if err := gd.gossipChecks(node); err != nil {
+		t.Error("Expected node meta to pass the gossip checks: ", err)
+	}
+
+	// Optional fields are dropped to fit in the limit
+	limit := len(full) - 1
+	reduced := gd.NodeMeta(limit)
+	if len(reduced) == 0 || len(reduced) > limit {
+		t.Error("Expected meta of at most ", limit, " bytes, got: ",
+			len(reduced))
+	}
+	node.Meta = reduced
+	if err := gd.gossipChecks(node); err != nil {
+		t.Error("Expected reduced node meta to pass the gossip checks: ", err)
+	}
+
+	// Meta which does not fit is never truncated
+	if meta := gd.NodeMeta(100); len(meta) != 0 {
+		t.Error("Expected empty meta, got ", len(meta), " bytes")
+	}
+}
+
+func TestGossiperCompressionNegotiation(t *testing.T) {
+	printTestInfo()
+
+	peers := getNodeUpdateMap([]string{"127.0.0.1:9944", "127.0.0.2:9945"})
+	d0 := newTestGossipDelegate(types.NodeId("0"), peers, false)
+	d1 := newTestGossipDelegate(types.NodeId("1"), peers, false)
+	d0.compression = types.COMPRESSION_FLATE
+	d0.UpdateSelfStatus(types.NODE_STATUS_UP)
+	d1.UpdateSelfStatus(types.NODE_STATUS_UP)
+	d1.UpdateNodeStatus(types.NodeId("0"), types.NODE_STATUS_UP)
+	key := types.StoreKey("key")
+	value := strings.Repeat("{\"volume\": \"data\"}", 100)
+	d0.UpdateSelf(key, value)
+
+	verifyMerge := func(buf []byte) {
+		d1.MergeRemoteState(buf, false)
+		res := d1.GetStoreKeyValue(key)
+		if res[types.NodeId("0")].Value != value {
+			t.Error("Expected merged value from node 0, got: ",
+				res[types.NodeId("0")].Value)
+		}
+	}
+
+	// The peer supports compression
+	d0.updatePeerMeta(&ml.Node{
+		Name: "1" + types.DEFAULT_GOSSIP_VERSION,
+		Meta: d1.NodeMeta(ml.MetaMaxSize),
+	})
+	buf := d0.LocalState(false)
+	if len(buf) < 2 || buf[0] != compressionPrefix ||
+		types.CompressionType(buf[1]) != types.COMPRESSION_FLATE {
+		t.Error("Expected compressed local state")
+	}
+	plain, _ := d0.GetLocalStateInBytes()
+	if len(buf) >= len(plain) {
+		t.Error("Expected compressed state of ", len(buf),
+			" bytes to be smaller than ", len(plain), " bytes")
+	}
+	verifyMerge(buf)
+
+	// The state sent on join is never compressed
+	if buf := d0.LocalState(true); len(buf) > 0 && buf[0] == compressionPrefix {
+		t.Error("Expected uncompressed local state on join")
+	}
+
+	// A peer which does not advertise compression
+	meta, _ := d1.convertToBytes(d1.MetaInfo())
+	d0.updatePeerMeta(&ml.Node{
+		Name: "1" + types.DEFAULT_GOSSIP_VERSION,
+		Meta: meta,
+	})
+	d0.UpdateSelf(key, value+"new")
+	value = value + "new"
+	buf = d0.LocalState(false)
+	if len(buf) > 0 && buf[0] == compressionPrefix {
+		t.Error("Expected uncompressed local state")
+	}
+	verifyMerge(buf)
+
+	// A payload which decompresses beyond the limit is dropped
+	bomb, err := compressState(types.COMPRESSION_FLATE,
+		make([]byte, maxDecompressedStateSize+1))
+	if err != nil {
+		t.Fatal("Error in compressing state: ", err)
+	}
+	if _, err := decompressState(bomb); err == nil {
+		t.Error("Expected an error for a state exceeding the limit")
+	}
+	merges := d1.GetStats().Merges
+	d1.MergeRemoteState(bomb, false)
+	if d1.GetStats().Merges != merges {
+		t.Error("Expected the state exceeding the limit not to be merged")
+	}
+}
+
+func TestGossiperAliveNotifications(t *testing.T) {
+	printTestInfo()
+
+	peers := getNodeUpdateMap([]string{"127.0.0.1:9948", "127.0.0.2:9949"})
+	node1 := types.NodeId("1")
+	d0 := newTestGossipDelegate(types.NodeId("0"), peers, false)
+	d1 := newTestGossipDelegate(node1, peers, false)
+	d0.InitCurrentState(uint(len(peers)))
+	checkStatus := func(msg string, expected types.NodeStatus) {
+		nodeInfo, err := d0.GetLocalNodeInfo(node1)
+		if err != nil {
+			t.Fatal("Error getting node 1: ", err)
+		}
+		if nodeInfo.Status != expected {
+			t.Error(msg, ": Expected node 1 to be ", expected, ", got: ",
+				nodeInfo.Status)
+		}
+	}
+
+	// Peers relay alive messages of nodes memberlist has not joined
+	// or has declared dead
+	node := &ml.Node{
+		Name: string(node1) + types.DEFAULT_GOSSIP_VERSION,
+		Meta: d1.NodeMeta(ml.MetaMaxSize),
+	}
+	d0.UpdateNodeStatus(node1, types.NODE_STATUS_DOWN)
+	if err := d0.NotifyAlive(node); err != nil {
+		t.Fatal("Expected node 1 to be accepted, got: ", err)
+	}
+	checkStatus("Alive before join", types.NODE_STATUS_DOWN)
+
+	d0.NotifyJoin(node)
+	checkStatus("Join", types.NODE_STATUS_UP)
+
+	d0.UpdateNodeStatus(node1, types.NODE_STATUS_DOWN)
+	d0.NotifyAlive(node)
+	checkStatus("Alive after join", types.NODE_STATUS_UP)
+
+	d0.NotifyLeave(node)
+	checkStatus("Leave", types.NODE_STATUS_DOWN)
+	d0.NotifyAlive(node)
+	checkStatus("Alive after leave", types.NODE_STATUS_DOWN)
+}
+
+func TestGossiperSuppressAlive(t *testing.T) {
+	printTestInfo()
+
+	peers := getNodeUpdateMap([]string{"127.0.0.1:9950", "127.0.0.2:9951"})
+	node1 := types.NodeId("1")
+	d0 := newTestGossipDelegate(types.NodeId("0"), peers, false)
+	d1 := newTestGossipDelegate(node1, peers, false)
+	d0.InitCurrentState(uint(len(peers)))
+	d0.InjectFaults(types.GossipFaults{SuppressAlive: true})
+
+	// Peers of other clusters are still rejected
+	other := new(GossipDelegate)
+	other.InitGossipDelegate(1, types.NodeId("2"), types.DEFAULT_GOSSIP_VERSION,
+		TestQuorumTimeout, "other-cluster")
+	err := d0.NotifyAlive(&ml.Node{
+		Name: "2" + types.DEFAULT_GOSSIP_VERSION,
+		Meta: other.NodeMeta(ml.MetaMaxSize),
+	})
+	if err == nil {
+		t.Error("Expected node 2 of another cluster to be rejected")
+	}
+
+	// Nodes coming back are not marked up
+	node := &ml.Node{
+		Name: string(node1) + types.DEFAULT_GOSSIP_VERSION,
+		Meta: d1.NodeMeta(ml.MetaMaxSize),
+	}
+	d0.NotifyJoin(node)
+	d0.UpdateNodeStatus(node1, types.NODE_STATUS_DOWN)
+	if err := d0.NotifyAlive(node); err != nil {
+		t.Fatal("Expected node 1 to be accepted, got: ", err)
+	}
+	nodeInfo, _ := d0.GetLocalNodeInfo(node1)
+	if nodeInfo.Status != types.NODE_STATUS_DOWN {
+		t.Error("Expected node 1 to stay down, got: ", nodeInfo.Status)
+	}
+
+	d0.InjectFaults(types.GossipFaults{})
+	d0.NotifyAlive(node)
+	nodeInfo, _ = d0.GetLocalNodeInfo(node1)
+	if nodeInfo.Status != types.NODE_STATUS_UP {
+		t.Error("Expected node 1 to be up, got: ", nodeInfo.Status)
+	}
+}
+
+func TestGossiperMetaCache(t *testing.T) {
+	printTestInfo()
+
+	peers := getNodeUpdateMap([]string{"127.0.0.1:9946", "127.0.0.2:9947"})
+	d0 := newTestGossipDelegate(types.NodeId("0"), peers, false)
+	d1 := newTestGossipDelegate(types.NodeId("1"), peers, false)
+	cacheSize := func() int {
+		d0.metaCacheLock.Lock()
+		defer d0.metaCacheLock.Unlock()
+		return len(d0.metaCache)
+	}
+
+	node1 := &ml.Node{
+		Name: "1" + types.DEFAULT_GOSSIP_VERSION,
+		Meta: d1.NodeMeta(ml.MetaMaxSize),
+	}
+	d0.updatePeerMeta(node1)
+	if cacheSize() != 1 {
+		t.Error("Expected the meta data of node 1 to be cached")
+	}
+	d0.removePeerMeta(node1)
+	if cacheSize() != 0 {
+		t.Error("Expected the meta data of node 1 to be dropped on leave")
+	}
+
+	// A node which is rejected is not cached
+	other := new(GossipDelegate)
+	other.InitGossipDelegate(1, types.NodeId("2"), types.DEFAULT_GOSSIP_VERSION,
+		TestQuorumTimeout, "other-cluster")
+	err := d0.NotifyAlive(&ml.Node{
+		Name: "2" + types.DEFAULT_GOSSIP_VERSION,
+		Meta: other.NodeMeta(ml.MetaMaxSize),
+	})
+	if err == nil {
+		t.Error("Expected node 2 of another cluster to be rejected")
+	}
+	if cacheSize() != 0 {
+		t.Error("Expected the meta data of node 2 not to be cached")
+	}
+}
+
+// newLargeStore returns a delegate whose state has the given number of
+// nodes with json like values
+func newLargeStore(numNodes, numKeys int) *GossipDelegate {
+	gd := newTestGossipDelegate(types.NodeId("0"),
+		largeClusterPeers(numNodes), false)
+	nodeInfoMap := make(types.NodeInfoMap)
+	for i := 0; i < numNodes; i++ {
+		id := types.NodeId(strconv.Itoa(i))
+		nodeInfo := types.NodeInfo{
+			Id:           id,
+			LastUpdateTs: time.Now(),
+			Status:       types.NODE_STATUS_UP,
+			Value:        make(types.StoreMap),
+		}
+		for j := 0; j < numKeys; j++ {
+			nodeInfo.Value[types.StoreKey("key"+strconv.Itoa(j))] =
+				"{\"id\": \"" + strconv.Itoa(i*numKeys+j) +
+					"\", \"status\": \"online\", \"capacity\": 1024}"
+		}
+		nodeInfoMap[id] = nodeInfo
+	}
+	gd.Update(nodeInfoMap)
+	return gd
+}
+
+// largeClusterPeers returns the peers of a cluster with the given number
+// of nodes
+func largeClusterPeers(numNodes int) map[types.NodeId]types.NodeUpdate {
+	nodes := make([]string, numNodes)
+	for i := range nodes {
+		nodes[i] = "127.0.0.1:" + strconv.Itoa(9000+i)
+	}
+	return getNodeUpdateMap(nodes)
+}
+
+func benchmarkLocalState(b *testing.B, compression types.CompressionType) {
+	gd := newLargeStore(100, 50)
+	gd.compression = compression
+	b.ResetTimer()
+	size := 0
+	for i := 0; i < b.N; i++ {
+		size = len(gd.LocalState(false))
+	}
+	b.ReportMetric(float64(size), "bytes/state")
+}
+
+func BenchmarkLocalStateUncompressed(b *testing.B) {
+	benchmarkLocalState(b, types.COMPRESSION_NONE)
+}
+
+func BenchmarkLocalStateCompressed(b *testing.B) {
+	benchmarkLocalState(b, types.COMPRESSION_FLATE)
+}
+
+func BenchmarkMergeRemoteStateCompressed(b *testing.B) {
+	gd := newLargeStore(100, 50)
+	gd.compression = types.COMPRESSION_FLATE
+	buf := gd.LocalState(false)
+	// The receiver knows the sender's nodes so that their info is merged
+	receiver := newTestGossipDelegate(types.NodeId("1"),
+		largeClusterPeers(100), false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		receiver.MergeRemoteState(buf, false)
+	}
+}
+
+func TestGossiperVersionRange(t *testing.T) {
+	printTestInfo()
+
+	v1, v2 := types.DEFAULT_GOSSIP_VERSION, types.GOSSIP_VERSION_2
+	if err := validateVersionRange(v1, "", ""); err != nil {
+		t.Error("Unexpected error for the default range: ", err)
+	}
+	if err := validateVersionRange("custom", "", ""); err != nil {
+		t.Error("Unexpected error for an unknown version: ", err)
+	}
+	if err := validateVersionRange(v1, v2, ""); err == nil {
+		t.Error("Expected an error for a range not containing the version")
+	}
+	if err := validateVersionRange(v1, "", "v9"); err == nil {
+		t.Error("Expected an error for an unknown version in the range")
+	}
+
+	gd := newTestGossipDelegate(types.NodeId("0"), nil, false)
+	for _, test := range []struct {
+		min, max string
+		peer     types.NodeMetaInfo
+		expected bool
+	}{
+		{"", "", types.NodeMetaInfo{GossipVersion: v1}, true},
+		{"", "", types.NodeMetaInfo{GossipVersion: v2}, false},
+		{"", v2, types.NodeMetaInfo{GossipVersion: v2}, false},
+		{"", v2, types.NodeMetaInfo{GossipVersion: v2, MinGossipVersion: v1}, true},
+		{"", "", types.NodeMetaInfo{GossipVersion: v2, MinGossipVersion: v1}, false},
+		{"", v2, types.NodeMetaInfo{GossipVersion: "custom", MinGossipVersion: v1}, false},
+	} {
+		gd.minGossipVersion, gd.maxGossipVersion = test.min, test.max
+		if gd.versionCompatible(test.peer) != test.expected {
+			t.Error("Expected compatibility ", test.expected, " for range [",
+				test.min, ", ", test.max, "] and peer ", test.peer)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		"1" + v1:    "1",
+		"1" + v2:    "1",
+		"1custom":   "1custom",
+		"node" + v2: "node",
+	} {
+		if id := gd.parseMemberlistNodeName(name); id != expected {
+			t.Error("Expected node id ", expected, " for ", name, " got ", id)
+		}
+	}
+}
+
+func TestGossiperRollingUpgrade(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9187",
+		"127.0.0.2:9188",
+		"127.0.0.3:9189",
+		"127.0.0.4:9190",
+	}
+	v1, v2 := types.DEFAULT_GOSSIP_VERSION, types.GOSSIP_VERSION_2
+	peers := getNodeUpdateMap(nodes[:3])
+	gossipers := make(map[int]*GossiperImpl)
+	for i := 0; i < 3; i++ {
+		// Node 2 has been upgraded to v2
+		version := v1
+		options := types.GossipOptions{MaxGossipVersion: v2}
+		if i == 2 {
+			version = v2
+			options = types.GossipOptions{MinGossipVersion: v1}
+		}
+		g, err := newGossiperImplWithVersion(nodes[i],
+			types.NodeId(strconv.Itoa(i)), []string{nodes[0]}, version, options)
+		if err != nil {
+			t.Fatal("Error in creating gossiper: ", err)
+		}
+		g.UpdateCluster(peers)
+		gossipers[i] = g
+	}
+	// A v2 node which does not accept v1 peers cannot join
+	g, err := newGossiperImplWithVersion(nodes[3], types.NodeId("3"),
+		[]string{nodes[0]}, v2, types.GossipOptions{})
+	if err == nil {
+		t.Error("Expected v2 node without a range to fail joining")
+	}
+	gossipers[3] = g
+
+	key := types.StoreKey("key")
+	for i := 0; i < 3; i++ {
+		gossipers[i].UpdateSelf(key, strconv.Itoa(i))
+	}
+	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+
+	for i := 0; i < 3; i++ {
+		res := gossipers[i].GetStoreKeyValue(key)
+		for j := 0; j < 3; j++ {
+			id := types.NodeId(strconv.Itoa(j))
+			if res[id].Status != types.NODE_STATUS_UP ||
+				res[id].Value != strconv.Itoa(j) {
+				t.Error("Expected node ", id, " to be up with its value on node ",
+					i, " got ", res[id])
+			}
+		}
+		if len(gossipers[i].GetNodes()) != 3 {
+			t.Error("Expected 3 members on node ", i, " got ",
+				gossipers[i].GetNodes())
+		}
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		gossipers[i].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	}
+}
+
+func TestGossiperMetrics(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9191",
+		"127.0.0.2:9192",
+	}
+	peers := getNodeUpdateMap(nodes)
+	sinks := make(map[int]*metrics.InmemSink)
+	gossipers := make(map[int]*GossiperImpl)
+	for i, nodeIp := range nodes {
+		sinks[i] = metrics.NewInmemSink(time.Minute, time.Minute)
+		g, err := newGossiperImplWithOptions(nodeIp,
+			types.NodeId(strconv.Itoa(i)), []string{nodes[0]},
+			types.GossipOptions{MetricSink: sinks[i]})
+		if err != nil {
+			t.Fatal("Error in creating gossiper: ", err)
+		}
+		g.UpdateCluster(peers)
+		g.UpdateSelf("key", "value")
+		gossipers[i] = g
+	}
+	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+2))
+
+	for i, g := range gossipers {
+		stats := g.GetStats()
+		if stats.Merges == 0 || stats.BytesSent == 0 ||
+			stats.BytesReceived == 0 || stats.StateTransitions == 0 ||
+			stats.LastGossipTs.IsZero() {
+			t.Error("Expected gossip activity on node ", i, " got ", stats)
+		}
+
+		// The test can span two intervals of the sink, so the metrics
+		// of all the intervals are collected
+		emitted := make(map[string]bool)
+		gauges := make(map[string]float32)
+		for _, interval := range sinks[i].Data() {
+			interval.RLock()
+			for name := range interval.Counters {
+				emitted[name] = true
+			}
+			for name := range interval.Samples {
+				emitted[name] = true
+			}
+			for name, val := range interval.Gauges {
+				gauges[name] = val
+			}
+			interval.RUnlock()
+		}
+		for _, name := range []string{
+			"gossip.push_pull.bytes_sent",
+			"gossip.push_pull.bytes_received",
+			"gossip.push_pull.merges",
+			"gossip.state.transitions",
+			"gossip.push_pull.merge",
+		} {
+			if !emitted[name] {
+				t.Error("Expected metric ", name, " on node ", i)
+			}
+		}
+		expectedGauges := map[string]float32{
+			"gossip.state.status":      float32(types.NODE_STATUS_UP),
+			"gossip.quorum.members":    2,
+			"gossip.quorum.members_up": 2,
+			"gossip.store.nodes":       2,
+			"gossip.store.keys":        1,
+		}
+		for name, expected := range expectedGauges {
+			if val, ok := gauges[name]; !ok || val != expected {
+				t.Error("Expected gauge ", name, " to be ", expected,
+					" on node ", i, " got ", val)
+			}
+		}
+		for _, name := range []string{
+			"gossip.last_gossip_age",
+			"gossip.store.node_size",
+		} {
+			if _, ok := gauges[name]; !ok {
+				t.Error("Expected gauge ", name, " on node ", i)
+			}
+		}
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		gossipers[i].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	}
+}
+
+func TestGossiperMetricsClock(t *testing.T) {
+	printTestInfo()
+
+	n := NewSimNetwork(5)
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	g, err := n.NewGossiper("10.0.0.1:9000", types.NodeId("0"), 1,
+		simIntervals, types.DEFAULT_GOSSIP_VERSION, DEFAULT_CLUSTER_ID,
+		types.GossipOptions{MetricSink: sink})
+	if err != nil {
+		t.Fatal("Error in creating gossiper: ", err)
+	}
+	if err := g.Start(nil); err != nil {
+		t.Fatal("Error in starting gossiper: ", err)
+	}
+	gauge := func(name string) (float32, bool) {
+		for _, interval := range sink.Data() {
+			interval.RLock()
+			val, ok := interval.Gauges[name]
+			interval.RUnlock()
+			if ok {
+				return val, true
+			}
+		}
+		return 0, false
+	}
+
+	// The periodic metrics follow the virtual time
+	if _, ok := gauge("gossip.store.nodes"); ok {
+		t.Error("Expected no periodic metrics before the clock moves")
+	}
+	n.Advance(simIntervals.GossipInterval)
+	if val, ok := gauge("gossip.store.nodes"); !ok || val != 1 {
+		t.Error("Expected gauge gossip.store.nodes to be 1, got: ", val)
+	}
+	g.Stop(time.Second)
+}
+
+func TestGossiperDebugInfo(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"127.0.0.1:9194",
+		"127.0.0.2:9195",
+	}
+	peers := getNodeUpdateMap(nodes)
+	gossipers := make(map[int]*GossiperImpl)
+	for i, nodeIp := range nodes {
+		g, _ := NewGossiperImpl(nodeIp, types.NodeId(strconv.Itoa(i)),
+			[]string{nodes[0]}, types.DEFAULT_GOSSIP_VERSION)
+		g.UpdateCluster(peers)
+		gossipers[i] = g
+	}
+	time.Sleep(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+
+	info := gossipers[0].GetDebugInfo()
+	if info.NodeId != types.NodeId("0") || info.ClusterId != DEFAULT_CLUSTER_ID ||
+		info.GossipVersion != types.DEFAULT_GOSSIP_VERSION {
+		t.Error("Unexpected node identity in debug info: ", info)
+	}
+	if info.Status != types.NODE_STATUS_UP || info.State != "NODE_STATUS_UP" {
+		t.Error("Expected node to be up, got: ", info.Status, info.State)
+	}
+	if len(info.NodeInfoMap) != 2 {
+		t.Error("Expected 2 nodes in debug info, got: ", info.NodeInfoMap)
+	}
+	if len(info.Members) != 2 {
+		t.Error("Expected 2 members in debug info, got: ", info.Members)
+	}
+	for _, member := range info.Members {
+		if _, ok := peers[member.NodeId]; !ok ||
+			member.Addr == "" || member.Port == 0 ||
+			member.GossipVersion != types.DEFAULT_GOSSIP_VERSION {
+			t.Error("Unexpected member in debug info: ", member)
+		}
+	}
+	expectedQuorum := types.DebugQuorum{
+		QuorumMembers:   2,
+		QuorumMembersUp: 2,
+		QuorumNeeded:    2,
+		InQuorum:        true,
+	}
+	if info.Quorum != expectedQuorum {
+		t.Error("Expected quorum ", expectedQuorum, " got: ", info.Quorum)
+	}
+	if len(info.Transitions) == 0 {
+		t.Fatal("Expected transitions in debug info")
+	}
+	last := info.Transitions[len(info.Transitions)-1]
+	if last.To != types.NODE_STATUS_UP || last.Event == "" || last.Ts.IsZero() {
+		t.Error("Expected last transition to up, got: ", last)
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		gossipers[i].Stop(types.DEFAULT_GOSSIP_INTERVAL * time.Duration(len(nodes)+1))
+	}
+}
+
+// testLogger records the messages logged with their fields
+type testLogger struct {
+	lock     *sync.Mutex
+	fields   map[string]interface{}
+	messages *[]testLogMessage
+}
+
+type testLogMessage struct {
+	level  types.LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{
+		lock:     &sync.Mutex{},
+		fields:   make(map[string]interface{}),
+		messages: &[]testLogMessage{},
+	}
+}
+
+func (l *testLogger) WithFields(fields map[string]interface{}) types.Logger {
+	newFields := make(map[string]interface{})
+	for k, v := range l.fields {
+		newFields[k] = v
+	}
+	for k, v := range fields {
+		newFields[k] = v
+	}
+	return &testLogger{lock: l.lock, fields: newFields, messages: l.messages}
+}
+
+func (l *testLogger) log(level types.LogLevel, format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	*l.messages = append(*l.messages, testLogMessage{
+		level:  level,
+		msg:    fmt.Sprintf(format, args...),
+		fields: l.fields,
+	})
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.log(types.LOG_LEVEL_DEBUG, format, args...)
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.log(types.LOG_LEVEL_INFO, format, args...)
+}
+
+func (l *testLogger) Warnf(format string, args ...interface{}) {
+	l.log(types.LOG_LEVEL_WARN, format, args...)
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.log(types.LOG_LEVEL_ERROR, format, args...)
+}
+
+func (l *testLogger) getMessages() []testLogMessage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]testLogMessage{}, *l.messages...)
+}
+
+func TestGossiperLogger(t *testing.T) {
+	printTestInfo()
+
+	gi := types.GossipIntervals{
+		GossipInterval:   types.DEFAULT_GOSSIP_INTERVAL,
+		PushPullInterval: types.DEFAULT_PUSH_PULL_INTERVAL,
+		ProbeInterval:    types.DEFAULT_PROBE_INTERVAL,
+		ProbeTimeout:     types.DEFAULT_PROBE_TIMEOUT,
+		QuorumTimeout:    TestQuorumTimeout,
+	}
+	g := new(GossiperImpl)
+	err := g.InitWithOptions("127.0.0.1:9944", types.NodeId("0"), 1, gi,
+		types.DEFAULT_GOSSIP_VERSION, DEFAULT_CLUSTER_ID,
+		types.GossipOptions{
+			LogLevels: map[types.LogComponent]types.LogLevel{"unknown": 0},
+		})
+	if err == nil {
+		t.Error("Expected an error for an unknown log component")
+	}
+
+	logger := newTestLogger()
+	g = new(GossiperImpl)
+	err = g.InitWithOptions("127.0.0.1:9944", types.NodeId("0"), 1, gi,
+		types.DEFAULT_GOSSIP_VERSION, DEFAULT_CLUSTER_ID,
+		types.GossipOptions{
+			Logger: logger,
+			LogLevels: map[types.LogComponent]types.LogLevel{
+				types.LOG_COMPONENT_STORE:      types.LOG_LEVEL_WARN,
+				types.LOG_COMPONENT_MEMBERLIST: types.LOG_LEVEL_DEBUG,
+			},
+		})
+	if err != nil {
+		t.Fatal("Error in initializing gossiper: ", err)
+	}
+
+	// Store messages below WARN are dropped
+	g.AddNode(types.NodeId("1"), types.NODE_STATUS_UP, true)
+	fmt.Fprintf(g.mlConf.LogOutput,
+		"2017/01/02 15:04:05 [DEBUG] memberlist: Initiating push/pull sync\n")
+	fmt.Fprintf(g.mlConf.LogOutput,
+		"2017/01/02 15:04:05 [ERR] memberlist: Failed to send ping\n")
+	g.ExternalNodeLeave(types.NodeId("1"))
+
+	messages := logger.getMessages()
+	expected := []testLogMessage{
+		{types.LOG_LEVEL_DEBUG, "memberlist: Initiating push/pull sync", nil},
+		{types.LOG_LEVEL_ERROR, "memberlist: Failed to send ping", nil},
+	}
+	components := []types.LogComponent{
+		types.LOG_COMPONENT_MEMBERLIST,
+		types.LOG_COMPONENT_MEMBERLIST,
+	}
+	if len(messages) < len(expected) {
+		t.Fatal("Expected at least ", len(expected), " messages, got: ",
+			messages)
+	}
+	for i, e := range expected {
+		m := messages[i]
+		if m.level != e.level || m.msg != e.msg {
+			t.Error("Expected message ", e, " got: ", m)
+		}
+		if m.fields["component"] != string(components[i]) ||
+			m.fields["node_id"] != "0" ||
+			m.fields["cluster_id"] != DEFAULT_CLUSTER_ID {
+			t.Error("Unexpected fields of message ", m)
+		}
+	}
+	quorumMessages := 0
+	for _, m := range messages[len(expected):] {
+		if m.fields["component"] != string(types.LOG_COMPONENT_QUORUM) {
+			t.Error("Unexpected message ", m)
+		}
+		quorumMessages++
+	}
+	if quorumMessages == 0 {
+		t.Error("Expected quorum messages for the node leave")
+	}
+}
+
 func TestGossiperNodesWithDifferentClusterId(t *testing.T) {
 	printTestInfo()
 
@@ -938,9 +2195,9 @@ func TestGossiperNodesWithDifferentClusterId(t *testing.T) {
 	for i, ip := range nodes {
 		nodeId := types.NodeId(strconv.FormatInt(int64(i), 10))
 		if i == 2 || i == 4 {
-			peers2[nodeId] = types.NodeUpdate{ip, true}
+			peers2[nodeId] = types.NodeUpdate{Addr: ip, QuorumMember: true}
 		} else {
-			peers1[nodeId] = types.NodeUpdate{ip, true}
+			peers1[nodeId] = types.NodeUpdate{Addr: ip, QuorumMember: true}
 		}
 	}
 
@@ -1000,3 +2257,209 @@ func TestGossiperNodesWithDifferentClusterId(t *testing.T) {
 	}
 
 }
+
+func TestGossiperFaultInjection(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"10.0.0.1:9000",
+		"10.0.0.2:9000",
+		"10.0.0.3:9000",
+	}
+	n := NewSimNetwork(3)
+	gossipers := startSimNodes(t, n, nodes)
+	n.Advance(5 * time.Second)
+	checkSimStatus(t, gossipers, types.NODE_STATUS_UP)
+
+	checkValue := func(
+		g *GossiperImpl,
+		key types.StoreKey,
+		expected interface{},
+	) {
+		values := g.GetStoreKeyValue(key)
+		if value := values[types.NodeId("0")].Value; value != expected {
+			t.Error("Expected value ", expected, " for ", key,
+				" on node ", g.NodeId(), ", got: ", value)
+		}
+	}
+
+	// Peers do not get our updates while our push/pulls are dropped
+	gossipers[0].InjectFaults(types.GossipFaults{DropPushPull: true})
+	gossipers[0].UpdateSelf("drop", "value")
+	n.Advance(10 * time.Second)
+	checkValue(gossipers[1], "drop", nil)
+	gossipers[0].InjectFaults(types.GossipFaults{})
+	n.Advance(10 * time.Second)
+	checkValue(gossipers[1], "drop", "value")
+
+	// Corrupted states are not merged
+	gossipers[1].InjectFaults(types.GossipFaults{CorruptMergeState: true})
+	gossipers[0].UpdateSelf("corrupt", "value")
+	n.Advance(10 * time.Second)
+	checkValue(gossipers[1], "corrupt", nil)
+	checkValue(gossipers[2], "corrupt", "value")
+	gossipers[1].InjectFaults(types.GossipFaults{})
+
+	// Delayed states are merged once the delay elapses
+	gossipers[1].InjectFaults(types.GossipFaults{MergeDelay: time.Minute})
+	gossipers[2].InjectFaults(types.GossipFaults{DropPushPull: true})
+	gossipers[0].UpdateSelf("delay", "value")
+	n.Advance(30 * time.Second)
+	checkValue(gossipers[1], "delay", nil)
+	gossipers[1].InjectFaults(types.GossipFaults{})
+	n.Advance(time.Minute)
+	checkValue(gossipers[1], "delay", "value")
+	gossipers[2].InjectFaults(types.GossipFaults{})
+
+	// A frozen state handler holds the state events until unfrozen
+	gossipers[2].InjectFaults(types.GossipFaults{FreezeStateHandler: true})
+	if faults := gossipers[2].GetDebugInfo().Faults; !faults.FreezeStateHandler {
+		t.Error("Expected the injected faults in the debug info, got: ", faults)
+	}
+	n.Partition(nodes[:2], nodes[2:])
+	n.Advance(30 * time.Second)
+	checkSimStatus(t, gossipers[2:], types.NODE_STATUS_UP)
+	gossipers[2].InjectFaults(types.GossipFaults{})
+	checkSimStatus(t, gossipers[2:], types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM)
+
+	// Nodes coming back are not marked up while alive notifications
+	// are suppressed
+	gossipers[0].InjectFaults(types.GossipFaults{SuppressAlive: true})
+	n.Heal()
+	n.Advance(30 * time.Second)
+	nodeInfo, _ := gossipers[0].GetLocalNodeInfo(types.NodeId("2"))
+	if nodeInfo.Status != types.NODE_STATUS_DOWN {
+		t.Error("Expected node 2 to be down on node 0, got: ", nodeInfo.Status)
+	}
+	nodeInfo, _ = gossipers[1].GetLocalNodeInfo(types.NodeId("2"))
+	if nodeInfo.Status != types.NODE_STATUS_UP {
+		t.Error("Expected node 2 to be up on node 1, got: ", nodeInfo.Status)
+	}
+	gossipers[0].InjectFaults(types.GossipFaults{})
+	n.Advance(30 * time.Second)
+	checkSimStatus(t, gossipers, types.NODE_STATUS_UP)
+
+	for _, g := range gossipers {
+		g.Stop(time.Second)
+	}
+}
+
+func TestGossiperWaitForConvergence(t *testing.T) {
+	printTestInfo()
+
+	nodes := []string{
+		"10.0.0.1:9000",
+		"10.0.0.2:9000",
+		"10.0.0.3:9000",
+	}
+	n := NewSimNetwork(4)
+	gossipers := startSimNodes(t, n, nodes)
+	n.Advance(5 * time.Second)
+	checkSimStatus(t, gossipers, types.NODE_STATUS_UP)
+
+	g := gossipers[0]
+	key := types.StoreKey("key")
+	if err := g.WaitForConvergence(context.Background(), key); err == nil {
+		t.Error("Expected an error for a key which is not set")
+	}
+	g.UpdateSelf(key, "value1")
+	version, _ := g.GetKeyVersion(key)
+	acks, _ := g.GetAcknowledgements(key, version)
+	for id, ack := range acks {
+		if ack.Acked {
+			t.Error("Expected node ", id, " not to have acked yet")
+		}
+	}
+	n.Advance(10 * time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	if err := g.WaitForConvergence(ctx, key); err != nil {
+		t.Error("Expected the update to converge: ", err)
+	}
+	cancel()
+
+	// Peers which we see down are not waited for
+	n.Partition(nodes[:2], nodes[2:])
+	n.Advance(30 * time.Second)
+	g.UpdateSelf(key, "value2")
+	n.Advance(10 * time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	if err := g.WaitForConvergence(ctx, key); err != nil {
+		t.Error("Expected the update to converge on the up peers: ", err)
+	}
+	cancel()
+	version, _ = g.GetKeyVersion(key)
+	acks, _ = g.GetAcknowledgements(key, version)
+	if acks["2"].Acked || acks["2"].Status != types.NODE_STATUS_DOWN {
+		t.Error("Expected node 2 to be down without acking, got: ",
+			acks["2"])
+	}
+
+	// Waiting ends with the context when the update does not spread
+	n.Heal()
+	n.Advance(30 * time.Second)
+	g.InjectFaults(types.GossipFaults{DropPushPull: true})
+	g.UpdateSelf(key, "value3")
+	n.Advance(10 * time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	if err := g.WaitForConvergence(ctx, key); err != context.DeadlineExceeded {
+		t.Error("Expected the wait to time out, got: ", err)
+	}
+	cancel()
+
+	// The acknowledgements are checked as the node's clock moves
+	g.InjectFaults(types.GossipFaults{})
+	done := make(chan error, 1)
+	go func() {
+		done <- g.WaitForConvergence(context.Background(), key)
+	}()
+	n.Advance(10 * time.Second)
+	waiting := true
+	for i := 0; i < 10 && waiting; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error("Expected the update to converge: ", err)
+			}
+			waiting = false
+		case <-time.After(100 * time.Millisecond):
+			// The wait might have started polling after the clock moved
+			n.Advance(simIntervals.GossipInterval)
+		}
+	}
+	if waiting {
+		t.Error("Expected the wait to end as the clock moved")
+	}
+
+	// Peers which we see in maintenance are waited for
+	gossipers[2].UpdateSelfMaintenance(true)
+	n.Advance(10 * time.Second)
+	gossipers[2].InjectFaults(types.GossipFaults{CorruptMergeState: true})
+	g.UpdateSelf(key, "value4")
+	n.Advance(10 * time.Second)
+	version, _ = g.GetKeyVersion(key)
+	acks, _ = g.GetAcknowledgements(key, version)
+	if acks["2"].Acked || acks["2"].Status != types.NODE_STATUS_MAINTENANCE {
+		t.Error("Expected node 2 to be in maintenance without acking, got: ",
+			acks["2"])
+	}
+	ctx, cancel = context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	if err := g.WaitForConvergence(ctx, key); err != context.DeadlineExceeded {
+		t.Error("Expected the wait for the peer in maintenance to time out, "+
+			"got: ", err)
+	}
+	cancel()
+	gossipers[2].InjectFaults(types.GossipFaults{})
+	n.Advance(10 * time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	if err := g.WaitForConvergence(ctx, key); err != nil {
+		t.Error("Expected the update to converge on the peer in "+
+			"maintenance: ", err)
+	}
+	cancel()
+
+	for _, g := range gossipers {
+		g.Stop(time.Second)
+	}
+}
@@ -0,0 +1,99 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libopenstorage/gossip/types"
+)
+
+// gossipVersionIndex returns the position of the version in the
+// ordered list of known versions or -1 if the version is unknown
+func gossipVersionIndex(version string) int {
+	for i, v := range types.GOSSIP_VERSIONS {
+		if v == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// versionInRange returns true if the version lies in the range.
+// Unknown versions are only in a range which they bound.
+func versionInRange(version, minVersion, maxVersion string) bool {
+	index := gossipVersionIndex(version)
+	minIndex := gossipVersionIndex(minVersion)
+	maxIndex := gossipVersionIndex(maxVersion)
+	if index >= 0 && minIndex >= 0 && maxIndex >= 0 {
+		return minIndex <= index && index <= maxIndex
+	}
+	return version == minVersion || version == maxVersion
+}
+
+// versionRange returns the range of accepted versions advertised in the
+// meta data. Nodes which do not advertise a range only accept their
+// own version.
+func versionRange(nodeMeta types.NodeMetaInfo) (string, string) {
+	minVersion, maxVersion := nodeMeta.MinGossipVersion, nodeMeta.MaxGossipVersion
+	if minVersion == "" {
+		minVersion = nodeMeta.GossipVersion
+	}
+	if maxVersion == "" {
+		maxVersion = nodeMeta.GossipVersion
+	}
+	return minVersion, maxVersion
+}
+
+// validateVersionRange checks that the version range contains the
+// node's own version
+func validateVersionRange(version, minVersion, maxVersion string) error {
+	for _, v := range []string{minVersion, maxVersion} {
+		if v != "" && v != version && gossipVersionIndex(v) < 0 {
+			return fmt.Errorf("gossip: Unknown gossip version %v", v)
+		}
+	}
+	if minVersion == "" {
+		minVersion = version
+	}
+	if maxVersion == "" {
+		maxVersion = version
+	}
+	if !versionInRange(version, minVersion, maxVersion) {
+		return fmt.Errorf("gossip: Gossip version %v is not in the "+
+			"range [%v, %v]", version, minVersion, maxVersion)
+	}
+	return nil
+}
+
+// versionCompatible returns true if the peer's version is in our range
+// and our version is in the peer's range
+func (gd *GossipDelegate) versionCompatible(nodeMeta types.NodeMetaInfo) bool {
+	minVersion, maxVersion := versionRange(gd.versionMetaInfo())
+	peerMinVersion, peerMaxVersion := versionRange(nodeMeta)
+	return versionInRange(nodeMeta.GossipVersion, minVersion, maxVersion) &&
+		versionInRange(gd.GetGossipVersion(), peerMinVersion, peerMaxVersion)
+}
+
+// versionMetaInfo returns the meta data describing our versions
+func (gd *GossipDelegate) versionMetaInfo() types.NodeMetaInfo {
+	return types.NodeMetaInfo{
+		GossipVersion:    gd.GetGossipVersion(),
+		MinGossipVersion: gd.minGossipVersion,
+		MaxGossipVersion: gd.maxGossipVersion,
+	}
+}
+
+// parseMemberlistNodeName returns the node id from the memberlist name.
+// Memberlist names are suffixed with the node's gossip version which can
+// differ from ours in a mixed version cluster.
+func (gd *GossipDelegate) parseMemberlistNodeName(nodeName string) string {
+	if strings.HasSuffix(nodeName, gd.GetGossipVersion()) {
+		return strings.TrimSuffix(nodeName, gd.GetGossipVersion())
+	}
+	for _, version := range types.GOSSIP_VERSIONS {
+		if strings.HasSuffix(nodeName, version) {
+			return strings.TrimSuffix(nodeName, version)
+		}
+	}
+	return nodeName
+}
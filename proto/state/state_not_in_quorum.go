@@ -36,7 +36,7 @@ func (niq *notInQuorum) NodeStatus() types.NodeStatus {
 
 func (niq *notInQuorum) SelfAlive(localNodeInfoMap types.NodeInfoMap) (State, error) {
 	quorum := (niq.numQuorumMembers / 2) + 1
-	upNodes := numQuorumMembersUp(localNodeInfoMap)
+	upNodes := NumQuorumMembersUp(localNodeInfoMap)
 	if upNodes < quorum {
 		return niq, nil
 	} else {
@@ -47,7 +47,7 @@ func (niq *notInQuorum) SelfAlive(localNodeInfoMap types.NodeInfoMap) (State, er
 
 func (niq *notInQuorum) NodeAlive(localNodeInfoMap types.NodeInfoMap) (State, error) {
 	quorum := (niq.numQuorumMembers / 2) + 1
-	upNodes := numQuorumMembersUp(localNodeInfoMap)
+	upNodes := NumQuorumMembersUp(localNodeInfoMap)
 	if upNodes < quorum {
 		return niq, nil
 	} else {
@@ -73,7 +73,7 @@ func (niq *notInQuorum) UpdateClusterSize(
 ) (State, error) {
 	niq.numQuorumMembers = numQuorumMembers
 	quorum := (niq.numQuorumMembers / 2) + 1
-	upNodes := numQuorumMembersUp(localNodeInfoMap)
+	upNodes := NumQuorumMembersUp(localNodeInfoMap)
 	if upNodes < quorum {
 		return niq, nil
 	} else {
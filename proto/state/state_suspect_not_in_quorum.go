@@ -40,7 +40,7 @@ func (siq *suspectNotInQuorum) SelfAlive(localNodeInfoMap types.NodeInfoMap) (St
 
 func (siq *suspectNotInQuorum) NodeAlive(localNodeInfoMap types.NodeInfoMap) (State, error) {
 	quorum := (siq.numQuorumMembers / 2) + 1
-	upNodes := numQuorumMembersUp(localNodeInfoMap)
+	upNodes := NumQuorumMembersUp(localNodeInfoMap)
 	if upNodes < quorum {
 		return siq, nil
 	} else {
@@ -66,7 +66,7 @@ func (siq *suspectNotInQuorum) UpdateClusterSize(
 ) (State, error) {
 	siq.numQuorumMembers = numQuorumMembers
 	quorum := (siq.numQuorumMembers / 2) + 1
-	upNodes := numQuorumMembersUp(localNodeInfoMap)
+	upNodes := NumQuorumMembersUp(localNodeInfoMap)
 	if upNodes < quorum {
 		return siq, nil
 	} else {
@@ -81,7 +81,7 @@ func (siq *suspectNotInQuorum) Timeout(
 ) (State, error) {
 	siq.numQuorumMembers = numQuorumMembers
 	quorum := (siq.numQuorumMembers / 2) + 1
-	upNodes := numQuorumMembersUp(localNodeInfoMap)
+	upNodes := NumQuorumMembersUp(localNodeInfoMap)
 	if upNodes < quorum {
 		notInQuorum := GetNotInQuorum(siq.numQuorumMembers, siq.id, siq.stateEvent)
 		return notInQuorum, nil
@@ -45,13 +45,15 @@ func (u *up) SelfLeave() (State, error) {
 	return down, nil
 }
 
-func numQuorumMembersUp(localNodeInfoMap types.NodeInfoMap) uint {
+// NumQuorumMembersUp returns the number of quorum members which are alive
+func NumQuorumMembersUp(localNodeInfoMap types.NodeInfoMap) uint {
 	upNodes := uint(0)
 	for _, nodeInfo := range localNodeInfoMap {
 		if nodeInfo.QuorumMember &&
 			(nodeInfo.Status == types.NODE_STATUS_UP ||
 				nodeInfo.Status == types.NODE_STATUS_NOT_IN_QUORUM ||
-				nodeInfo.Status == types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM) {
+				nodeInfo.Status == types.NODE_STATUS_SUSPECT_NOT_IN_QUORUM ||
+				nodeInfo.Status == types.NODE_STATUS_MAINTENANCE) {
 			upNodes++
 		}
 	}
@@ -60,7 +62,7 @@ func numQuorumMembersUp(localNodeInfoMap types.NodeInfoMap) uint {
 
 func (u *up) NodeLeave(localNodeInfoMap types.NodeInfoMap) (State, error) {
 	quorum := (u.numQuorumMembers / 2) + 1
-	upNodes := numQuorumMembersUp(localNodeInfoMap)
+	upNodes := NumQuorumMembersUp(localNodeInfoMap)
 	if upNodes < quorum {
 		// Caller of this function should start a timer
 		return GetSuspectNotInQuorum(u.numQuorumMembers, u.id, u.stateEvent), nil
@@ -75,7 +77,7 @@ func (u *up) UpdateClusterSize(
 ) (State, error) {
 	u.numQuorumMembers = numQuorumMembers
 	quorum := (u.numQuorumMembers / 2) + 1
-	upNodes := numQuorumMembersUp(localNodeInfoMap)
+	upNodes := NumQuorumMembersUp(localNodeInfoMap)
 	if upNodes < quorum {
 		// Caller of this function should start a timer
 		return GetSuspectNotInQuorum(u.numQuorumMembers, u.id, u.stateEvent), nil
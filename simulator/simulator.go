@@ -0,0 +1,445 @@
+// Package simulator runs a gossip cluster on a simulated network to
+// measure how fast updates and failures spread with given intervals.
+//
+// All the gossipers run in-process on a proto.SimNetwork and the time
+// is virtual, so a run with hundreds of nodes over minutes of gossip
+// takes seconds and replays the same way for the same seed.
+package simulator
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/libopenstorage/gossip/proto"
+	"github.com/libopenstorage/gossip/types"
+)
+
+// Config describes a simulation
+type Config struct {
+	// Nodes is the number of gossipers. They are all quorum members.
+	Nodes int
+	// Intervals are the intervals of all the gossipers. Unset
+	// intervals take their default values.
+	Intervals types.GossipIntervals
+	// Updates is the number of key updates, each made by a random
+	// live node
+	Updates int
+	// Failures is the number of nodes which crash
+	Failures int
+	// EventInterval is the time between the injected updates and
+	// failures. It defaults to the push/pull interval.
+	EventInterval time.Duration
+	// Timeout is the time after which an update or a failure which did
+	// not reach all the live nodes is reported as not converged. It
+	// defaults to 5 minutes.
+	Timeout time.Duration
+	// DropRate is the probability with which a packet is dropped
+	DropRate float64
+	// Delay is the delay of the packets
+	Delay time.Duration
+	// Seed seeds all the randomness of the simulation
+	Seed int64
+	// Options are the options of the gossipers. The gossipers only log
+	// errors unless the options set the log levels.
+	Options types.GossipOptions
+}
+
+// Distribution summarizes the times taken by updates or failures to
+// reach all the live nodes
+type Distribution struct {
+	// Count is the number of updates or failures which converged
+	Count int
+	// Unconverged is the number of them which timed out
+	Unconverged int
+	Min         time.Duration
+	Mean        time.Duration
+	P50         time.Duration
+	P90         time.Duration
+	P99         time.Duration
+	Max         time.Duration
+}
+
+// Report is the result of a simulation. The times are measured with
+// the resolution of the gossip interval.
+type Report struct {
+	Nodes int
+	// StartupTime is the time taken by all the nodes to see each other up
+	StartupTime time.Duration
+	// Duration is the simulated time after the startup
+	Duration time.Duration
+	// Convergence is the time taken by an update to reach all the
+	// live nodes
+	Convergence Distribution
+	// Detection is the time taken by all the live nodes to see a
+	// crashed node DOWN
+	Detection Distribution
+	// BytesSent and BytesReceived are the push/pull bytes exchanged by
+	// all the nodes after the startup
+	BytesSent     uint64
+	BytesReceived uint64
+	// FalseDown is the number of times a live node saw another live
+	// node go DOWN
+	FalseDown int
+}
+
+// tracked is an update or a failure followed until it reaches all
+// the live nodes
+type tracked struct {
+	node     int
+	key      types.StoreKey
+	start    time.Time
+	done     bool
+	duration time.Duration
+}
+
+type simulation struct {
+	conf      Config
+	net       *proto.SimNetwork
+	rand      *rand.Rand
+	addrs     []string
+	gossipers []*proto.GossiperImpl
+	crashed   map[int]bool
+	seenDown  map[[2]int]bool
+	updates   []*tracked
+	failures  []*tracked
+	falseDown int
+}
+
+// Run runs the simulation described by the config
+func Run(conf Config) (*Report, error) {
+	if err := setDefaults(&conf); err != nil {
+		return nil, err
+	}
+	s := &simulation{
+		conf:     conf,
+		net:      proto.NewSimNetwork(conf.Seed),
+		rand:     rand.New(rand.NewSource(conf.Seed)),
+		crashed:  make(map[int]bool),
+		seenDown: make(map[[2]int]bool),
+	}
+	defer s.stop()
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{Nodes: conf.Nodes}
+	startupTs := s.net.Now()
+	for !s.allUp() {
+		if s.net.Now().Sub(startupTs) > conf.Timeout {
+			return nil, fmt.Errorf("nodes did not see each other up "+
+				"within %v", conf.Timeout)
+		}
+		s.net.Advance(conf.Intervals.GossipInterval)
+	}
+	report.StartupTime = s.net.Now().Sub(startupTs)
+
+	sent, received := s.bytes()
+	s.net.SetDropRate(conf.DropRate)
+	s.net.SetDelay(conf.Delay)
+	runTs := s.net.Now()
+	for _, crash := range s.schedule() {
+		if crash {
+			s.crash()
+		} else {
+			s.update()
+		}
+		s.advance(conf.EventInterval)
+	}
+	for s.pending() {
+		s.advance(conf.Intervals.GossipInterval)
+	}
+	report.Duration = s.net.Now().Sub(runTs)
+
+	report.Convergence = summarize(s.updates)
+	report.Detection = summarize(s.failures)
+	report.BytesSent, report.BytesReceived = s.bytes()
+	report.BytesSent -= sent
+	report.BytesReceived -= received
+	report.FalseDown = s.falseDown
+	return report, nil
+}
+
+func setDefaults(conf *Config) error {
+	if conf.Nodes < 1 {
+		return fmt.Errorf("at least one node is needed, got %v", conf.Nodes)
+	}
+	if conf.Failures >= conf.Nodes {
+		return fmt.Errorf("%v failures would crash all the %v nodes",
+			conf.Failures, conf.Nodes)
+	}
+	intervals := &conf.Intervals
+	if intervals.GossipInterval == 0 {
+		intervals.GossipInterval = types.DEFAULT_GOSSIP_INTERVAL
+	}
+	if intervals.PushPullInterval == 0 {
+		intervals.PushPullInterval = types.DEFAULT_PUSH_PULL_INTERVAL
+	}
+	if intervals.ProbeInterval == 0 {
+		intervals.ProbeInterval = types.DEFAULT_PROBE_INTERVAL
+	}
+	if intervals.ProbeTimeout == 0 {
+		intervals.ProbeTimeout = types.DEFAULT_PROBE_TIMEOUT
+	}
+	if intervals.QuorumTimeout == 0 {
+		intervals.QuorumTimeout = types.DEFAULT_QUORUM_TIMEOUT
+	}
+	if conf.EventInterval == 0 {
+		conf.EventInterval = intervals.PushPullInterval
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = 5 * time.Minute
+	}
+	if conf.Options.LogLevels == nil {
+		conf.Options.LogLevels = make(map[types.LogComponent]types.LogLevel)
+		for _, component := range types.LOG_COMPONENTS {
+			conf.Options.LogLevels[component] = types.LOG_LEVEL_ERROR
+		}
+	}
+	return nil
+}
+
+// nodeAddr returns the address of the i-th node
+func nodeAddr(i int) string {
+	n := i + 1
+	return fmt.Sprintf("10.%d.%d.%d:9000", n>>16&0xff, n>>8&0xff, n&0xff)
+}
+
+// start starts all the gossipers. They join the first node.
+func (s *simulation) start() error {
+	peers := make(map[types.NodeId]types.NodeUpdate)
+	for i := 0; i < s.conf.Nodes; i++ {
+		s.addrs = append(s.addrs, nodeAddr(i))
+		peers[nodeId(i)] = types.NodeUpdate{
+			Addr:         s.addrs[i],
+			QuorumMember: true,
+		}
+	}
+	for i, addr := range s.addrs {
+		g, err := s.net.NewGossiper(addr, nodeId(i), 1, s.conf.Intervals,
+			types.DEFAULT_GOSSIP_VERSION, "simulator", s.conf.Options)
+		if err != nil {
+			return err
+		}
+		s.gossipers = append(s.gossipers, g)
+		var knownIps []string
+		if i != 0 {
+			knownIps = []string{s.addrs[0]}
+		}
+		if err := g.Start(knownIps); err != nil {
+			return err
+		}
+		g.UpdateCluster(peers)
+	}
+	return nil
+}
+
+func (s *simulation) stop() {
+	for _, g := range s.gossipers {
+		g.Stop(0)
+	}
+}
+
+func nodeId(i int) types.NodeId {
+	return types.NodeId(strconv.Itoa(i))
+}
+
+// schedule returns the order of the injected events. An event is a
+// crash if true and an update otherwise.
+func (s *simulation) schedule() []bool {
+	events := make([]bool, s.conf.Updates+s.conf.Failures)
+	for i := 0; i < s.conf.Failures; i++ {
+		events[i] = true
+	}
+	s.rand.Shuffle(len(events), func(i, j int) {
+		events[i], events[j] = events[j], events[i]
+	})
+	return events
+}
+
+// live returns the nodes which have not crashed
+func (s *simulation) live() []int {
+	var nodes []int
+	for i := range s.gossipers {
+		if !s.crashed[i] {
+			nodes = append(nodes, i)
+		}
+	}
+	return nodes
+}
+
+// update sets a new key on a random live node
+func (s *simulation) update() {
+	live := s.live()
+	node := live[s.rand.Intn(len(live))]
+	key := types.StoreKey("sim-" + strconv.Itoa(len(s.updates)))
+	s.gossipers[node].UpdateSelf(key, len(s.updates))
+	s.updates = append(s.updates, &tracked{
+		node:  node,
+		key:   key,
+		start: s.net.Now(),
+	})
+}
+
+// crash cuts a random live node off the network
+func (s *simulation) crash() {
+	live := s.live()
+	node := live[s.rand.Intn(len(live))]
+	var others []string
+	for i, addr := range s.addrs {
+		if i != node {
+			others = append(others, addr)
+		}
+	}
+	s.net.Partition([]string{s.addrs[node]}, others)
+	s.crashed[node] = true
+	s.failures = append(s.failures, &tracked{
+		node:  node,
+		start: s.net.Now(),
+	})
+}
+
+// advance moves the time forward by d one gossip interval at a time,
+// checking the progress of the updates and the failures after each
+func (s *simulation) advance(d time.Duration) {
+	step := s.conf.Intervals.GossipInterval
+	for end := s.net.Now().Add(d); s.net.Now().Before(end); {
+		if remaining := end.Sub(s.net.Now()); remaining < step {
+			step = remaining
+		}
+		s.net.Advance(step)
+		s.check()
+	}
+}
+
+// pending returns true if an update or a failure is still followed
+func (s *simulation) pending() bool {
+	for _, t := range append(s.updates, s.failures...) {
+		if !t.done {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *simulation) check() {
+	now := s.net.Now()
+	live := s.live()
+	for _, t := range s.updates {
+		s.checkTracked(t, now, live, func(info types.NodeInfo) bool {
+			return info.Value[t.key] != nil
+		})
+	}
+	for _, t := range s.failures {
+		s.checkTracked(t, now, live, func(info types.NodeInfo) bool {
+			return info.Status == types.NODE_STATUS_DOWN
+		})
+	}
+
+	for _, observer := range live {
+		for _, target := range live {
+			if observer == target {
+				continue
+			}
+			info, err := s.gossipers[observer].GetLocalNodeInfo(
+				nodeId(target))
+			down := err == nil && info.Status == types.NODE_STATUS_DOWN
+			pair := [2]int{observer, target}
+			if down && !s.seenDown[pair] {
+				s.falseDown++
+			}
+			s.seenDown[pair] = down
+		}
+	}
+}
+
+// checkTracked marks the update or the failure done once all the live
+// nodes see the tracked node in the expected way
+func (s *simulation) checkTracked(
+	t *tracked,
+	now time.Time,
+	live []int,
+	seen func(info types.NodeInfo) bool,
+) {
+	if t.done {
+		return
+	}
+	if now.Sub(t.start) > s.conf.Timeout {
+		t.done = true
+		t.duration = -1
+		return
+	}
+	for _, observer := range live {
+		if observer == t.node {
+			continue
+		}
+		info, err := s.gossipers[observer].GetLocalNodeInfo(nodeId(t.node))
+		if err != nil || !seen(info) {
+			return
+		}
+	}
+	t.done = true
+	t.duration = now.Sub(t.start)
+}
+
+// allUp returns true if all the nodes see each other up
+func (s *simulation) allUp() bool {
+	for _, g := range s.gossipers {
+		if g.GetSelfStatus() != types.NODE_STATUS_UP {
+			return false
+		}
+		for i := range s.gossipers {
+			info, err := g.GetLocalNodeInfo(nodeId(i))
+			if err != nil || info.Status != types.NODE_STATUS_UP {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// bytes returns the push/pull bytes sent and received by all the nodes
+func (s *simulation) bytes() (uint64, uint64) {
+	var sent, received uint64
+	for _, g := range s.gossipers {
+		stats := g.GetStats()
+		sent += stats.BytesSent
+		received += stats.BytesReceived
+	}
+	return sent, received
+}
+
+// summarize returns the distribution of the times taken by the
+// updates or the failures. Timed out ones have a negative duration.
+func summarize(events []*tracked) Distribution {
+	var d Distribution
+	var durations []time.Duration
+	var total time.Duration
+	for _, t := range events {
+		if t.duration < 0 {
+			d.Unconverged++
+			continue
+		}
+		durations = append(durations, t.duration)
+		total += t.duration
+	}
+	d.Count = len(durations)
+	if d.Count == 0 {
+		return d
+	}
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	percentile := func(p int) time.Duration {
+		return durations[(len(durations)-1)*p/100]
+	}
+	d.Min = durations[0]
+	d.Mean = total / time.Duration(d.Count)
+	d.P50 = percentile(50)
+	d.P90 = percentile(90)
+	d.P99 = percentile(99)
+	d.Max = durations[len(durations)-1]
+	return d
+}
@@ -0,0 +1,44 @@
+package simulator
+
+import (
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		report, err := Run(Config{
+			Nodes:    10,
+			Updates:  3,
+			Failures: 1,
+			Seed:     seed,
+		})
+		if err != nil {
+			t.Fatal("Error in running the simulation: ", err)
+		}
+		if report.Nodes != 10 {
+			t.Error("Expected 10 nodes, got ", report.Nodes)
+		}
+		if report.Convergence.Count != 3 ||
+			report.Convergence.Unconverged != 0 {
+			t.Error("Expected all the 3 updates to converge with seed ",
+				seed, " got ", report.Convergence)
+		}
+		if report.Detection.Count != 1 || report.Detection.Unconverged != 0 {
+			t.Error("Expected the failure to be detected with seed ", seed,
+				" got ", report.Detection)
+		}
+		if report.FalseDown != 0 {
+			t.Error("Expected no live node to be seen down with seed ", seed,
+				" got ", report.FalseDown)
+		}
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	if _, err := Run(Config{Nodes: 0}); err == nil {
+		t.Error("Expected an error for no nodes")
+	}
+	if _, err := Run(Config{Nodes: 2, Failures: 2}); err == nil {
+		t.Error("Expected an error for failing all the nodes")
+	}
+}
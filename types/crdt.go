@@ -0,0 +1,248 @@
+package types
+
+import (
+	"encoding/gob"
+	"math"
+	"sort"
+	"time"
+)
+
+// The CRDT types are gossiped as values of a StoreMap
+func init() {
+	gob.Register(GCounter{})
+	gob.Register(PNCounter{})
+	gob.Register(ORSet{})
+	gob.Register(LWWRegister{})
+}
+
+// GCounter is a grow-only counter. Every node only increments its own
+// count in its current generation and the value of the counter is the
+// sum of the counts. The counts of the earlier generations of a node
+// are kept, so they are not lost when the node restarts.
+type GCounter map[NodeId]map[uint64]uint64
+
+// Value returns the sum of the counts. It saturates at MaxUint64.
+func (c GCounter) Value() uint64 {
+	var sum uint64
+	for _, counts := range c {
+		for _, count := range counts {
+			if count > math.MaxUint64-sum {
+				return math.MaxUint64
+			}
+			sum += count
+		}
+	}
+	return sum
+}
+
+// Increment returns a copy of the counter with the count of the node
+// in the generation incremented by delta
+func (c GCounter) Increment(id NodeId, genNumber uint64, delta uint64) GCounter {
+	counter := c.Merge(GCounter{id: {genNumber: 0}})
+	counter[id][genNumber] += delta
+	return counter
+}
+
+// Merge returns a counter with the highest count of every node in
+// every generation. It is nil if both counters are empty as empty maps
+// are not kept by gob.
+func (c GCounter) Merge(other GCounter) GCounter {
+	if len(c) == 0 && len(other) == 0 {
+		return nil
+	}
+	counter := make(GCounter, len(c)+len(other))
+	for _, g := range []GCounter{c, other} {
+		for id, counts := range g {
+			merged, ok := counter[id]
+			if !ok {
+				merged = make(map[uint64]uint64, len(counts))
+				counter[id] = merged
+			}
+			for genNumber, count := range counts {
+				if old, ok := merged[genNumber]; !ok || count > old {
+					merged[genNumber] = count
+				}
+			}
+		}
+	}
+	return counter
+}
+
+// PNCounter is a counter which can be incremented and decremented. It
+// is a pair of grow-only counters of the increments and decrements.
+type PNCounter struct {
+	Incr GCounter
+	Decr GCounter
+}
+
+// Value returns the sum of the increments minus the decrements. It
+// saturates at MaxInt64 and MinInt64.
+func (c PNCounter) Value() int64 {
+	incr, decr := c.Incr.Value(), c.Decr.Value()
+	if incr >= decr {
+		if incr-decr > math.MaxInt64 {
+			return math.MaxInt64
+		}
+		return int64(incr - decr)
+	}
+	if decr-incr > -math.MinInt64 {
+		return math.MinInt64
+	}
+	return -int64(decr - incr)
+}
+
+// Add returns a copy of the counter with delta added by the node in the
+// generation
+func (c PNCounter) Add(id NodeId, genNumber uint64, delta int64) PNCounter {
+	counter := c.Merge(PNCounter{})
+	if delta >= 0 {
+		counter.Incr = counter.Incr.Increment(id, genNumber, uint64(delta))
+	} else {
+		counter.Decr = counter.Decr.Increment(id, genNumber, uint64(-delta))
+	}
+	return counter
+}
+
+// Merge returns a counter with the highest increments and decrements
+// of every node
+func (c PNCounter) Merge(other PNCounter) PNCounter {
+	return PNCounter{
+		Incr: c.Incr.Merge(other.Incr),
+		Decr: c.Decr.Merge(other.Decr),
+	}
+}
+
+// ORSetTag identifies an addition of an element to an ORSet
+type ORSetTag struct {
+	NodeId    NodeId
+	GenNumber uint64
+	Seq       uint64
+}
+
+// ORSet is an observed-remove set of strings. An element is in the set
+// if it has an addition which no removal has observed, so an addition
+// concurrent with a removal wins.
+type ORSet struct {
+	// Adds are the tags of the additions of every element
+	Adds map[string][]ORSetTag
+	// Removes are the tags of the additions observed by the removals
+	// of every element
+	Removes map[string][]ORSetTag
+}
+
+// Contains returns true if the element is in the set
+func (s ORSet) Contains(element string) bool {
+	removed := s.Removes[element]
+	for _, tag := range s.Adds[element] {
+		if !containsTag(removed, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Elements returns the elements of the set in order
+func (s ORSet) Elements() []string {
+	elements := make([]string, 0, len(s.Adds))
+	for element := range s.Adds {
+		if s.Contains(element) {
+			elements = append(elements, element)
+		}
+	}
+	sort.Strings(elements)
+	return elements
+}
+
+// Add returns a copy of the set with the element added by the node.
+// The additions of a node are numbered within its generation.
+func (s ORSet) Add(element string, id NodeId, genNumber uint64) ORSet {
+	var seq uint64
+	for _, tags := range s.Adds {
+		for _, tag := range tags {
+			if tag.NodeId == id && tag.GenNumber == genNumber &&
+				tag.Seq > seq {
+				seq = tag.Seq
+			}
+		}
+	}
+	tag := ORSetTag{NodeId: id, GenNumber: genNumber, Seq: seq + 1}
+	return s.Merge(ORSet{Adds: map[string][]ORSetTag{element: {tag}}})
+}
+
+// Remove returns a copy of the set with the observed additions of the
+// element removed
+func (s ORSet) Remove(element string, observed []ORSetTag) ORSet {
+	if len(observed) == 0 {
+		return s.Merge(ORSet{})
+	}
+	return s.Merge(ORSet{Removes: map[string][]ORSetTag{element: observed}})
+}
+
+// Merge returns a set with the additions and removals of both sets
+func (s ORSet) Merge(other ORSet) ORSet {
+	return ORSet{
+		Adds:    mergeTags(s.Adds, other.Adds),
+		Removes: mergeTags(s.Removes, other.Removes),
+	}
+}
+
+// mergeTags returns the union of the tags of every element. It is nil
+// if there are no tags as empty maps are not kept by gob.
+func mergeTags(a, b map[string][]ORSetTag) map[string][]ORSetTag {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	merged := make(map[string][]ORSetTag, len(a)+len(b))
+	for _, tagMap := range []map[string][]ORSetTag{a, b} {
+		for element, tags := range tagMap {
+			for _, tag := range tags {
+				if !containsTag(merged[element], tag) {
+					merged[element] = append(merged[element], tag)
+				}
+			}
+		}
+	}
+	for _, tags := range merged {
+		sort.Slice(tags, func(i, j int) bool {
+			return lessTag(tags[i], tags[j])
+		})
+	}
+	return merged
+}
+
+func containsTag(tags []ORSetTag, tag ORSetTag) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func lessTag(a, b ORSetTag) bool {
+	if a.NodeId != b.NodeId {
+		return a.NodeId < b.NodeId
+	}
+	if a.GenNumber != b.GenNumber {
+		return a.GenNumber < b.GenNumber
+	}
+	return a.Seq < b.Seq
+}
+
+// LWWRegister is a register whose value is the one set last by any
+// node. The concrete type of the value must be registered with gob.
+type LWWRegister struct {
+	Value  interface{}
+	Ts     time.Time
+	NodeId NodeId
+}
+
+// Merge returns the register set last. Registers set at the same time
+// are ordered by node id.
+func (r LWWRegister) Merge(other LWWRegister) LWWRegister {
+	if other.Ts.After(r.Ts) ||
+		(other.Ts.Equal(r.Ts) && other.NodeId > r.NodeId) {
+		return other
+	}
+	return r
+}
@@ -0,0 +1,193 @@
+package types
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// checkMerge checks that merging the values is commutative, associative
+// and idempotent
+func checkMerge(
+	t *testing.T,
+	name string,
+	a, b, c interface{},
+	merge func(x, y interface{}) interface{},
+) {
+	if ab, ba := merge(a, b), merge(b, a); !reflect.DeepEqual(ab, ba) {
+		t.Errorf("%v: Expected merge to be commutative, got %v and %v",
+			name, ab, ba)
+	}
+	left, right := merge(merge(a, b), c), merge(a, merge(b, c))
+	if !reflect.DeepEqual(left, right) {
+		t.Errorf("%v: Expected merge to be associative, got %v and %v",
+			name, left, right)
+	}
+	for _, x := range []interface{}{a, merge(a, b)} {
+		if xx := merge(x, x); !reflect.DeepEqual(xx, merge(x, nil)) {
+			t.Errorf("%v: Expected merge to be idempotent, got %v for %v",
+				name, xx, x)
+		}
+	}
+}
+
+func TestGCounterMerge(t *testing.T) {
+	merge := func(x, y interface{}) interface{} {
+		a, _ := x.(GCounter)
+		b, _ := y.(GCounter)
+		return a.Merge(b)
+	}
+	counter := GCounter{}.Increment("1", 1, 3)
+	for _, test := range []struct {
+		name    string
+		a, b, c GCounter
+		value   uint64
+	}{
+		{"empty", nil, nil, nil, 0},
+		{"one node", counter, counter.Increment("1", 1, 2), nil, 5},
+		{"nodes", counter, GCounter{}.Increment("2", 1, 4),
+			GCounter{}.Increment("3", 1, 5), 12},
+		{"generations", counter, counter.Increment("1", 2, 1),
+			GCounter{}.Increment("1", 1, 1), 4},
+	} {
+		checkMerge(t, test.name, test.a, test.b, test.c, merge)
+		merged := test.a.Merge(test.b).Merge(test.c)
+		if v := merged.Value(); v != test.value {
+			t.Errorf("%v: Expected value %v, got %v", test.name, test.value, v)
+		}
+	}
+
+	saturated := GCounter{}.Increment("1", 1, math.MaxUint64).
+		Increment("2", 1, 1)
+	if v := saturated.Value(); v != math.MaxUint64 {
+		t.Error("Expected the value to saturate, got ", v)
+	}
+}
+
+func TestPNCounterMerge(t *testing.T) {
+	merge := func(x, y interface{}) interface{} {
+		a, _ := x.(PNCounter)
+		b, _ := y.(PNCounter)
+		return a.Merge(b)
+	}
+	counter := PNCounter{}.Add("1", 1, 3)
+	for _, test := range []struct {
+		name    string
+		a, b, c PNCounter
+		value   int64
+	}{
+		{"empty", PNCounter{}, PNCounter{}, PNCounter{}, 0},
+		{"increments", counter, PNCounter{}.Add("2", 1, 4),
+			PNCounter{}.Add("3", 1, 5), 12},
+		{"decrements", counter, counter.Add("1", 1, -5),
+			PNCounter{}.Add("2", 1, -1), -3},
+	} {
+		checkMerge(t, test.name, test.a, test.b, test.c, merge)
+		merged := test.a.Merge(test.b).Merge(test.c)
+		if v := merged.Value(); v != test.value {
+			t.Errorf("%v: Expected value %v, got %v", test.name, test.value, v)
+		}
+	}
+
+	for _, test := range []struct {
+		name    string
+		counter PNCounter
+		value   int64
+	}{
+		{"max", PNCounter{}.Add("1", 1, math.MaxInt64).Add("2", 1, 1),
+			math.MaxInt64},
+		{"min", PNCounter{}.Add("1", 1, -math.MaxInt64).Add("2", 1, -2),
+			math.MinInt64},
+		{"exact min", PNCounter{}.Add("1", 1, -math.MaxInt64).Add("2", 1, -1),
+			math.MinInt64},
+		{"large increments", PNCounter{}.Add("1", 1, math.MaxInt64).
+			Add("2", 1, math.MaxInt64).Add("3", 1, -math.MaxInt64),
+			math.MaxInt64},
+	} {
+		if v := test.counter.Value(); v != test.value {
+			t.Errorf("%v: Expected value %v, got %v", test.name, test.value, v)
+		}
+	}
+}
+
+func TestORSetMerge(t *testing.T) {
+	merge := func(x, y interface{}) interface{} {
+		a, _ := x.(ORSet)
+		b, _ := y.(ORSet)
+		return a.Merge(b)
+	}
+	set := ORSet{}.Add("a", "1", 1)
+	for _, test := range []struct {
+		name     string
+		a, b, c  ORSet
+		elements []string
+	}{
+		{"empty", ORSet{}, ORSet{}, ORSet{}, []string{}},
+		{"adds", set, ORSet{}.Add("b", "2", 1), ORSet{}.Add("a", "3", 1),
+			[]string{"a", "b"}},
+		{"removes", set, set.Remove("a", set.Adds["a"]),
+			ORSet{}.Add("c", "2", 1), []string{"c"}},
+	} {
+		checkMerge(t, test.name, test.a, test.b, test.c, merge)
+		merged := test.a.Merge(test.b).Merge(test.c)
+		if e := merged.Elements(); !reflect.DeepEqual(e, test.elements) {
+			t.Errorf("%v: Expected elements %v, got %v",
+				test.name, test.elements, e)
+		}
+	}
+}
+
+func TestORSetConcurrentAddRemove(t *testing.T) {
+	set := ORSet{}.Add("a", "1", 1)
+
+	// Node 1 removes the element it has seen while node 2 adds it again
+	removed := set.Remove("a", set.Adds["a"])
+	added := set.Add("a", "2", 1)
+	for _, merged := range []ORSet{removed.Merge(added), added.Merge(removed)} {
+		if !merged.Contains("a") {
+			t.Error("Expected the concurrent add to win over the remove")
+		}
+	}
+
+	// A remove which observed both additions removes the element
+	merged := removed.Merge(added)
+	merged = merged.Remove("a", merged.Adds["a"])
+	if merged.Contains("a") {
+		t.Error("Expected the element to be removed")
+	}
+	if merged.Merge(added).Contains("a") {
+		t.Error("Expected the observed additions to stay removed")
+	}
+}
+
+func TestLWWRegisterMerge(t *testing.T) {
+	merge := func(x, y interface{}) interface{} {
+		a, _ := x.(LWWRegister)
+		b, _ := y.(LWWRegister)
+		return a.Merge(b)
+	}
+	ts := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name    string
+		a, b, c LWWRegister
+		value   interface{}
+	}{
+		{"empty", LWWRegister{}, LWWRegister{}, LWWRegister{}, nil},
+		{"last write", LWWRegister{"a", ts, "1"},
+			LWWRegister{"b", ts.Add(time.Second), "1"},
+			LWWRegister{"c", ts.Add(-time.Second), "2"}, "b"},
+		{"tie", LWWRegister{"a", ts, "1"}, LWWRegister{"b", ts, "3"},
+			LWWRegister{"c", ts, "2"}, "b"},
+		{"tie and later", LWWRegister{"a", ts, "3"},
+			LWWRegister{"b", ts, "1"},
+			LWWRegister{"c", ts.Add(time.Nanosecond), "2"}, "c"},
+	} {
+		checkMerge(t, test.name, test.a, test.b, test.c, merge)
+		merged := test.a.Merge(test.b).Merge(test.c)
+		if merged.Value != test.value {
+			t.Errorf("%v: Expected value %v, got %v",
+				test.name, test.value, merged.Value)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package types
 
 import (
+	"crypto/ed25519"
 	"fmt"
+	"math"
 	"time"
+
+	"github.com/armon/go-metrics"
 )
 
 type NodeId string
@@ -25,6 +29,10 @@ const (
 	GOSSIP_VERSION_2           string        = "v2"
 )
 
+// GOSSIP_VERSIONS lists the known gossip versions from the oldest
+// to the newest. Compatibility ranges are based on this order.
+var GOSSIP_VERSIONS = []string{DEFAULT_GOSSIP_VERSION, GOSSIP_VERSION_2}
+
 const (
 	NODE_STATUS_INVALID NodeStatus = iota
 	NODE_STATUS_UP
@@ -32,6 +40,21 @@ const (
 	NODE_STATUS_NEVER_GOSSIPED
 	NODE_STATUS_NOT_IN_QUORUM
 	NODE_STATUS_SUSPECT_NOT_IN_QUORUM
+	// NODE_STATUS_MAINTENANCE indicates that the node is alive and in
+	// quorum, but it is draining and will be leaving soon
+	NODE_STATUS_MAINTENANCE
+)
+
+type MaintenanceQuorumPolicy uint8
+
+const (
+	// MAINTENANCE_QUORUM_POLICY_COUNT counts nodes in maintenance
+	// as quorum members which are UP
+	MAINTENANCE_QUORUM_POLICY_COUNT MaintenanceQuorumPolicy = iota
+	// MAINTENANCE_QUORUM_POLICY_EXCLUDE does not consider nodes in
+	// maintenance as quorum members. The quorum is decided amongst
+	// the remaining quorum members.
+	MAINTENANCE_QUORUM_POLICY_EXCLUDE
 )
 
 const (
@@ -48,6 +71,9 @@ type NodeUpdate struct {
 	Addr string
 	// QuorumMember is true if node participates in quorum decisions
 	QuorumMember bool
+	// PublicKey is the node's ed25519 public key used to verify its
+	// identity when nodes authenticate with identity keys
+	PublicKey []byte
 }
 
 type NodeMetaInfo struct {
@@ -56,6 +82,15 @@ type NodeMetaInfo struct {
 	Id            NodeId
 	GenNumber     uint64
 	LastUpdateTs  time.Time
+	// Identity is the node's signature over its id and cluster id
+	Identity []byte
+	// Compression lists the compression types the node can decompress
+	Compression []CompressionType
+	// MinGossipVersion and MaxGossipVersion are the range of gossip
+	// versions of the peers the node accepts. They are empty for nodes
+	// which only accept their own version.
+	MinGossipVersion string
+	MaxGossipVersion string
 }
 
 type NodeInfo struct {
@@ -66,6 +101,50 @@ type NodeInfo struct {
 	Status             NodeStatus
 	Value              StoreMap
 	QuorumMember       bool
+	// StatusUpdateTs is the last time our view of the node's Status
+	// changed. Like Status it is decided locally and is not signed.
+	StatusUpdateTs time.Time
+	// Maintenance is set by the owner node when it is in maintenance
+	Maintenance bool
+	// PeerStatus is the owner node's view of the status of its peers.
+	// It is only filled in by the owner and is used by other nodes to
+	// find out whether the owner can see them.
+	PeerStatus map[NodeId]NodeStatus
+	// Signature is the owner node's signature over its node info. It is
+	// only set when nodes authenticate each other.
+	Signature []byte
+	// Namespaces holds the owner node's values for each namespace
+	Namespaces map[string]StoreMap
+	// Version is bumped by the owner node on every change of its values
+	Version uint64
+	// KeyVersions is the version at which the owner node last set
+	// each of its keys
+	KeyVersions map[StoreKey]uint64
+	// PeerVersions is the owner node's digest of its view of its peers.
+	// It is only filled in by the owner and is used by other nodes to
+	// find out which of their versions the owner has seen.
+	PeerVersions map[NodeId]NodeVersion
+	// KeyFingerprints are the fingerprints of the owner node's encryption
+	// keys, its primary key first. They are used by other nodes to find
+	// out whether a key rotation has reached the owner.
+	KeyFingerprints []string
+}
+
+// NodeVersion identifies a version of a node's values
+type NodeVersion struct {
+	GenNumber uint64
+	Version   uint64
+}
+
+// Acknowledgement tells whether a node has seen a version of a key
+type Acknowledgement struct {
+	// Status is our view of the node's status
+	Status NodeStatus
+	// Seen is the version of our values last seen by the node as told
+	// by its gossiped digest
+	Seen NodeVersion
+	// Acked is true if the node has seen the version of the key
+	Acked bool
 }
 
 type NodeValue struct {
@@ -74,6 +153,67 @@ type NodeValue struct {
 	LastUpdateTs time.Time
 	Status       NodeStatus
 	Value        interface{}
+	// ReceivedTs is the last time we received the owner node's info
+	// and were up to date with it. It is zero if we never received it.
+	ReceivedTs time.Time
+	// Staleness is the time since ReceivedTs when the value was read.
+	// It is MAX_STALENESS if we never received the node's info.
+	Staleness time.Duration
+}
+
+// QueryOptions select the nodes whose values of a key are returned.
+// The zero value selects the nodes with a valid status which have the key.
+type QueryOptions struct {
+	// IncludeMissing also returns the selected nodes which do not have
+	// the key, with a nil Value
+	IncludeMissing bool
+	// Statuses only selects the nodes with one of the statuses. When
+	// empty, the nodes whose status is not NODE_STATUS_INVALID or
+	// NODE_STATUS_NEVER_GOSSIPED are selected.
+	Statuses []NodeStatus
+	// QuorumMembersOnly only selects the quorum members
+	QuorumMembersOnly bool
+	// MaxStaleness leaves out the nodes whose info we received longer
+	// ago. Zero means no limit.
+	MaxStaleness time.Duration
+}
+
+// MAX_STALENESS is the staleness of the values of the nodes whose info
+// we never received
+const MAX_STALENESS = time.Duration(math.MaxInt64)
+
+// NodeLeaveVerdict is the decision on an external node leave request
+// along with the evidence it is based upon.
+type NodeLeaveVerdict struct {
+	// NodeId is the node which should be marked down. It is empty if
+	// no node should be marked down.
+	NodeId NodeId
+	// Target is the node which was suspected to be down
+	Target NodeId
+	// SelfStatus is our status at the time of the decision
+	SelfStatus NodeStatus
+	// TargetProbed is true if the target was probed directly
+	TargetProbed bool
+	// TargetReachable is true if the target responded to our probe
+	// or to the probe of one of our peers
+	TargetReachable bool
+	// IndirectProbes is whether the target responded to the probes
+	// our peers sent on our behalf, keyed by peer. The target is only
+	// probed through the peers if it does not respond to our probe.
+	// The peers which did not answer in time are left out.
+	IndirectProbes map[NodeId]bool
+	// PeerReports is the status of the target as gossiped by our peers.
+	// The peers whose info we received longer than the quorum timeout
+	// ago are left out.
+	PeerReports map[NodeId]NodeStatus
+	// PeersReportingSelfDown is the number of peers which gossip that
+	// they do not see us
+	PeersReportingSelfDown uint
+	// Confirmed is true if the evidence confirms that the target
+	// is unreachable
+	Confirmed bool
+	// Reason describes why NodeId was chosen
+	Reason string
 }
 
 func (n NodeInfo) String() string {
@@ -97,6 +237,237 @@ type GossipIntervals struct {
 	QuorumTimeout time.Duration
 }
 
+// CompressionType is the algorithm used to compress the push/pull state
+type CompressionType uint8
+
+const (
+	COMPRESSION_NONE CompressionType = iota
+	COMPRESSION_FLATE
+)
+
+// Clock is the source of time of a gossiper
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// AfterFunc calls f once the duration has elapsed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a call scheduled with a Clock
+type Timer interface {
+	// Stop prevents the call. It returns false if the call
+	// already happened or was stopped.
+	Stop() bool
+}
+
+// LogLevel is the severity of a log message
+type LogLevel uint8
+
+const (
+	LOG_LEVEL_DEBUG LogLevel = iota
+	LOG_LEVEL_INFO
+	LOG_LEVEL_WARN
+	LOG_LEVEL_ERROR
+)
+
+// LogComponent is the part of the gossiper which logs a message
+type LogComponent string
+
+const (
+	// LOG_COMPONENT_GOSSIP logs the membership and the node lifecycle
+	LOG_COMPONENT_GOSSIP LogComponent = "gossip"
+	// LOG_COMPONENT_STORE logs the changes of the gossiped state
+	LOG_COMPONENT_STORE LogComponent = "store"
+	// LOG_COMPONENT_QUORUM logs the quorum decisions
+	LOG_COMPONENT_QUORUM LogComponent = "quorum"
+	// LOG_COMPONENT_MEMBERLIST logs the output of memberlist
+	LOG_COMPONENT_MEMBERLIST LogComponent = "memberlist"
+)
+
+// LOG_COMPONENTS are all the components which log
+var LOG_COMPONENTS = []LogComponent{
+	LOG_COMPONENT_GOSSIP,
+	LOG_COMPONENT_STORE,
+	LOG_COMPONENT_QUORUM,
+	LOG_COMPONENT_MEMBERLIST,
+}
+
+// Logger is a structured logger
+type Logger interface {
+	// WithFields returns a logger which attaches the fields
+	// to all the messages
+	WithFields(fields map[string]interface{}) Logger
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// GossipOptions are optional settings for a gossiper. The zero value
+// keeps the default behavior.
+type GossipOptions struct {
+	// PeerConfirmedQuorum when set makes a node consider a quorum member
+	// as UP only if that member also reports this node as UP in its
+	// gossiped state. This protects against asymmetric network partitions
+	// where two nodes could otherwise both believe they are in quorum.
+	PeerConfirmedQuorum bool
+	// MaintenanceQuorumPolicy decides how nodes in maintenance are
+	// treated in quorum decisions
+	MaintenanceQuorumPolicy MaintenanceQuorumPolicy
+	// EncryptionKey is the primary key used to encrypt the gossip and
+	// push/pull traffic. It should be either 16, 24, or 32 bytes to select
+	// AES-128, AES-192, or AES-256. Encryption is disabled if it is empty.
+	EncryptionKey []byte
+	// EncryptionKeys are additional keys which are used for decryption
+	EncryptionKeys [][]byte
+	// AuthSecret is a secret shared by all the nodes. When set, nodes
+	// present an HMAC of their id and cluster id and peers which cannot
+	// prove their identity are rejected. It only keeps out nodes which
+	// are not members: every member can sign on behalf of any other
+	// member, so relayed state is not protected against tampering by a
+	// member. Use IdentityKey to verify the origin of relayed state.
+	AuthSecret []byte
+	// IdentityKey is the node's ed25519 private key. When set, nodes
+	// present a signature of their id and cluster id which is verified
+	// against the public keys pinned through UpdateCluster.
+	// Only one of AuthSecret and IdentityKey can be set.
+	IdentityKey ed25519.PrivateKey
+	// MaxKeySize is the maximum encoded size in bytes of a single key
+	// and its value. Zero means no limit.
+	MaxKeySize int
+	// MaxNodeSize is the maximum encoded size in bytes of the state
+	// gossiped by a node. Zero means no limit.
+	MaxNodeSize int
+	// Compression is used for the push/pull state once all the peers
+	// advertise support for it
+	Compression CompressionType
+	// MinGossipVersion and MaxGossipVersion are the range of gossip
+	// versions of the peers this node accepts. They default to the node's
+	// own gossip version. Two nodes gossip if each one's version is in
+	// the other's range. To upgrade a cluster from v1 to v2 without
+	// splitting it, first roll out nodes at v1 with a MaxGossipVersion of
+	// v2 and then roll out nodes at v2 with a MinGossipVersion of v1.
+	MinGossipVersion string
+	MaxGossipVersion string
+	// MetricSink receives the metrics emitted by the gossiper. Metrics
+	// are emitted to the global go-metrics instance if it is nil.
+	MetricSink metrics.MetricSink
+	// Logger receives the log messages of the gossiper and memberlist
+	// with the node id, cluster id and component attached as fields.
+	// The standard logrus logger is used if it is nil.
+	Logger Logger
+	// LogLevels are the minimum levels logged per component. Components
+	// which are not listed log at LOG_LEVEL_INFO.
+	LogLevels map[LogComponent]LogLevel
+	// Clock is used for the update timestamps and the quorum timeout.
+	// The system clock is used if it is nil.
+	Clock Clock
+}
+
+// GossipStats are the counters of the gossip activity of a node
+type GossipStats struct {
+	// Merges is the number of push/pull states merged
+	Merges uint64
+	// BytesSent is the number of push/pull bytes sent
+	BytesSent uint64
+	// BytesReceived is the number of push/pull bytes received
+	BytesReceived uint64
+	// StateTransitions is the number of changes of our status
+	StateTransitions uint64
+	// ForgedUpdates is the number of rejected forged node infos
+	ForgedUpdates uint64
+	// LastGossipTs is the time of our last gossip with a peer
+	LastGossipTs time.Time
+	// QuorumMembers is the number of quorum members and QuorumMembersUp
+	// the number of them which are up as seen by the quorum decisions
+	QuorumMembers   uint
+	QuorumMembersUp uint
+}
+
+// StateTransition is a change of a node's status
+type StateTransition struct {
+	Ts time.Time
+	// Event is the state event which caused the transition
+	Event string
+	From  NodeStatus
+	To    NodeStatus
+}
+
+// DebugMember is a memberlist member as seen by a node
+type DebugMember struct {
+	Name          string
+	NodeId        NodeId
+	Addr          string
+	Port          uint16
+	GossipVersion string
+	// ProtocolVersion is the memberlist protocol version spoken
+	ProtocolVersion uint8
+}
+
+// DebugQuorum is the quorum math of a node
+type DebugQuorum struct {
+	QuorumMembers   uint
+	QuorumMembersUp uint
+	// QuorumNeeded is the number of quorum members which need to
+	// be up for the node to be in quorum
+	QuorumNeeded            uint
+	InQuorum                bool
+	PeerConfirmedQuorum     bool
+	MaintenanceQuorumPolicy MaintenanceQuorumPolicy
+}
+
+// DebugInfo is a dump of a node's view of the gossip cluster
+type DebugInfo struct {
+	NodeId        NodeId
+	ClusterId     string
+	GossipVersion string
+	// State is the name of the node's current state
+	State       string
+	Status      NodeStatus
+	NodeInfoMap NodeInfoMap
+	Members     []DebugMember
+	Quorum      DebugQuorum
+	// Transitions are the recent status changes, oldest first
+	Transitions []StateTransition
+	Stats       GossipStats
+	// Faults are the faults injected in the node
+	Faults GossipFaults
+}
+
+// NamespaceWatchCb is invoked when the value of a key in a namespace
+// changes on a node. The value is nil if the key was deleted.
+type NamespaceWatchCb func(nodeId NodeId, key StoreKey, value interface{})
+
+// Namespace is a view of the gossip store with its own key space.
+// Keys of different namespaces, or of a namespace and the default
+// store, never collide.
+type Namespace interface {
+	// Name returns the name of the namespace
+	Name() string
+
+	// UpdateSelf updates the value of the key for this node.
+	// It returns an error if the update exceeds the size limits.
+	UpdateSelf(key StoreKey, val interface{}) error
+
+	// DeleteSelf deletes the key for this node
+	DeleteSelf(key StoreKey)
+
+	// GetStoreKeyValue returns the values of the key on all
+	// the nodes which have the key
+	GetStoreKeyValue(key StoreKey) NodeValueMap
+
+	// GetStoreKeys returns the keys present on any node
+	GetStoreKeys() []StoreKey
+
+	// Watch registers a callback which is invoked when a key of
+	// the namespace changes on any node, including this node.
+	Watch(cb NamespaceWatchCb)
+
+	// Size returns the encoded size in bytes of this node's
+	// values in the namespace
+	Size() int
+}
+
 // Used by the Gossip protocol
 type StoreMetaInfo map[NodeId]NodeMetaInfo
 type StoreNodes []NodeId
@@ -122,3 +493,24 @@ type MessageChannel interface {
 	// Close terminates the message channel.
 	Close()
 }
+
+// GossipFaults are the faults injected in a gossiper for testing how
+// the cluster and the application react to a misbehaving node.
+// The zero value injects no faults.
+type GossipFaults struct {
+	// DropPushPull drops our state from the push/pulls with the peers.
+	// The membership is still exchanged.
+	DropPushPull bool
+	// CorruptMergeState corrupts the states received in push/pulls
+	// before they are merged
+	CorruptMergeState bool
+	// MergeDelay delays the merge of the states received in push/pulls
+	MergeDelay time.Duration
+	// SuppressAlive ignores the alive notifications of the nodes, so
+	// nodes coming back are not marked up. The peers are still checked
+	// before they are let in.
+	SuppressAlive bool
+	// FreezeStateHandler holds the state events without handling them.
+	// The held events are handled once unfrozen.
+	FreezeStateHandler bool
+}